@@ -0,0 +1,454 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and
+// JSON Patch (RFC 6902) documents to JSON values
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MediaTypeMergePatch = "application/merge-patch+json"
+	MediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+var (
+	// Patch document itself is malformed
+	ErrInvalidPatch = errors.New("invalid patch document")
+	// Patch is well formed but can't be applied to the document
+	ErrPathNotFound = errors.New("path not found")
+	ErrTestFailed   = errors.New("test operation failed")
+	// Patched document doesn't fit the target value
+	ErrInvalidResult = errors.New("patched document is invalid")
+
+	ErrUnsupportedMediaType = errors.New("unsupported patch media type")
+)
+
+// MediaType returns the patch media type of the Content-Type header value
+// and whether it's one of the supported ones
+func MediaType(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+
+	return mediaType, mediaType == MediaTypeMergePatch || mediaType == MediaTypeJSONPatch
+}
+
+// Apply applies the patch of the media type to the document
+func Apply(mediaType string, doc, patch []byte) ([]byte, error) {
+	switch mediaType {
+	case MediaTypeMergePatch:
+		return MergePatch(doc, patch)
+	case MediaTypeJSONPatch:
+		return ApplyPatch(doc, patch)
+	default:
+		return nil, ErrUnsupportedMediaType
+	}
+}
+
+// ApplyTo patches the JSON representation of v, which must be a pointer.
+// v is reset before the result is decoded, so removed members become zero
+// values. Members unknown to v make the result invalid
+func ApplyTo(mediaType string, patch []byte, v any) error {
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal document: %w", err)
+	}
+
+	patched, err := Apply(mediaType, doc, patch)
+	if err != nil {
+		return err
+	}
+
+	target := reflect.ValueOf(v).Elem()
+	target.Set(reflect.Zero(target.Type()))
+
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidResult, err)
+	}
+
+	return nil
+}
+
+// MergePatch applies the merge patch: members of the patch object replace
+// members of the document recursively, null members are removed
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("decode document: %w", err)
+	}
+
+	patchValue, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+
+	return json.Marshal(mergePatch(target, patchValue))
+}
+
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+
+	return targetObject
+}
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ApplyPatch applies operations of the JSON Patch in order. If any of them
+// fails, the error is returned and the document is not changed
+func ApplyPatch(doc, patch []byte) ([]byte, error) {
+	var operations []operation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+
+	root, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("decode document: %w", err)
+	}
+
+	for i, op := range operations {
+		if root, err = op.apply(root); err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %w", i, op.Op, err)
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+func (op operation) apply(root any) (any, error) {
+	if op.Path == nil {
+		return nil, fmt.Errorf("%w: path is required", ErrInvalidPatch)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var from []string
+	switch op.Op {
+	case "move", "copy":
+		if op.From == nil {
+			return nil, fmt.Errorf("%w: from is required", ErrInvalidPatch)
+		}
+		if from, err = parsePointer(*op.From); err != nil {
+			return nil, err
+		}
+	}
+
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		// Missing value differs from null
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: value is required", ErrInvalidPatch)
+		}
+		if value, err = decode(op.Value); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return add(root, path, value)
+	case "remove":
+		return remove(root, path)
+	case "replace":
+		if _, err := get(root, path); err != nil {
+			return nil, err
+		}
+		if root, err = removeIfNotRoot(root, path); err != nil {
+			return nil, err
+		}
+		return add(root, path, value)
+	case "move":
+		// Location can't be moved into its own child
+		if len(path) > len(from) && isPrefix(from, path) {
+			return nil, fmt.Errorf("%w: can't move a value into itself", ErrInvalidPatch)
+		}
+		if value, err = get(root, from); err != nil {
+			return nil, err
+		}
+		if root, err = removeIfNotRoot(root, from); err != nil {
+			return nil, err
+		}
+		return add(root, path, value)
+	case "copy":
+		if value, err = get(root, from); err != nil {
+			return nil, err
+		}
+		return add(root, path, deepCopy(value))
+	case "test":
+		actual, err := get(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(actual, value) {
+			return nil, ErrTestFailed
+		}
+		return root, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// parsePointer splits the JSON Pointer (RFC 6901) into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: pointer %q must start with '/'", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// arrayIndex parses the array index token, "-" is the index after the last
+// element. Indexes up to max are valid
+func arrayIndex(token string, length, max int) (int, error) {
+	if token == "-" {
+		token = strconv.Itoa(length)
+	}
+	// Leading zeros are not allowed
+	if len(token) > 1 && token[0] == '0' {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrPathNotFound, token)
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > max {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrPathNotFound, token)
+	}
+
+	return index, nil
+}
+
+func get(node any, path []string) (any, error) {
+	for _, token := range path {
+		switch container := node.(type) {
+		case map[string]any:
+			child, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q", ErrPathNotFound, token)
+			}
+			node = child
+		case []any:
+			index, err := arrayIndex(token, len(container), len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("%w: %q is not in a container", ErrPathNotFound, token)
+		}
+	}
+
+	return node, nil
+}
+
+// modify calls change for the container of the last token and stores the
+// returned container back into its parent, since changed arrays are new slices
+func modify(node any, path []string, change func(container any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return change(node, path[0])
+	}
+
+	child, err := get(node, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = modify(child, path[1:], change); err != nil {
+		return nil, err
+	}
+
+	switch container := node.(type) {
+	case map[string]any:
+		container[path[0]] = child
+	case []any:
+		index, _ := strconv.Atoi(path[0])
+		container[index] = child
+	}
+
+	return node, nil
+}
+
+func add(root any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return modify(root, path, func(node any, token string) (any, error) {
+		switch container := node.(type) {
+		case map[string]any:
+			container[token] = value
+			return container, nil
+		case []any:
+			index, err := arrayIndex(token, len(container), len(container))
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, fmt.Errorf("%w: %q is not in a container", ErrPathNotFound, token)
+		}
+	})
+}
+
+func remove(root any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: can't remove the whole document", ErrInvalidPatch)
+	}
+
+	return modify(root, path, func(node any, token string) (any, error) {
+		switch container := node.(type) {
+		case map[string]any:
+			if _, ok := container[token]; !ok {
+				return nil, fmt.Errorf("%w: member %q", ErrPathNotFound, token)
+			}
+			delete(container, token)
+			return container, nil
+		case []any:
+			index, err := arrayIndex(token, len(container), len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%w: %q is not in a container", ErrPathNotFound, token)
+		}
+	})
+}
+
+// removeIfNotRoot removes the value before it's replaced by add,
+// the root is replaced by add itself
+func removeIfNotRoot(root any, path []string) (any, error) {
+	if len(path) == 0 {
+		return root, nil
+	}
+
+	return remove(root, path)
+}
+
+// decode keeps numbers as json.Number, so large integers are not rounded
+func decode(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	return value, nil
+}
+
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(v))
+		for name, member := range v {
+			copied[name] = deepCopy(member)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(v))
+		for i, element := range v {
+			copied[i] = deepCopy(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// equal compares values as the test operation requires: numbers by value,
+// objects regardless of member order
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, member := range a {
+			other, ok := b[name]
+			if !ok || !equal(member, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okX := new(big.Rat).SetString(a.String())
+		y, okY := new(big.Rat).SetString(b.String())
+		return okX && okY && x.Cmp(y) == 0
+	default:
+		return a == b
+	}
+}
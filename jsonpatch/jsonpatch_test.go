@@ -0,0 +1,421 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type patchTest struct {
+	name  string
+	doc   string
+	patch string
+	// Expected document, unless err is set
+	want string
+	err  error
+}
+
+// jsonEqual compares JSON documents regardless of member order and formatting
+func jsonEqual(t *testing.T, got []byte, want string) bool {
+	t.Helper()
+
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("decode result %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("decode expected %s: %v", want, err)
+	}
+
+	return reflect.DeepEqual(gotValue, wantValue)
+}
+
+func runPatchTests(t *testing.T, apply func(doc, patch []byte) ([]byte, error), tests []patchTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apply([]byte(tt.doc), []byte(tt.patch))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %s, %v, want %v", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if !jsonEqual(t, got, tt.want) {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Examples of RFC 6902 Appendix A
+func TestApplyPatchRFCExamples(t *testing.T) {
+	runPatchTests(t, ApplyPatch, []patchTest{
+		{
+			name:  "A.1 adding an object member",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			want:  `{"baz": "qux", "foo": "bar"}`,
+		},
+		{
+			name:  "A.2 adding an array element",
+			doc:   `{"foo": ["bar", "baz"]}`,
+			patch: `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			want:  `{"foo": ["bar", "qux", "baz"]}`,
+		},
+		{
+			name:  "A.3 removing an object member",
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "remove", "path": "/baz"}]`,
+			want:  `{"foo": "bar"}`,
+		},
+		{
+			name:  "A.4 removing an array element",
+			doc:   `{"foo": ["bar", "qux", "baz"]}`,
+			patch: `[{"op": "remove", "path": "/foo/1"}]`,
+			want:  `{"foo": ["bar", "baz"]}`,
+		},
+		{
+			name:  "A.5 replacing a value",
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			want:  `{"baz": "boo", "foo": "bar"}`,
+		},
+		{
+			name:  "A.6 moving a value",
+			doc:   `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch: `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			want:  `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{
+			name:  "A.7 moving an array element",
+			doc:   `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch: `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			want:  `{"foo": ["all", "cows", "eat", "grass"]}`,
+		},
+		{
+			name:  "A.8 testing a value: success",
+			doc:   `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch: `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			want:  `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		{
+			name:  "A.9 testing a value: error",
+			doc:   `{"baz": "qux"}`,
+			patch: `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			err:   ErrTestFailed,
+		},
+		{
+			name:  "A.10 adding a nested member object",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			want:  `{"foo": "bar", "child": {"grandchild": {}}}`,
+		},
+		{
+			name:  "A.11 ignoring unrecognized elements",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			want:  `{"foo": "bar", "baz": "qux"}`,
+		},
+		{
+			name:  "A.12 adding to a nonexistent target",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			// The last of duplicate members is used, removing a missing member fails
+			name:  "A.13 invalid JSON patch document",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux", "op": "remove"}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "A.14 ~ escape ordering",
+			doc:   `{"/": 9, "~1": 10}`,
+			patch: `[{"op": "test", "path": "/~01", "value": 10}]`,
+			want:  `{"/": 9, "~1": 10}`,
+		},
+		{
+			name:  "A.15 comparing strings and numbers",
+			doc:   `{"/": 9, "~1": 10}`,
+			patch: `[{"op": "test", "path": "/~01", "value": "10"}]`,
+			err:   ErrTestFailed,
+		},
+		{
+			name:  "A.16 adding an array value",
+			doc:   `{"foo": ["bar"]}`,
+			patch: `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			want:  `{"foo": ["bar", ["abc", "def"]]}`,
+		},
+	})
+}
+
+func TestApplyPatch(t *testing.T) {
+	runPatchTests(t, ApplyPatch, []patchTest{
+		{
+			name:  "pointer escapes",
+			doc:   `{"a/b": 1, "m~n": 2}`,
+			patch: `[{"op": "replace", "path": "/a~1b", "value": 3}, {"op": "remove", "path": "/m~0n"}]`,
+			want:  `{"a/b": 3}`,
+		},
+		{
+			name:  "empty member name",
+			doc:   `{"": 1}`,
+			patch: `[{"op": "replace", "path": "/", "value": 2}]`,
+			want:  `{"": 2}`,
+		},
+		{
+			name:  "replace the whole document",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "replace", "path": "", "value": [1]}]`,
+			want:  `[1]`,
+		},
+		{
+			name:  "remove the whole document",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "remove", "path": ""}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "add null value",
+			doc:   `{}`,
+			patch: `[{"op": "add", "path": "/foo", "value": null}]`,
+			want:  `{"foo": null}`,
+		},
+		{
+			name:  "missing value",
+			doc:   `{}`,
+			patch: `[{"op": "add", "path": "/foo"}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "missing path",
+			doc:   `{}`,
+			patch: `[{"op": "remove"}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "missing from",
+			doc:   `{"foo": 1}`,
+			patch: `[{"op": "copy", "path": "/bar"}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "pointer without leading slash",
+			doc:   `{"foo": 1}`,
+			patch: `[{"op": "remove", "path": "foo"}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "unknown operation",
+			doc:   `{}`,
+			patch: `[{"op": "merge", "path": "/foo", "value": 1}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "patch is not an array",
+			doc:   `{}`,
+			patch: `{"op": "add", "path": "/foo", "value": 1}`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "replace missing member",
+			doc:   `{"foo": 1}`,
+			patch: `[{"op": "replace", "path": "/bar", "value": 2}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "append with dash",
+			doc:   `[1, 2]`,
+			patch: `[{"op": "add", "path": "/-", "value": 3}]`,
+			want:  `[1, 2, 3]`,
+		},
+		{
+			name:  "add at the array length",
+			doc:   `[1, 2]`,
+			patch: `[{"op": "add", "path": "/2", "value": 3}]`,
+			want:  `[1, 2, 3]`,
+		},
+		{
+			name:  "add past the array length",
+			doc:   `[1, 2]`,
+			patch: `[{"op": "add", "path": "/3", "value": 3}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "dash refers to no element",
+			doc:   `[1, 2]`,
+			patch: `[{"op": "remove", "path": "/-"}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "dash inside the path",
+			doc:   `[[1]]`,
+			patch: `[{"op": "add", "path": "/-/0", "value": 2}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "array index with leading zero",
+			doc:   `[1, 2]`,
+			patch: `[{"op": "remove", "path": "/01"}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "negative array index",
+			doc:   `[1, 2]`,
+			patch: `[{"op": "remove", "path": "/-1"}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "nested array element",
+			doc:   `{"a": [{"b": [1, 2]}]}`,
+			patch: `[{"op": "remove", "path": "/a/0/b/0"}, {"op": "add", "path": "/a/0/b/-", "value": 3}]`,
+			want:  `{"a": [{"b": [2, 3]}]}`,
+		},
+		{
+			name:  "move into its own child",
+			doc:   `{"a": {"b": {}}}`,
+			patch: `[{"op": "move", "from": "/a", "path": "/a/b/c"}]`,
+			err:   ErrInvalidPatch,
+		},
+		{
+			name:  "move to the same location",
+			doc:   `{"a": {"b": 1}}`,
+			patch: `[{"op": "move", "from": "/a", "path": "/a"}]`,
+			want:  `{"a": {"b": 1}}`,
+		},
+		{
+			name:  "move to a sibling with a common prefix",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "move", "from": "/a", "path": "/ab"}]`,
+			want:  `{"ab": 1}`,
+		},
+		{
+			name:  "copy is deep",
+			doc:   `{"a": {"b": [1]}}`,
+			patch: `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/a/b/-", "value": 2}]`,
+			want:  `{"a": {"b": [1, 2]}, "c": {"b": [1]}}`,
+		},
+		{
+			name:  "test numbers by value",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "test", "path": "/a", "value": 1.0}, {"op": "test", "path": "/a", "value": 1e0}]`,
+			want:  `{"a": 1}`,
+		},
+		{
+			name:  "test objects regardless of member order",
+			doc:   `{"a": {"x": 1, "y": [true, null]}}`,
+			patch: `[{"op": "test", "path": "/a", "value": {"y": [true, null], "x": 1}}]`,
+			want:  `{"a": {"x": 1, "y": [true, null]}}`,
+		},
+		{
+			name:  "test array order matters",
+			doc:   `{"a": [1, 2]}`,
+			patch: `[{"op": "test", "path": "/a", "value": [2, 1]}]`,
+			err:   ErrTestFailed,
+		},
+		{
+			name:  "test null against missing member",
+			doc:   `{}`,
+			patch: `[{"op": "test", "path": "/a", "value": null}]`,
+			err:   ErrPathNotFound,
+		},
+		{
+			name:  "test the whole document",
+			doc:   `[1]`,
+			patch: `[{"op": "test", "path": "", "value": [1]}]`,
+			want:  `[1]`,
+		},
+		{
+			name:  "path through a scalar",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "add", "path": "/a/b", "value": 2}]`,
+			err:   ErrPathNotFound,
+		},
+	})
+}
+
+// Large integers keep their precision, they are not converted to float64
+func TestApplyPatchKeepsLargeNumbers(t *testing.T) {
+	got, err := ApplyPatch([]byte(`{"a": 9007199254740993}`), []byte(`[{"op": "copy", "from": "/a", "path": "/b"}]`))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if want := `{"a":9007199254740993,"b":9007199254740993}`; string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// Examples of RFC 7396 Appendix A
+func TestMergePatchRFCExamples(t *testing.T) {
+	runPatchTests(t, MergePatch, []patchTest{
+		{name: "replace member", doc: `{"a": "b"}`, patch: `{"a": "c"}`, want: `{"a": "c"}`},
+		{name: "add member", doc: `{"a": "b"}`, patch: `{"b": "c"}`, want: `{"a": "b", "b": "c"}`},
+		{name: "remove member", doc: `{"a": "b"}`, patch: `{"a": null}`, want: `{}`},
+		{name: "remove one of members", doc: `{"a": "b", "b": "c"}`, patch: `{"a": null}`, want: `{"b": "c"}`},
+		{name: "array by string", doc: `{"a": ["b"]}`, patch: `{"a": "c"}`, want: `{"a": "c"}`},
+		{name: "string by array", doc: `{"a": "c"}`, patch: `{"a": ["b"]}`, want: `{"a": ["b"]}`},
+		{name: "nested objects", doc: `{"a": {"b": "c"}}`, patch: `{"a": {"b": "d", "c": null}}`, want: `{"a": {"b": "d"}}`},
+		{name: "arrays are replaced", doc: `{"a": [{"b": "c"}]}`, patch: `{"a": [1]}`, want: `{"a": [1]}`},
+		{name: "array document", doc: `["a", "b"]`, patch: `["c", "d"]`, want: `["c", "d"]`},
+		{name: "object by array", doc: `{"a": "b"}`, patch: `["c"]`, want: `["c"]`},
+		{name: "null patch", doc: `{"a": "foo"}`, patch: `null`, want: `null`},
+		{name: "string patch", doc: `{"a": "foo"}`, patch: `"bar"`, want: `"bar"`},
+		{name: "nulls of the document are kept", doc: `{"e": null}`, patch: `{"a": 1}`, want: `{"e": null, "a": 1}`},
+		{name: "array by object", doc: `[1, 2]`, patch: `{"a": "b", "c": null}`, want: `{"a": "b"}`},
+		{name: "nulls of new members are dropped", doc: `{}`, patch: `{"a": {"bb": {"ccc": null}}}`, want: `{"a": {"bb": {}}}`},
+		{name: "invalid patch", doc: `{}`, patch: `{"a":`, err: ErrInvalidPatch},
+		{name: "data after the patch", doc: `{}`, patch: `{} {}`, err: ErrInvalidPatch},
+	})
+}
+
+func TestMediaType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+		ok          bool
+	}{
+		{"application/merge-patch+json", MediaTypeMergePatch, true},
+		{"application/json-patch+json; charset=utf-8", MediaTypeJSONPatch, true},
+		{"application/json", "application/json", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := MediaType(tt.contentType)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("MediaType(%q) = %q, %t, want %q, %t", tt.contentType, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if _, err := Apply("application/json", []byte(`{}`), []byte(`{}`)); !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Errorf("got %v, want %v", err, ErrUnsupportedMediaType)
+	}
+}
+
+func TestApplyTo(t *testing.T) {
+	type document struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags,omitempty"`
+	}
+
+	doc := document{Name: "a", Tags: []string{"x"}}
+	if err := ApplyTo(MediaTypeMergePatch, []byte(`{"tags": null}`), &doc); err != nil {
+		t.Fatalf("merge patch: %v", err)
+	}
+	if !reflect.DeepEqual(doc, document{Name: "a"}) {
+		t.Fatalf("got %+v, removed members must become zero values", doc)
+	}
+
+	err := ApplyTo(MediaTypeJSONPatch, []byte(`[{"op": "add", "path": "/unknown", "value": 1}]`), &doc)
+	if !errors.Is(err, ErrInvalidResult) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidResult)
+	}
+	err = ApplyTo(MediaTypeJSONPatch, []byte(`[{"op": "replace", "path": "/name", "value": 1}]`), &doc)
+	if !errors.Is(err, ErrInvalidResult) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidResult)
+	}
+}
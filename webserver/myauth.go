@@ -0,0 +1,52 @@
+package webserver
+
+import (
+	"strings"
+
+	"github.com/ermakovov/learn-golang/webserver2"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	localsUserID    = "user_id"
+	localsUserEmail = "user_email"
+)
+
+// OptionalAuth authenticates users by access tokens issued by the JWT auth
+// server. Requests without a token pass as anonymous, invalid tokens are rejected
+func OptionalAuth(c *fiber.Ctx) error {
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if authorization == "" {
+		return c.Next()
+	}
+
+	tokenString, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid Authorization header")
+	}
+
+	claims, err := webserver2.ParseAccessToken(tokenString)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Invalid access token")
+	}
+	c.Locals(localsUserID, claims.UserID)
+	c.Locals(localsUserEmail, claims.Email)
+
+	return c.Next()
+}
+
+// RequireAuth is OptionalAuth which rejects anonymous requests
+func RequireAuth(c *fiber.Ctx) error {
+	if c.Get(fiber.HeaderAuthorization) == "" {
+		return c.Status(fiber.StatusUnauthorized).SendString("Access token is required")
+	}
+
+	return OptionalAuth(c)
+}
+
+// authUserID returns the ID of the user authenticated by OptionalAuth or RequireAuth
+func authUserID(c *fiber.Ctx) (int64, bool) {
+	userID, ok := c.Locals(localsUserID).(int64)
+
+	return userID, ok
+}
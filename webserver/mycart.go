@@ -0,0 +1,431 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// Anonymous carts are identified by this header, the ID is generated
+	// by the server on the first change of the cart
+	headerCartID = "X-Cart-ID"
+	// Quantity of a product in a cart, the lte tags of requests must match
+	maxCartItemQuantity = 10000
+)
+
+type (
+	AddCartItemRequest struct {
+		ProductID int64 `json:"product_id" validate:"required"`
+		Quantity  int64 `json:"quantity" validate:"required,gte=1,lte=10000"`
+	}
+
+	// Zero quantity removes the item
+	UpdateCartItemRequest struct {
+		Quantity int64 `json:"quantity" validate:"gte=0,lte=10000"`
+	}
+
+	CartResponse struct {
+		Items []CartItemResponse `json:"items"`
+		// Preview computed from current prices, the final total is computed on checkout
+		SubtotalMinor int64  `json:"subtotal_minor"`
+		Currency      string `json:"currency,omitempty"`
+	}
+
+	CartItemResponse struct {
+		ProductID      int64  `json:"product_id"`
+		SKU            string `json:"sku,omitempty"`
+		Name           string `json:"name,omitempty"`
+		Quantity       int64  `json:"quantity"`
+		UnitPriceMinor int64  `json:"unit_price_minor"`
+		LineTotalMinor int64  `json:"line_total_minor"`
+		Available      bool   `json:"available"`
+	}
+)
+
+// Cart owner is either a logged in user or an anonymous cart ID
+type cartOwner string
+
+func userCartOwner(userID int64) cartOwner {
+	return cartOwner("user:" + strconv.FormatInt(userID, 10))
+}
+
+func anonymousCartOwner(cartID string) cartOwner {
+	return cartOwner("anonymous:" + cartID)
+}
+
+type CartHandler struct {
+	storage  *CartStorage
+	products ProductGetter
+	orders   *OrderHandler
+	validate *validator.Validate
+}
+
+// cartOwner picks the user cart for logged in users and the anonymous
+// cart otherwise. With create set, a new anonymous cart ID is generated
+// and returned in the response header if the client has none
+func (h *CartHandler) cartOwner(c *fiber.Ctx, create bool) (cartOwner, bool) {
+	if userID, ok := authUserID(c); ok {
+		h.mergeAnonymousCart(c, userID)
+		return userCartOwner(userID), true
+	}
+
+	cartID := c.Get(headerCartID)
+	if cartID == "" {
+		if !create {
+			return "", false
+		}
+		cartID = uuid.NewString()
+	}
+	c.Set(headerCartID, cartID)
+
+	return anonymousCartOwner(cartID), true
+}
+
+// mergeAnonymousCart moves the anonymous cart, which the client still sends
+// after logging in, into the user cart. Logins are handled by the JWT server,
+// so this happens on the first cart request with a token instead of
+// requiring clients to call POST /cart/merge
+func (h *CartHandler) mergeAnonymousCart(c *fiber.Ctx, userID int64) {
+	if cartID := c.Get(headerCartID); cartID != "" {
+		h.storage.Merge(anonymousCartOwner(cartID), userCartOwner(userID))
+	}
+}
+
+func (h *CartHandler) GetCart(c *fiber.Ctx) error {
+	owner, ok := h.cartOwner(c, false)
+	if !ok {
+		return c.JSON(h.cartResponse(nil))
+	}
+
+	return c.JSON(h.cartResponse(h.storage.Items(owner)))
+}
+
+func (h *CartHandler) AddItem(c *fiber.Ctx) error {
+	var req AddCartItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	if _, err := h.products.GetProduct(req.ProductID); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString("Product not found")
+	}
+
+	owner, _ := h.cartOwner(c, true)
+	items, err := h.storage.AddItem(owner, req.ProductID, req.Quantity)
+	if errors.Is(err, errCartItemQuantity) {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	return c.JSON(h.cartResponse(items))
+}
+
+func (h *CartHandler) UpdateItem(c *fiber.Ctx) error {
+	productID, err := strconv.ParseInt(c.Params("productId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+	}
+
+	var req UpdateCartItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	owner, ok := h.cartOwner(c, false)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Cart item not found")
+	}
+
+	items, err := h.storage.SetQuantity(owner, productID, req.Quantity)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Cart item not found")
+	}
+
+	return c.JSON(h.cartResponse(items))
+}
+
+func (h *CartHandler) RemoveItem(c *fiber.Ctx) error {
+	productID, err := strconv.ParseInt(c.Params("productId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+	}
+
+	owner, ok := h.cartOwner(c, false)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Cart item not found")
+	}
+
+	items, err := h.storage.SetQuantity(owner, productID, 0)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Cart item not found")
+	}
+
+	return c.JSON(h.cartResponse(items))
+}
+
+// MergeCart moves items of the anonymous cart into the cart of the user
+// who has just logged in. Quantities of products present in both carts are
+// summed. Other cart requests with a token and the header merge carts as well
+func (h *CartHandler) MergeCart(c *fiber.Ctx) error {
+	userID, ok := authUserID(c)
+	if !ok {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	cartID := c.Get(headerCartID)
+	if cartID == "" {
+		return c.Status(fiber.StatusBadRequest).SendString(headerCartID + " header is required")
+	}
+
+	items := h.storage.Merge(anonymousCartOwner(cartID), userCartOwner(userID))
+
+	return c.JSON(h.cartResponse(items))
+}
+
+// Checkout turns the user cart into an order. The cart is emptied only
+// if the order is placed, otherwise it's left as is
+func (h *CartHandler) Checkout(c *fiber.Ctx) error {
+	userID, ok := authUserID(c)
+	if !ok {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	h.mergeAnonymousCart(c, userID)
+
+	var order Order
+	err := h.storage.Checkout(userCartOwner(userID), func(items []CartItem) error {
+		reqItems := make([]CreateOrderItemRequest, 0, len(items))
+		for _, item := range items {
+			reqItems = append(reqItems, CreateOrderItemRequest(item))
+		}
+
+		var err error
+		order, err = h.orders.placeOrder(userID, reqItems)
+
+		return err
+	})
+	if errors.Is(err, errCartEmpty) {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+	if status, ok := placeOrderErrorStatus(err); ok {
+		return c.Status(status).SendString(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("checkout: %w", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newGetOrderResponse(order))
+}
+
+// cartResponse prices cart items with current product data. Products
+// removed from the catalog are shown as unavailable
+func (h *CartHandler) cartResponse(items []CartItem) CartResponse {
+	resp := CartResponse{Items: make([]CartItemResponse, 0, len(items))}
+
+	for _, item := range items {
+		itemResp := CartItemResponse{ProductID: item.ProductID, Quantity: item.Quantity}
+
+		product, err := h.products.GetProduct(item.ProductID)
+		if err == nil {
+			itemResp.SKU = product.SKU
+			itemResp.Name = product.Name
+			itemResp.UnitPriceMinor = product.PriceMinor
+			itemResp.Available = product.Stock >= item.Quantity
+
+			if resp.Currency == "" {
+				resp.Currency = product.Currency
+			}
+			// Lines overflowing the total can't be ordered, they are
+			// left out of the subtotal as unavailable
+			overflow := product.PriceMinor != 0 && item.Quantity > math.MaxInt64/product.PriceMinor
+			if !overflow {
+				itemResp.LineTotalMinor = product.PriceMinor * item.Quantity
+				overflow = resp.SubtotalMinor > math.MaxInt64-itemResp.LineTotalMinor
+			}
+			if overflow {
+				itemResp.LineTotalMinor = 0
+				itemResp.Available = false
+			} else {
+				resp.SubtotalMinor += itemResp.LineTotalMinor
+			}
+		}
+
+		resp.Items = append(resp.Items, itemResp)
+	}
+
+	return resp
+}
+
+// Cart model
+type CartItem struct {
+	ProductID int64
+	Quantity  int64
+}
+
+// Storage
+type CartStorage struct {
+	mu    sync.Mutex
+	carts map[cartOwner]*cart
+}
+
+// Every cart has its own lock, so checkout of one cart
+// doesn't block changes of others
+type cart struct {
+	mu    sync.Mutex
+	items map[int64]int64 // product ID -> quantity
+}
+
+func NewCartStorage() *CartStorage {
+	return &CartStorage{carts: make(map[cartOwner]*cart)}
+}
+
+var (
+	errCartItemNotFound = errors.New("cart item not found")
+	errCartEmpty        = errors.New("cart is empty")
+	errCartItemQuantity = fmt.Errorf("cart can hold at most %d items of a product", maxCartItemQuantity)
+)
+
+// existingCart never creates a cart, so lookups of missing items
+// don't leave empty carts behind
+func (s *CartStorage) existingCart(owner cartOwner) (*cart, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	crt, ok := s.carts[owner]
+
+	return crt, ok
+}
+
+func (s *CartStorage) cart(owner cartOwner) *cart {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	crt, ok := s.carts[owner]
+	if !ok {
+		crt = &cart{items: make(map[int64]int64)}
+		s.carts[owner] = crt
+	}
+
+	return crt
+}
+
+// Items are sorted by product ID. Must be called with crt.mu held
+func (crt *cart) list() []CartItem {
+	items := make([]CartItem, 0, len(crt.items))
+	for productID, quantity := range crt.items {
+		items = append(items, CartItem{ProductID: productID, Quantity: quantity})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+	return items
+}
+
+func (s *CartStorage) Items(owner cartOwner) []CartItem {
+	crt, ok := s.existingCart(owner)
+	if !ok {
+		return nil
+	}
+
+	crt.mu.Lock()
+	defer crt.mu.Unlock()
+
+	return crt.list()
+}
+
+func (s *CartStorage) AddItem(owner cartOwner, productID, quantity int64) ([]CartItem, error) {
+	crt := s.cart(owner)
+	crt.mu.Lock()
+	defer crt.mu.Unlock()
+
+	if quantity > maxCartItemQuantity-crt.items[productID] {
+		return nil, errCartItemQuantity
+	}
+	crt.items[productID] += quantity
+
+	return crt.list(), nil
+}
+
+func (s *CartStorage) SetQuantity(owner cartOwner, productID, quantity int64) ([]CartItem, error) {
+	crt, ok := s.existingCart(owner)
+	if !ok {
+		return nil, errCartItemNotFound
+	}
+	crt.mu.Lock()
+	defer crt.mu.Unlock()
+
+	if _, ok := crt.items[productID]; !ok {
+		return nil, errCartItemNotFound
+	}
+
+	if quantity == 0 {
+		delete(crt.items, productID)
+	} else {
+		crt.items[productID] = quantity
+	}
+
+	return crt.list(), nil
+}
+
+// Merge moves all items from one cart to another and drops the source cart.
+// The destination cart is created only if there is something to move.
+// Summed quantities are capped at maxCartItemQuantity
+func (s *CartStorage) Merge(from, to cartOwner) []CartItem {
+	s.mu.Lock()
+	src, ok := s.carts[from]
+	delete(s.carts, from)
+	s.mu.Unlock()
+	if !ok {
+		return s.Items(to)
+	}
+
+	dst := s.cart(to)
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	src.mu.Lock()
+	for productID, quantity := range src.items {
+		dst.items[productID] = min(dst.items[productID]+quantity, maxCartItemQuantity)
+	}
+	src.mu.Unlock()
+
+	return dst.list()
+}
+
+// Checkout passes cart items to placeOrder while holding the cart lock and
+// empties the cart if it succeeds, so the cart can't be changed or checked
+// out twice in the meantime
+func (s *CartStorage) Checkout(owner cartOwner, placeOrder func(items []CartItem) error) error {
+	crt, ok := s.existingCart(owner)
+	if !ok {
+		return errCartEmpty
+	}
+	crt.mu.Lock()
+	defer crt.mu.Unlock()
+
+	if len(crt.items) == 0 {
+		return errCartEmpty
+	}
+
+	if err := placeOrder(crt.list()); err != nil {
+		return err
+	}
+
+	clear(crt.items)
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+	idempotencyKeyMaxLength  = 255
+	idempotencyKeyTTL        = 24 * time.Hour
+)
+
+// Response saved for an Idempotency-Key
+type idempotencyEntry struct {
+	fingerprint string
+	done        bool // false while the first request is still being handled
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+type IdempotencyStorage struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]idempotencyEntry
+	lastSweep time.Time
+}
+
+func NewIdempotencyStorage(ttl time.Duration) *IdempotencyStorage {
+	return &IdempotencyStorage{
+		ttl:     ttl,
+		entries: make(map[string]idempotencyEntry),
+	}
+}
+
+// NewIdempotencyMiddleware makes handlers safe to retry. The first request with
+// an Idempotency-Key header is handled as usual and its response is saved, later
+// requests with the same key get the saved response back instead of being handled
+// again. Reusing the key for a different request is answered with 422.
+// Keys are scoped to the user set by the auth middleware, which must run
+// before this one, keys of anonymous requests are shared.
+// Requests without the header are passed through.
+func NewIdempotencyMiddleware(storage *IdempotencyStorage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Header values point into a buffer reused by later requests
+		key := strings.Clone(c.Get(headerIdempotencyKey))
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			return c.Status(fiber.StatusBadRequest).SendString("Idempotency-Key is too long")
+		}
+
+		key = idempotencyScope(c) + key
+		fingerprint := requestFingerprint(c)
+
+		entry, found := storage.begin(key, fingerprint)
+		if found {
+			switch {
+			case entry.fingerprint != fingerprint:
+				return c.Status(fiber.StatusUnprocessableEntity).
+					SendString("Idempotency-Key was already used for a different request")
+			case !entry.done:
+				return c.Status(fiber.StatusConflict).SendString("Request with the same Idempotency-Key is in progress")
+			}
+
+			c.Set(headerIdempotentReplayed, "true")
+			c.Set(fiber.HeaderContentType, entry.contentType)
+			return c.Status(entry.status).Send(entry.body)
+		}
+
+		err := c.Next()
+		status := c.Response().StatusCode()
+		// Failed requests are not saved, so the client can retry them
+		if err != nil || status >= fiber.StatusInternalServerError {
+			storage.forget(key)
+			return err
+		}
+
+		storage.finish(key, status, string(c.Response().Header.ContentType()), c.Response().Body())
+
+		return nil
+	}
+}
+
+// idempotencyScope prefixes keys of the user, so a key reused by another
+// user is not answered with their response. The token itself isn't part of
+// the scope, retries with a refreshed token get the saved response
+func idempotencyScope(c *fiber.Ctx) string {
+	if userID, ok := authUserID(c); ok {
+		return "user:" + strconv.FormatInt(userID, 10) + ":"
+	}
+
+	return "anonymous:"
+}
+
+// Fingerprint identifies the request by its method, URL and body
+func requestFingerprint(c *fiber.Ctx) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Method()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(c.OriginalURL()))
+	hash.Write([]byte{0})
+	hash.Write(c.Body())
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// begin returns the entry saved for the key if there is one, otherwise
+// it marks the key as being in progress
+func (s *IdempotencyStorage) begin(key, fingerprint string) (idempotencyEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	entry, ok := s.entries[key]
+	if ok && now.Before(entry.expiresAt) {
+		return entry, true
+	}
+
+	s.entries[key] = idempotencyEntry{
+		fingerprint: fingerprint,
+		expiresAt:   now.Add(s.ttl),
+	}
+
+	return idempotencyEntry{}, false
+}
+
+func (s *IdempotencyStorage) finish(key string, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return
+	}
+
+	entry.done = true
+	entry.status = status
+	entry.contentType = contentType
+	// Response body buffer is reused by fiber after the request
+	entry.body = append([]byte(nil), body...)
+	s.entries[key] = entry
+}
+
+func (s *IdempotencyStorage) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+}
+
+// sweep drops expired entries at most once per TTL. Must be called with s.mu held
+func (s *IdempotencyStorage) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package webserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Keys are scoped to users, not to their tokens
+func TestIdempotencyKeysOfUsers(t *testing.T) {
+	webApp := fiber.New()
+	calls := 0
+	webApp.Post("/things", RequireAuth, NewIdempotencyMiddleware(NewIdempotencyStorage(time.Hour)), func(c *fiber.Ctx) error {
+		calls++
+		return c.Status(fiber.StatusCreated).SendString(strconv.Itoa(calls))
+	})
+
+	token := func(userID int64, ttl time.Duration) string {
+		payload := jwt.MapClaims{"sub": "user@example.com", "uid": userID, "exp": time.Now().Add(ttl).Unix()}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, payload).SignedString([]byte("secret-phrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	request := func(token, body string) (int, string, bool) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		req.Header.Set(headerIdempotencyKey, "key-1")
+		resp, err := webApp.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody), resp.Header.Get(headerIdempotentReplayed) == "true"
+	}
+
+	if status, body, _ := request(token(1, time.Hour), "a"); status != fiber.StatusCreated || body != "1" {
+		t.Fatalf("first request: %d %q", status, body)
+	}
+	// A refreshed token of the same user gets the saved response
+	if status, body, replayed := request(token(1, 2*time.Hour), "a"); status != fiber.StatusCreated || body != "1" || !replayed {
+		t.Fatalf("retry with a refreshed token: %d %q, replayed %t", status, body, replayed)
+	}
+	if status, _, _ := request(token(1, time.Hour), "b"); status != fiber.StatusUnprocessableEntity {
+		t.Fatalf("key reused for another body: %d", status)
+	}
+	// Another user has keys of their own
+	if status, body, replayed := request(token(2, time.Hour), "a"); status != fiber.StatusCreated || body != "2" || replayed {
+		t.Fatalf("same key of another user: %d %q, replayed %t", status, body, replayed)
+	}
+}
@@ -0,0 +1,146 @@
+package webserver
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type StockTakerReturner interface {
+	TakeStock(quantities map[int64]int64) error
+	ReturnStock(quantities map[int64]int64)
+}
+
+// Stock reserved for a not yet confirmed order
+type Reservation struct {
+	OrderID    string
+	Quantities map[int64]int64 // product ID -> quantity
+	ExpiresAt  time.Time
+}
+
+// Inventory keeps stock reservations of pending orders. Reserved stock is
+// taken from products immediately, so it can't be sold twice, and returned
+// back when the order is cancelled or the reservation expires
+type Inventory struct {
+	mu           sync.Mutex
+	stock        StockTakerReturner
+	ttl          time.Duration
+	reservations map[string]Reservation
+}
+
+func NewInventory(stock StockTakerReturner, ttl time.Duration) *Inventory {
+	return &Inventory{
+		stock:        stock,
+		ttl:          ttl,
+		reservations: make(map[string]Reservation),
+	}
+}
+
+var (
+	errReservationExists   = errors.New("stock is already reserved for order")
+	errReservationNotFound = errors.New("stock reservation not found")
+)
+
+func (inv *Inventory) Reserve(orderID string, items []OrderItem) error {
+	quantities := make(map[int64]int64, len(items))
+	for _, item := range items {
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	inv.mu.Lock()
+	if _, exists := inv.reservations[orderID]; exists {
+		inv.mu.Unlock()
+		return errReservationExists
+	}
+	// Placeholder keeps the order ID busy while stock is being taken without
+	// holding the inventory lock
+	inv.reservations[orderID] = Reservation{OrderID: orderID}
+	inv.mu.Unlock()
+
+	if err := inv.stock.TakeStock(quantities); err != nil {
+		inv.mu.Lock()
+		delete(inv.reservations, orderID)
+		inv.mu.Unlock()
+
+		return err
+	}
+
+	inv.mu.Lock()
+	inv.reservations[orderID] = Reservation{
+		OrderID:    orderID,
+		Quantities: quantities,
+		ExpiresAt:  time.Now().Add(inv.ttl),
+	}
+	inv.mu.Unlock()
+
+	return nil
+}
+
+// take removes a completed reservation. Placeholders of reservations
+// still in progress are left in place
+func (inv *Inventory) take(orderID string) (Reservation, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	reservation, ok := inv.reservations[orderID]
+	if !ok || reservation.Quantities == nil {
+		return Reservation{}, errReservationNotFound
+	}
+	delete(inv.reservations, orderID)
+
+	return reservation, nil
+}
+
+// Release returns reserved stock, e.g. when the order is cancelled
+func (inv *Inventory) Release(orderID string) error {
+	reservation, err := inv.take(orderID)
+	if err != nil {
+		return err
+	}
+
+	inv.stock.ReturnStock(reservation.Quantities)
+
+	return nil
+}
+
+// Commit turns the reservation into a sale, the stock stays taken
+func (inv *Inventory) Commit(orderID string) error {
+	_, err := inv.take(orderID)
+
+	return err
+}
+
+// ReleaseExpired returns stock of all reservations expired by now
+// and reports IDs of their orders
+func (inv *Inventory) ReleaseExpired(now time.Time) []string {
+	inv.mu.Lock()
+	expired := make([]Reservation, 0)
+	for orderID, reservation := range inv.reservations {
+		if reservation.Quantities != nil && !now.Before(reservation.ExpiresAt) {
+			expired = append(expired, reservation)
+			delete(inv.reservations, orderID)
+		}
+	}
+	inv.mu.Unlock()
+
+	orderIDs := make([]string, 0, len(expired))
+	for _, reservation := range expired {
+		inv.stock.ReturnStock(reservation.Quantities)
+		orderIDs = append(orderIDs, reservation.OrderID)
+	}
+
+	return orderIDs
+}
+
+// RunExpirySweeper releases expired reservations every interval
+// and calls onExpire for their orders. It never returns
+func (inv *Inventory) RunExpirySweeper(interval time.Duration, onExpire func(orderID string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, orderID := range inv.ReleaseExpired(now) {
+			onExpire(orderID)
+		}
+	}
+}
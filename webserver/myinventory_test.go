@@ -0,0 +1,188 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestInventoryConcurrentReservations races reservations, releases, commits,
+// expiry and direct stock changes on a few shared products. Run it with
+// -race. Stock must never go negative, and what is left in stock plus what
+// was sold must add up to the initial stock
+func TestInventoryConcurrentReservations(t *testing.T) {
+	const (
+		productCount = 4
+		initialStock = 50
+		workers      = 16
+		rounds       = 300
+	)
+
+	products := NewProductStorage()
+	productIDs := make([]int64, 0, productCount)
+	for i := 0; i < productCount; i++ {
+		id, err := products.CreateProduct(Product{SKU: fmt.Sprintf("SKU-%d", i), Name: "Product", Currency: "USD", Stock: initialStock})
+		if err != nil {
+			t.Fatalf("create product: %v", err)
+		}
+		productIDs = append(productIDs, id)
+	}
+	inventory := NewInventory(products, time.Millisecond)
+
+	var (
+		soldMu sync.Mutex
+		sold   = make(map[int64]int64)
+	)
+	sell := func(quantities map[int64]int64) {
+		soldMu.Lock()
+		defer soldMu.Unlock()
+		for productID, quantity := range quantities {
+			sold[productID] += quantity
+		}
+	}
+
+	checkStock := func() {
+		list, err := products.ListProducts()
+		if err != nil {
+			t.Errorf("list products: %v", err)
+			return
+		}
+		for _, product := range list {
+			if product.Stock < 0 {
+				t.Errorf("product %d has negative stock %d", product.ID, product.Stock)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(2)
+	// Expired reservations are released while orders are still being placed
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				inventory.ReleaseExpired(time.Now())
+			}
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				checkStock()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(w)))
+
+			for i := 0; i < rounds; i++ {
+				items := make([]OrderItem, 0, 2)
+				for j := 0; j < 1+random.Intn(2); j++ {
+					items = append(items, OrderItem{
+						ProductID: productIDs[random.Intn(len(productIDs))],
+						Quantity:  1 + random.Int63n(3),
+					})
+				}
+				quantities := make(map[int64]int64)
+				for _, item := range items {
+					quantities[item.ProductID] += item.Quantity
+				}
+
+				orderID := fmt.Sprintf("order-%d-%d", w, i)
+				err := inventory.Reserve(orderID, items)
+				if errors.Is(err, errInsufficientStock) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("reserve %s: %v", orderID, err)
+					return
+				}
+
+				switch random.Intn(4) {
+				case 0:
+					// Some orders are sold, unless their reservation expired first
+					if err := inventory.Commit(orderID); err == nil {
+						sell(quantities)
+					}
+				case 1:
+					if err := inventory.Release(orderID); err != nil && !errors.Is(err, errReservationNotFound) {
+						t.Errorf("release %s: %v", orderID, err)
+					}
+				case 2:
+					// Stock taken around the inventory, e.g. by another shop
+					if err := products.TakeStock(quantities); err == nil {
+						products.ReturnStock(quantities)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	background.Wait()
+
+	// Whatever is still reserved goes back to stock
+	inventory.ReleaseExpired(time.Now().Add(time.Hour))
+	checkStock()
+
+	for _, productID := range productIDs {
+		product, err := products.GetProduct(productID)
+		if err != nil {
+			t.Fatalf("get product %d: %v", productID, err)
+		}
+		if product.Stock+sold[productID] != initialStock {
+			t.Errorf("product %d: stock %d + sold %d, want %d", productID, product.Stock, sold[productID], initialStock)
+		}
+	}
+}
+
+// TakeStock takes all quantities or none of them, orders are reserved once
+func TestProductStorageTakeStockAllOrNothing(t *testing.T) {
+	products := NewProductStorage()
+	first, _ := products.CreateProduct(Product{SKU: "A", Name: "A", Currency: "USD", Stock: 5})
+	second, _ := products.CreateProduct(Product{SKU: "B", Name: "B", Currency: "USD", Stock: 1})
+
+	err := products.TakeStock(map[int64]int64{first: 3, second: 2})
+	if !errors.Is(err, errInsufficientStock) {
+		t.Fatalf("got %v, want %v", err, errInsufficientStock)
+	}
+	err = products.TakeStock(map[int64]int64{first: 1, 999: 1})
+	if !errors.Is(err, errProductNotFound) {
+		t.Fatalf("got %v, want %v", err, errProductNotFound)
+	}
+
+	inventory := NewInventory(products, time.Hour)
+	if err := inventory.Reserve("order", []OrderItem{{ProductID: first, Quantity: 2}}); err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	err = inventory.Reserve("order", []OrderItem{{ProductID: first, Quantity: 2}})
+	if !errors.Is(err, errReservationExists) {
+		t.Fatalf("got %v, want %v", err, errReservationExists)
+	}
+	if err := inventory.Release("order"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	for productID, want := range map[int64]int64{first: 5, second: 1} {
+		product, _ := products.GetProduct(productID)
+		if product.Stock != want {
+			t.Errorf("product %d: stock %d, want %d", productID, product.Stock, want)
+		}
+	}
+}
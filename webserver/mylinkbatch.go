@@ -0,0 +1,225 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	linkBatchFormatJSON = "json"
+	linkBatchFormatCSV  = "csv"
+
+	linkBatchMaxSize = 1000
+)
+
+type (
+	CreateLinksBatchResponse struct {
+		Created int                      `json:"created"`
+		Results []CreateLinksBatchResult `json:"results"`
+	}
+
+	// Item is the 1-based position of the link in the batch, Line is set for CSV
+	CreateLinksBatchResult struct {
+		Item     int    `json:"item"`
+		Line     int    `json:"line,omitempty"`
+		Status   int    `json:"status"`
+		Code     string `json:"code,omitempty"`
+		ShortURL string `json:"short_url,omitempty"`
+		IntLink  string `json:"internal,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+)
+
+var (
+	errLinkBatchTooLarge = fmt.Errorf("batch must contain at most %d links", linkBatchMaxSize)
+	errLinkBatchHeader   = errors.New("CSV header must contain the internal column")
+)
+
+// batchLink is a link request read from the batch, err is set
+// if the item itself can't be parsed
+type batchLink struct {
+	line int
+	req  CreateLinkRequest
+	err  error
+}
+
+// CreateLinksBatch creates every link of the batch independently, failed
+// items don't affect others. The status of each item is the one CreateLink
+// would respond with
+func (h *LinkHandler) CreateLinksBatch(c *fiber.Ctx) error {
+	format := c.Query("format")
+	if format == "" {
+		switch string(c.Request().Header.ContentType()) {
+		case mimeTextCSV:
+			format = linkBatchFormatCSV
+		default:
+			format = linkBatchFormatJSON
+		}
+	}
+
+	var (
+		links []batchLink
+		err   error
+	)
+	switch format {
+	case linkBatchFormatJSON:
+		links, err = readLinksJSON(c.Body())
+	case linkBatchFormatCSV:
+		links, err = readLinksCSV(bytes.NewReader(c.Body()))
+	default:
+		return c.Status(fiber.StatusBadRequest).SendString("format must be json or csv")
+	}
+	if errors.Is(err, errLinkBatchTooLarge) {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(err.Error())
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	userID, _ := authUserID(c)
+	resp := CreateLinksBatchResponse{Results: make([]CreateLinksBatchResult, 0, len(links))}
+	for i, item := range links {
+		result := CreateLinksBatchResult{Item: i + 1, Line: item.line}
+
+		if item.err != nil {
+			result.Status = fiber.StatusBadRequest
+			result.Error = item.err.Error()
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+
+		link, err := h.createLink(item.req, userID, c.Hostname())
+		if status, ok := createLinkErrorStatus(err); ok {
+			result.Status = status
+			result.Error = err.Error()
+		} else if err != nil {
+			return fmt.Errorf("link creation: %w", err)
+		} else {
+			created := h.createLinkResponse(link)
+			result.Status = fiber.StatusCreated
+			result.Code = created.Code
+			result.ShortURL = created.ShortURL
+			result.IntLink = created.IntLink
+			resp.Created++
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	return c.JSON(resp)
+}
+
+// readLinksJSON reads an array of link requests. Items are decoded one by one,
+// so an item of a wrong shape fails only itself
+func readLinksJSON(body []byte) ([]batchLink, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, errors.New("body must be a JSON array of links")
+	}
+	if len(items) > linkBatchMaxSize {
+		return nil, errLinkBatchTooLarge
+	}
+
+	links := make([]batchLink, 0, len(items))
+	for _, item := range items {
+		var link batchLink
+		link.err = json.Unmarshal(item, &link.req)
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// readLinksCSV reads links from CSV with the columns external, internal,
+// permanent, expires_at and max_clicks. Only internal is required
+func readLinksCSV(r io.Reader) ([]batchLink, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, errLinkBatchHeader
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["internal"]; !ok {
+		return nil, errLinkBatchHeader
+	}
+
+	links := make([]batchLink, 0)
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Rest of the document can't be read reliably after a quoting error
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				links = append(links, batchLink{line: parseErr.StartLine, err: err})
+				break
+			}
+			return nil, fmt.Errorf("read CSV: %w", err)
+		}
+		if len(links) == linkBatchMaxSize {
+			return nil, errLinkBatchTooLarge
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		link := batchLink{line: line}
+		if len(record) != len(header) {
+			link.err = csv.ErrFieldCount
+		} else {
+			link.req, link.err = parseLinkCSVRecord(func(name string) string {
+				if i, ok := columns[name]; ok {
+					return strings.TrimSpace(record[i])
+				}
+				return ""
+			})
+		}
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+func parseLinkCSVRecord(column func(name string) string) (CreateLinkRequest, error) {
+	req := CreateLinkRequest{
+		ExtLink: column("external"),
+		IntLink: column("internal"),
+	}
+
+	var err error
+	if permanent := column("permanent"); permanent != "" {
+		if req.Permanent, err = strconv.ParseBool(permanent); err != nil {
+			return req, fmt.Errorf("permanent: %w", err)
+		}
+	}
+
+	if expiresAt := column("expires_at"); expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return req, fmt.Errorf("expires_at: %w", err)
+		}
+		req.ExpiresAt = &t
+	}
+
+	if maxClicks := column("max_clicks"); maxClicks != "" {
+		if req.MaxClicks, err = strconv.ParseInt(maxClicks, 10, 64); err != nil {
+			return req, fmt.Errorf("max_clicks: %w", err)
+		}
+	}
+
+	return req, nil
+}
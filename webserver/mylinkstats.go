@@ -0,0 +1,425 @@
+package webserver
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math"
+	"math/bits"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Clicks are counted in hourly buckets, older buckets are dropped
+	linkStatsRetention = 90 * 24 * time.Hour
+	// Distinct referrers counted per link, the rest are counted as "other"
+	linkStatsMaxReferrers = 1000
+	linkStatsTopReferrers = 10
+
+	referrerDirect = "direct"
+	referrerOther  = "other"
+	countryUnknown = "unknown"
+)
+
+type (
+	// Single resolution of a short link
+	LinkClick struct {
+		At        time.Time
+		Referrer  string
+		UserAgent string
+		IP        string
+	}
+
+	LinkStatsResponse struct {
+		Clicks         int64             `json:"clicks"`
+		UniqueVisitors int64             `json:"unique_visitors"`
+		Buckets        []LinkStatsBucket `json:"buckets"`
+		TopReferrers   []LinkStatsCount  `json:"top_referrers"`
+		Browsers       map[string]int64  `json:"browsers"`
+		Countries      map[string]int64  `json:"countries"`
+	}
+
+	LinkStatsBucket struct {
+		Start  time.Time `json:"start"`
+		Clicks int64     `json:"clicks"`
+	}
+
+	LinkStatsCount struct {
+		Name   string `json:"name"`
+		Clicks int64  `json:"clicks"`
+	}
+)
+
+// Stats handler
+func (h *LinkHandler) GetLinkStats(c *fiber.Ctx) error {
+	code, err := linkCodeParam(c, "extLink")
+	if err != nil {
+		return fmt.Errorf("link escaping: %w", err)
+	}
+
+	// Stats of expired and deleted links are still available
+	link, err := h.storage.GetLink(code)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Link not found")
+	}
+	if userID, _ := authUserID(c); link.OwnerID != userID {
+		return c.Status(fiber.StatusForbidden).SendString(errLinkForbidden.Error())
+	}
+
+	bucketSize := time.Hour
+	switch c.Query("bucket", "hour") {
+	case "hour":
+	case "day":
+		bucketSize = 24 * time.Hour
+	default:
+		return c.Status(fiber.StatusBadRequest).SendString("bucket must be hour or day")
+	}
+
+	// Last week by default
+	to := time.Now().UTC()
+	if toParam := c.Query("to"); toParam != "" {
+		if to, err = time.Parse(time.RFC3339, toParam); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("to must be in RFC 3339 format")
+		}
+	}
+	from := to.Add(-7 * 24 * time.Hour)
+	if fromParam := c.Query("from"); fromParam != "" {
+		if from, err = time.Parse(time.RFC3339, fromParam); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("from must be in RFC 3339 format")
+		}
+	}
+	if !from.Before(to) {
+		return c.Status(fiber.StatusBadRequest).SendString("from must be before to")
+	}
+
+	return c.JSON(h.stats.Stats(code, from, to, bucketSize))
+}
+
+// recordClick is called after every successful redirect
+func (h *LinkHandler) recordClick(c *fiber.Ctx, code string) {
+	if h.stats == nil {
+		return
+	}
+
+	h.stats.Record(code, LinkClick{
+		At:        time.Now().UTC(),
+		Referrer:  c.Get(fiber.HeaderReferer),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		IP:        c.IP(),
+	})
+}
+
+// Storage
+type LinkStatsStorage struct {
+	mu    sync.Mutex
+	geoIP *GeoIPDatabase // nil if countries are not resolved
+	seed  maphash.Seed
+	links map[string]*linkStats
+}
+
+// Aggregated clicks of a link. Individual clicks are not stored,
+// so memory per link is bounded
+type linkStats struct {
+	clicks    int64
+	hourly    map[int64]int64 // unix hour -> clicks
+	referrers map[string]int64
+	browsers  map[string]int64
+	countries map[string]int64
+	visitors  *hyperLogLog
+}
+
+func NewLinkStatsStorage(geoIP *GeoIPDatabase) *LinkStatsStorage {
+	return &LinkStatsStorage{
+		geoIP: geoIP,
+		seed:  maphash.MakeSeed(),
+		links: make(map[string]*linkStats),
+	}
+}
+
+func (s *LinkStatsStorage) Record(code string, click LinkClick) {
+	referrer := referrerHost(click.Referrer)
+	browser := userAgentFamily(click.UserAgent)
+	country := countryUnknown
+	if s.geoIP != nil {
+		country = s.geoIP.Country(click.IP)
+	}
+	// Visitors are told apart by IP and user agent, only the hash is kept
+	visitor := maphash.String(s.seed, click.IP+"\x00"+click.UserAgent)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.links[code]
+	if !ok {
+		stats = &linkStats{
+			hourly:    make(map[int64]int64),
+			referrers: make(map[string]int64),
+			browsers:  make(map[string]int64),
+			countries: make(map[string]int64),
+			visitors:  newHyperLogLog(),
+		}
+		s.links[code] = stats
+	}
+
+	stats.clicks++
+	hour := click.At.Unix() / 3600
+	if _, exists := stats.hourly[hour]; !exists {
+		// Old buckets are dropped once per hour, when a new one is started
+		oldest := click.At.Add(-linkStatsRetention).Unix() / 3600
+		for bucket := range stats.hourly {
+			if bucket < oldest {
+				delete(stats.hourly, bucket)
+			}
+		}
+	}
+	stats.hourly[hour]++
+
+	if _, known := stats.referrers[referrer]; !known && len(stats.referrers) >= linkStatsMaxReferrers {
+		referrer = referrerOther
+	}
+	stats.referrers[referrer]++
+	stats.browsers[browser]++
+	stats.countries[country]++
+	stats.visitors.add(visitor)
+}
+
+// Delete drops the stats of the link
+func (s *LinkStatsStorage) Delete(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.links, code)
+}
+
+// Stats returns clicks in [from, to) split into buckets of bucketSize
+// (hour or day) together with totals for the whole lifetime of the link
+func (s *LinkStatsStorage) Stats(code string, from, to time.Time, bucketSize time.Duration) LinkStatsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := LinkStatsResponse{
+		Buckets:      make([]LinkStatsBucket, 0),
+		TopReferrers: make([]LinkStatsCount, 0),
+		Browsers:     make(map[string]int64),
+		Countries:    make(map[string]int64),
+	}
+
+	stats, ok := s.links[code]
+	if !ok {
+		return resp
+	}
+
+	resp.Clicks = stats.clicks
+	resp.UniqueVisitors = stats.visitors.estimate()
+	for name, clicks := range stats.browsers {
+		resp.Browsers[name] = clicks
+	}
+	for name, clicks := range stats.countries {
+		resp.Countries[name] = clicks
+	}
+
+	for name, clicks := range stats.referrers {
+		resp.TopReferrers = append(resp.TopReferrers, LinkStatsCount{Name: name, Clicks: clicks})
+	}
+	sort.Slice(resp.TopReferrers, func(i, j int) bool {
+		if resp.TopReferrers[i].Clicks != resp.TopReferrers[j].Clicks {
+			return resp.TopReferrers[i].Clicks > resp.TopReferrers[j].Clicks
+		}
+		return resp.TopReferrers[i].Name < resp.TopReferrers[j].Name
+	})
+	resp.TopReferrers = resp.TopReferrers[:min(len(resp.TopReferrers), linkStatsTopReferrers)]
+
+	buckets := make(map[int64]int64)
+	for hour, clicks := range stats.hourly {
+		at := time.Unix(hour*3600, 0).UTC()
+		if at.Before(from) || !at.Before(to) {
+			continue
+		}
+		buckets[at.Truncate(bucketSize).Unix()] += clicks
+	}
+	for start, clicks := range buckets {
+		resp.Buckets = append(resp.Buckets, LinkStatsBucket{Start: time.Unix(start, 0).UTC(), Clicks: clicks})
+	}
+	sort.Slice(resp.Buckets, func(i, j int) bool { return resp.Buckets[i].Start.Before(resp.Buckets[j].Start) })
+
+	return resp
+}
+
+// referrerHost keeps only the host of the referrer URL
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return referrerDirect
+	}
+
+	parsed, err := url.Parse(referrer)
+	if err != nil || parsed.Hostname() == "" {
+		return referrerOther
+	}
+
+	// Header values point into a buffer reused by later requests
+	return strings.Clone(strings.ToLower(parsed.Hostname()))
+}
+
+// Order matters: many browsers mention others in their user agent,
+// e.g. Edge and Opera contain "Chrome", Chrome contains "Safari"
+var userAgentFamilies = []struct {
+	token  string
+	family string
+}{
+	{"bot", "Bot"},
+	{"spider", "Bot"},
+	{"crawl", "Bot"},
+	{"curl/", "curl"},
+	{"edg/", "Edge"},
+	{"opr/", "Opera"},
+	{"firefox/", "Firefox"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"safari/", "Safari"},
+}
+
+func userAgentFamily(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown"
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	for _, family := range userAgentFamilies {
+		if strings.Contains(userAgent, family.token) {
+			return family.family
+		}
+	}
+
+	return "Other"
+}
+
+// HyperLogLog estimates the number of distinct values using fixed memory:
+// 2^hllPrecision one-byte registers, ~1.6% standard error
+const hllPrecision = 12
+
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	index := hash >> (64 - hllPrecision)
+	// Position of the first set bit in the rest of the hash
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(len(h.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, register := range h.registers {
+		sum += 1 / float64(uint64(1)<<register)
+		if register == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(math.Round(estimate))
+}
+
+// GeoIPDatabase resolves IP addresses to countries using a local CSV file
+// with rows "start_ip,end_ip,country_code", IPv4 and IPv6 ranges are supported
+type GeoIPDatabase struct {
+	ranges []geoIPRange // sorted by start, not overlapping
+}
+
+type geoIPRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+}
+
+func LoadGeoIPCSV(path string) (*GeoIPDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseGeoIPCSV(file)
+}
+
+func ParseGeoIPCSV(r io.Reader) (*GeoIPDatabase, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = 3
+	csvReader.Comment = '#'
+
+	db := &GeoIPDatabase{}
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read GeoIP CSV: %w", err)
+		}
+
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP range start: %w", err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP range end: %w", err)
+		}
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("GeoIP range %s-%s is invalid", start, end)
+		}
+
+		db.ranges = append(db.ranges, geoIPRange{
+			start:   start,
+			end:     end,
+			country: strings.ToUpper(strings.TrimSpace(record[2])),
+		})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+
+	return db, nil
+}
+
+func (db *GeoIPDatabase) Country(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return countryUnknown
+	}
+	addr = addr.Unmap()
+
+	// Last range starting at or before the address
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].start) }) - 1
+	if i < 0 || db.ranges[i].end.Less(addr) || db.ranges[i].start.Is4() != addr.Is4() {
+		return countryUnknown
+	}
+
+	return db.ranges[i].country
+}
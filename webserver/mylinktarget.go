@@ -0,0 +1,295 @@
+package webserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	linkTargetMaxLength = 2048
+
+	// One domain per line, '#' starts a comment. Subdomains of listed
+	// domains are blocked too
+	linkBlocklistPath = "link_blocklist.txt"
+)
+
+var (
+	errLinkTargetInvalid   = errors.New("target link is not a valid absolute URL")
+	errLinkTargetScheme    = errors.New("target link scheme is not allowed")
+	errLinkTargetTooLong   = errors.New("target link is too long")
+	errLinkTargetBlocked   = errors.New("target link domain is blocked")
+	errLinkTargetShortener = errors.New("target link points to the shortener itself")
+)
+
+// LinkTargetPolicy decides which URLs short links may redirect to
+type LinkTargetPolicy struct {
+	Schemes   map[string]bool
+	MaxLength int
+	// Domains in ASCII form, without trailing dots
+	Blocklist map[string]bool
+	// Hosts of the shortener, links to them would redirect in a loop
+	OwnHosts map[string]bool
+}
+
+func NewLinkTargetPolicy(blocklist []string, ownHosts ...string) (*LinkTargetPolicy, error) {
+	policy := &LinkTargetPolicy{
+		Schemes:   map[string]bool{"http": true, "https": true},
+		MaxLength: linkTargetMaxLength,
+		Blocklist: make(map[string]bool, len(blocklist)),
+		OwnHosts:  make(map[string]bool, len(ownHosts)),
+	}
+
+	for _, domain := range blocklist {
+		host, err := normalizeHost(domain)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist domain %q: %w", domain, err)
+		}
+		policy.Blocklist[host] = true
+	}
+
+	for _, ownHost := range ownHosts {
+		host, err := normalizeHost(ownHost)
+		if err != nil {
+			return nil, fmt.Errorf("own host %q: %w", ownHost, err)
+		}
+		policy.OwnHosts[host] = true
+	}
+
+	return policy, nil
+}
+
+// Normalize checks the target and returns it in a canonical form: lower case
+// scheme and host, the host in punycode and no default port. The host the
+// request came to and loopback hosts are treated as own hosts as well.
+// Errors are one of errLinkTarget*
+func (p *LinkTargetPolicy) Normalize(target, requestHost string) (string, error) {
+	target = strings.TrimSpace(target)
+	if len(target) > p.MaxLength {
+		return "", errLinkTargetTooLong
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || !u.IsAbs() || u.Opaque != "" {
+		return "", errLinkTargetInvalid
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !p.Schemes[u.Scheme] {
+		return "", errLinkTargetScheme
+	}
+
+	// Credentials in links are mostly used to disguise the real host,
+	// like https://bank.com@evil.com
+	if u.User != nil {
+		return "", errLinkTargetInvalid
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", errLinkTargetInvalid
+	}
+
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+
+	hostPort := host
+	if port != "" {
+		hostPort = net.JoinHostPort(host, port)
+	}
+	if p.OwnHosts[hostPort] || p.ownRequestHost(hostPort, requestHost) || loopbackHost(host) {
+		return "", errLinkTargetShortener
+	}
+	if p.blocked(host) {
+		return "", errLinkTargetBlocked
+	}
+
+	u.Host = hostPort
+	if port == "" && strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	normalized := u.String()
+	if len(normalized) > p.MaxLength {
+		return "", errLinkTargetTooLong
+	}
+
+	return normalized, nil
+}
+
+// loopbackHost reports whether the normalized host is this machine under
+// any name, the shortener may listen there on any port
+func loopbackHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// ListenHosts returns hosts with the port of all addresses of the machine,
+// which a server listening on all interfaces is reachable at
+func ListenHosts(port string) []string {
+	hosts := []string{net.JoinHostPort("localhost", port)}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return hosts
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, net.JoinHostPort(ipNet.IP.String(), port))
+		}
+	}
+
+	return hosts
+}
+
+func (p *LinkTargetPolicy) ownRequestHost(hostPort, requestHost string) bool {
+	if requestHost == "" {
+		return false
+	}
+
+	own, err := normalizeHost(requestHost)
+
+	return err == nil && own == hostPort
+}
+
+// blocked checks the host and all its parent domains
+func (p *LinkTargetPolicy) blocked(host string) bool {
+	for {
+		if p.Blocklist[host] {
+			return true
+		}
+
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return false
+		}
+		host = parent
+	}
+}
+
+// normalizeHost converts internationalized domain names to punycode and
+// lower cases the result. A port, if any, is kept. IPv4 addresses in the
+// short and numeric forms browsers accept, like 127.1 or 0x7f000001, are
+// converted to dotted ones, other IP addresses are left as is
+func normalizeHost(host string) (string, error) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+	hostname = strings.TrimSuffix(strings.Trim(hostname, "[]"), ".")
+	if hostname == "" {
+		return "", errors.New("empty host")
+	}
+
+	if net.ParseIP(hostname) == nil {
+		hostname, err = idna.Lookup.ToASCII(hostname)
+		if err != nil {
+			return "", err
+		}
+		ip, numeric, err := parseNumericIPv4(strings.ToLower(hostname))
+		if err != nil {
+			return "", err
+		}
+		if numeric {
+			hostname = ip.String()
+		}
+	}
+	hostname = strings.ToLower(hostname)
+
+	if port != "" {
+		return net.JoinHostPort(hostname, port), nil
+	}
+
+	return hostname, nil
+}
+
+// parseNumericIPv4 parses hosts whose last label is a number as IPv4
+// addresses, like the URL standard does: up to four decimal, octal or hex
+// parts, the last one fills the remaining bytes. False means the host
+// is a domain name
+func parseNumericIPv4(host string) (net.IP, bool, error) {
+	parts := strings.Split(host, ".")
+	if _, ok := parseIPv4Part(parts[len(parts)-1]); !ok {
+		return nil, false, nil
+	}
+	if len(parts) > 4 {
+		return nil, true, errors.New("invalid IPv4 address")
+	}
+
+	var address uint64
+	for i, part := range parts {
+		value, ok := parseIPv4Part(part)
+		last := i == len(parts)-1
+		if !ok || (!last && value > 255) || (last && value >= 1<<(8*(5-len(parts)))) {
+			return nil, true, errors.New("invalid IPv4 address")
+		}
+		if last {
+			address = address<<(8*(5-len(parts))) | value
+		} else {
+			address = address<<8 | value
+		}
+	}
+
+	return net.IPv4(byte(address>>24), byte(address>>16), byte(address>>8), byte(address)), true, nil
+}
+
+func parseIPv4Part(part string) (uint64, bool) {
+	base := 10
+	switch {
+	case strings.HasPrefix(part, "0x"):
+		part, base = part[2:], 16
+		if part == "" {
+			return 0, true
+		}
+	case len(part) > 1 && part[0] == '0':
+		part, base = part[1:], 8
+	}
+	if part == "" {
+		return 0, false
+	}
+
+	value, err := strconv.ParseUint(part, base, 32)
+
+	return value, err == nil
+}
+
+func LoadDomainBlocklist(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseDomainBlocklist(file)
+}
+
+func ParseDomainBlocklist(r io.Reader) ([]string, error) {
+	var domains []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			domains = append(domains, line)
+		}
+	}
+
+	return domains, scanner.Err()
+}
@@ -0,0 +1,424 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	orderExportFormatCSV    = "csv"
+	orderExportFormatNDJSON = "ndjson"
+
+	mimeApplicationNDJSON = "application/x-ndjson"
+	mimeTextCSV           = "text/csv"
+
+	// Orders read from the storage at once while exporting
+	orderExportPageSize = 500
+)
+
+// CSV has one row per order line item, order columns are repeated in every
+// row of the order. Orders without items have a single row with empty item columns
+var orderCSVHeader = []string{
+	"order_id", "user_id", "status", "created_at", "currency", "total_minor",
+	"product_id", "sku", "name", "quantity", "unit_price_minor", "line_total_minor",
+}
+
+type (
+	ImportOrdersResponse struct {
+		Imported int                 `json:"imported"`
+		Errors   []ImportOrdersError `json:"errors"`
+	}
+
+	// Line is the line of the NDJSON document or the first CSV line of the order
+	ImportOrdersError struct {
+		Line    int    `json:"line"`
+		OrderID string `json:"order_id,omitempty"`
+		Error   string `json:"error"`
+	}
+)
+
+// ExportOrders streams orders created in [from, to) page by page,
+// so the whole export is never held in memory
+func (h *OrderHandler) ExportOrders(c *fiber.Ctx) error {
+	format := c.Query("format", orderExportFormatCSV)
+
+	var filter OrderFilter
+	if fromParam := c.Query("from"); fromParam != "" {
+		from, err := time.Parse(time.RFC3339Nano, fromParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("from must be in RFC 3339 format")
+		}
+		filter.CreatedAfter = from.Add(-time.Nanosecond)
+	}
+	if toParam := c.Query("to"); toParam != "" {
+		to, err := time.Parse(time.RFC3339Nano, toParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("to must be in RFC 3339 format")
+		}
+		filter.CreatedBefore = to
+	}
+
+	var writeOrders func(w io.Writer, orders []Order) error
+	switch format {
+	case orderExportFormatCSV:
+		c.Set(fiber.HeaderContentType, mimeTextCSV)
+		writeOrders = writeOrdersCSV
+	case orderExportFormatNDJSON:
+		c.Set(fiber.HeaderContentType, mimeApplicationNDJSON)
+		writeOrders = writeOrdersNDJSON
+	default:
+		return c.Status(fiber.StatusBadRequest).SendString("format must be csv or ndjson")
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="orders.%s"`, format))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if format == orderExportFormatCSV {
+			header := csv.NewWriter(w)
+			if err := header.Write(orderCSVHeader); err != nil {
+				return
+			}
+			header.Flush()
+		}
+
+		filter.Limit = orderExportPageSize
+		for {
+			orders, next, err := h.storage.ListOrders(filter)
+			if err != nil {
+				logrus.WithError(err).Error("export orders")
+				return
+			}
+
+			if err := writeOrders(w, orders); err != nil {
+				// Client has gone away
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			if next == nil {
+				return
+			}
+			filter.Cursor = next
+		}
+	})
+
+	return nil
+}
+
+func writeOrdersCSV(w io.Writer, orders []Order) error {
+	csvWriter := csv.NewWriter(w)
+
+	for _, order := range orders {
+		orderColumns := []string{
+			order.ID,
+			strconv.FormatInt(order.UserID, 10),
+			string(order.Status),
+			order.CreatedAt.Format(time.RFC3339Nano),
+			order.Currency,
+			strconv.FormatInt(order.TotalMinor, 10),
+		}
+
+		if len(order.Items) == 0 {
+			if err := csvWriter.Write(append(orderColumns, "", "", "", "", "", "")); err != nil {
+				return err
+			}
+		}
+		for _, item := range order.Items {
+			row := append(orderColumns[:len(orderColumns):len(orderColumns)],
+				strconv.FormatInt(item.ProductID, 10),
+				item.SKU,
+				item.Name,
+				strconv.FormatInt(item.Quantity, 10),
+				strconv.FormatInt(item.UnitPriceMinor, 10),
+				strconv.FormatInt(item.LineTotalMinor, 10),
+			)
+			if err := csvWriter.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+func writeOrdersNDJSON(w io.Writer, orders []Order) error {
+	// Encoder ends every value with a newline
+	encoder := json.NewEncoder(w)
+
+	for _, order := range orders {
+		if err := encoder.Encode(newGetOrderResponse(order)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImportOrders saves orders exported by ExportOrders or produced by other
+// systems. Every order is validated separately, invalid ones are reported
+// and don't stop the import of the rest
+func (h *OrderHandler) ImportOrders(c *fiber.Ctx) error {
+	format := c.Query("format")
+	if format == "" {
+		switch string(c.Request().Header.ContentType()) {
+		case mimeApplicationNDJSON:
+			format = orderExportFormatNDJSON
+		default:
+			format = orderExportFormatCSV
+		}
+	}
+
+	var (
+		orders []importedOrder
+		err    error
+	)
+	switch format {
+	case orderExportFormatCSV:
+		orders, err = readOrdersCSV(bytes.NewReader(c.Body()))
+	case orderExportFormatNDJSON:
+		orders, err = readOrdersNDJSON(bytes.NewReader(c.Body()))
+	default:
+		return c.Status(fiber.StatusBadRequest).SendString("format must be csv or ndjson")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	resp := ImportOrdersResponse{Errors: make([]ImportOrdersError, 0)}
+	for _, imported := range orders {
+		err := imported.err
+		if err == nil {
+			err = h.validateImportedOrder(imported.order)
+		}
+		if err == nil {
+			err = h.storage.ImportOrder(imported.order)
+		}
+
+		if err != nil {
+			resp.Errors = append(resp.Errors, ImportOrdersError{
+				Line:    imported.line,
+				OrderID: imported.order.ID,
+				Error:   err.Error(),
+			})
+			continue
+		}
+		resp.Imported++
+	}
+
+	return c.JSON(resp)
+}
+
+// Order read from the import document, err is set if it couldn't be parsed
+type importedOrder struct {
+	line  int
+	order Order
+	err   error
+}
+
+var errImportHeader = errors.New("CSV header must contain columns: order_id, user_id, status, created_at, currency, total_minor, product_id, sku, name, quantity, unit_price_minor, line_total_minor")
+
+// readOrdersCSV groups consecutive rows with the same order_id into one order
+func readOrdersCSV(r io.Reader) ([]importedOrder, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, errImportHeader
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range orderCSVHeader {
+		if _, ok := columns[name]; !ok {
+			return nil, errImportHeader
+		}
+	}
+
+	orders := make([]importedOrder, 0)
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Rest of the document can't be read reliably after a quoting error
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				orders = append(orders, importedOrder{line: parseErr.StartLine, err: err})
+				break
+			}
+			return nil, fmt.Errorf("read CSV: %w", err)
+		}
+		line, _ := csvReader.FieldPos(0)
+		if len(record) != len(header) {
+			orders = append(orders, importedOrder{line: line, err: csv.ErrFieldCount})
+			continue
+		}
+
+		column := func(name string) string { return record[columns[name]] }
+
+		// Item row of the order from the previous row
+		if last := len(orders) - 1; last >= 0 && orders[last].order.ID == column("order_id") {
+			if orders[last].err == nil {
+				orders[last].err = appendImportedItem(&orders[last].order, column)
+			}
+			continue
+		}
+
+		imported := importedOrder{line: line, order: Order{ID: column("order_id")}}
+		imported.err = parseImportedOrder(&imported.order, column)
+		if imported.err == nil {
+			imported.err = appendImportedItem(&imported.order, column)
+		}
+		orders = append(orders, imported)
+	}
+
+	return orders, nil
+}
+
+func parseImportedOrder(order *Order, column func(name string) string) error {
+	var err error
+
+	if order.UserID, err = strconv.ParseInt(column("user_id"), 10, 64); err != nil {
+		return fmt.Errorf("user_id: %w", err)
+	}
+	order.Status = OrderStatus(column("status"))
+	if order.CreatedAt, err = time.Parse(time.RFC3339Nano, column("created_at")); err != nil {
+		return fmt.Errorf("created_at: %w", err)
+	}
+	order.Currency = column("currency")
+	if order.TotalMinor, err = strconv.ParseInt(column("total_minor"), 10, 64); err != nil {
+		return fmt.Errorf("total_minor: %w", err)
+	}
+
+	return nil
+}
+
+// appendImportedItem adds the item from the row, rows with empty
+// item columns belong to orders without items
+func appendImportedItem(order *Order, column func(name string) string) error {
+	if column("product_id") == "" {
+		return nil
+	}
+
+	item := OrderItem{SKU: column("sku"), Name: column("name")}
+	var err error
+	if item.ProductID, err = strconv.ParseInt(column("product_id"), 10, 64); err != nil {
+		return fmt.Errorf("product_id: %w", err)
+	}
+	if item.Quantity, err = strconv.ParseInt(column("quantity"), 10, 64); err != nil {
+		return fmt.Errorf("quantity: %w", err)
+	}
+	if item.UnitPriceMinor, err = strconv.ParseInt(column("unit_price_minor"), 10, 64); err != nil {
+		return fmt.Errorf("unit_price_minor: %w", err)
+	}
+	if item.LineTotalMinor, err = strconv.ParseInt(column("line_total_minor"), 10, 64); err != nil {
+		return fmt.Errorf("line_total_minor: %w", err)
+	}
+	order.Items = append(order.Items, item)
+
+	return nil
+}
+
+func readOrdersNDJSON(r io.Reader) ([]importedOrder, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	orders := make([]importedOrder, 0)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var row GetOrderResponse
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			orders = append(orders, importedOrder{line: line, err: err})
+			continue
+		}
+
+		order := Order{
+			ID:         row.ID,
+			UserID:     row.UserID,
+			Status:     row.Status,
+			CreatedAt:  row.CreatedAt,
+			Items:      make([]OrderItem, 0, len(row.Items)),
+			Currency:   row.Currency,
+			TotalMinor: row.TotalMinor,
+		}
+		for _, item := range row.Items {
+			order.Items = append(order.Items, OrderItem(item))
+		}
+		orders = append(orders, importedOrder{line: line, order: order})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read NDJSON: %w", err)
+	}
+
+	return orders, nil
+}
+
+var errImportedOrderPending = errors.New("only confirmed, cancelled or expired orders can be imported, pending orders have no stock reserved")
+
+// validateImportedOrder checks the order on its own, products don't have
+// to exist in the catalog any more
+func (h *OrderHandler) validateImportedOrder(order Order) error {
+	switch {
+	case order.ID == "":
+		return errors.New("order_id is required")
+	case order.UserID <= 0:
+		return errors.New("user_id must be positive")
+	case order.CreatedAt.IsZero():
+		return errors.New("created_at is required")
+	}
+
+	switch order.Status {
+	case OrderStatusConfirmed, OrderStatusCancelled, OrderStatusExpired:
+	case OrderStatusPending:
+		return errImportedOrderPending
+	default:
+		return fmt.Errorf("unknown status %q", order.Status)
+	}
+
+	if err := h.validate.Var(order.Currency, "required,iso4217"); err != nil {
+		return fmt.Errorf("currency %q is invalid", order.Currency)
+	}
+
+	var total int64
+	for i, item := range order.Items {
+		if item.Quantity < 1 || item.UnitPriceMinor < 0 {
+			return fmt.Errorf("item %d: quantity must be positive and price non-negative", i+1)
+		}
+		if item.UnitPriceMinor != 0 && item.Quantity > math.MaxInt64/item.UnitPriceMinor {
+			return errOrderTotalOverflow
+		}
+		if item.LineTotalMinor != item.UnitPriceMinor*item.Quantity {
+			return fmt.Errorf("item %d: line_total_minor doesn't match quantity * unit_price_minor", i+1)
+		}
+		if total > math.MaxInt64-item.LineTotalMinor {
+			return errOrderTotalOverflow
+		}
+		total += item.LineTotalMinor
+	}
+	if total != order.TotalMinor {
+		return errors.New("total_minor doesn't match the sum of line totals")
+	}
+
+	return nil
+}
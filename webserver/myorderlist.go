@@ -0,0 +1,213 @@
+package webserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultOrdersPageSize = 50
+	maxOrdersPageSize     = 100
+)
+
+type ListOrdersResponse struct {
+	Orders     []GetOrderResponse `json:"orders"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// Orders are always listed by creation time, orders created
+// at the same time are ordered by ID
+type orderKey struct {
+	createdAt int64 // unix nanoseconds
+	id        string
+}
+
+func newOrderKey(order Order) orderKey {
+	return orderKey{createdAt: order.CreatedAt.UnixNano(), id: order.ID}
+}
+
+func (k orderKey) compare(other orderKey) int {
+	switch {
+	case k.createdAt < other.createdAt:
+		return -1
+	case k.createdAt > other.createdAt:
+		return 1
+	}
+
+	return strings.Compare(k.id, other.id)
+}
+
+// Cursor is opaque for clients: base64 of "<created_at_nanos>:<id>"
+func (k orderKey) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(k.createdAt, 10) + ":" + k.id))
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func parseOrderCursor(cursor string) (orderKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return orderKey{}, errInvalidCursor
+	}
+
+	createdAtParam, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return orderKey{}, errInvalidCursor
+	}
+	createdAt, err := strconv.ParseInt(createdAtParam, 10, 64)
+	if err != nil {
+		return orderKey{}, errInvalidCursor
+	}
+
+	return orderKey{createdAt: createdAt, id: id}, nil
+}
+
+// Sorted list of order keys, used for the whole storage and as secondary indexes
+type orderIndex []orderKey
+
+func (idx orderIndex) insert(key orderKey) orderIndex {
+	pos, _ := slices.BinarySearchFunc(idx, key, orderKey.compare)
+
+	return slices.Insert(idx, pos, key)
+}
+
+func (idx orderIndex) remove(key orderKey) orderIndex {
+	pos, found := slices.BinarySearchFunc(idx, key, orderKey.compare)
+	if !found {
+		return idx
+	}
+
+	return slices.Delete(idx, pos, pos+1)
+}
+
+// after returns position of the first key greater than the provided one
+func (idx orderIndex) after(key orderKey) int {
+	pos, found := slices.BinarySearchFunc(idx, key, orderKey.compare)
+	if found {
+		pos++
+	}
+
+	return pos
+}
+
+// Zero values of the fields mean "any"
+type OrderFilter struct {
+	UserID        int64
+	Status        OrderStatus
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Cursor        *orderKey // list orders after this one
+	Limit         int
+}
+
+// ListOrders returns a page of orders matching the filter and a cursor
+// of the next page, nil if there are no more orders
+func (o *OrderStorage) ListOrders(filter OrderFilter) ([]Order, *orderKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Scan the smallest index which covers the filter
+	index := o.all
+	if filter.UserID != 0 {
+		index = o.byUser[filter.UserID]
+	}
+	if filter.Status != "" {
+		if byStatus := o.byStatus[filter.Status]; filter.UserID == 0 || len(byStatus) < len(index) {
+			index = byStatus
+		}
+	}
+
+	start := 0
+	if !filter.CreatedAfter.IsZero() {
+		// No key has an empty ID, so this is the first order created after the time
+		start = index.after(orderKey{createdAt: filter.CreatedAfter.UnixNano() + 1})
+	}
+	if filter.Cursor != nil {
+		start = max(start, index.after(*filter.Cursor))
+	}
+
+	orders := make([]Order, 0, filter.Limit)
+	for _, key := range index[start:] {
+		if !filter.CreatedBefore.IsZero() && key.createdAt >= filter.CreatedBefore.UnixNano() {
+			break
+		}
+
+		order := o.orders[key.id]
+		if filter.UserID != 0 && order.UserID != filter.UserID {
+			continue
+		}
+		if filter.Status != "" && order.Status != filter.Status {
+			continue
+		}
+
+		if len(orders) == filter.Limit {
+			next := newOrderKey(orders[len(orders)-1])
+			return orders, &next, nil
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil, nil
+}
+
+func (h *OrderHandler) ListOrders(c *fiber.Ctx) error {
+	filter := OrderFilter{
+		Status: OrderStatus(c.Query("status")),
+		Limit:  c.QueryInt("limit", defaultOrdersPageSize),
+	}
+	if filter.Limit < 1 || filter.Limit > maxOrdersPageSize {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("limit must be between 1 and %d", maxOrdersPageSize))
+	}
+
+	switch filter.Status {
+	case "", OrderStatusPending, OrderStatusConfirmed, OrderStatusCancelled, OrderStatusExpired:
+	default:
+		return c.Status(fiber.StatusBadRequest).SendString("Unknown order status")
+	}
+
+	if userIDParam := c.Query("user_id"); userIDParam != "" {
+		userID, err := strconv.ParseInt(userIDParam, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid user_id")
+		}
+		filter.UserID = userID
+	}
+
+	if createdAfterParam := c.Query("created_after"); createdAfterParam != "" {
+		createdAfter, err := time.Parse(time.RFC3339Nano, createdAfterParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("created_after must be in RFC 3339 format")
+		}
+		filter.CreatedAfter = createdAfter
+	}
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		cursor, err := parseOrderCursor(cursorParam)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		filter.Cursor = &cursor
+	}
+
+	orders, next, err := h.storage.ListOrders(filter)
+	if err != nil {
+		return fmt.Errorf("list orders: %w", err)
+	}
+
+	resp := ListOrdersResponse{Orders: make([]GetOrderResponse, 0, len(orders))}
+	for _, order := range orders {
+		resp.Orders = append(resp.Orders, newGetOrderResponse(order))
+	}
+	if next != nil {
+		resp.NextCursor = next.cursor()
+	}
+
+	return c.JSON(resp)
+}
@@ -0,0 +1,48 @@
+package webserver
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	OrderEventCreated       = "order.created"
+	OrderEventStatusChanged = "order.status_changed"
+)
+
+// Event about an order change, written to the outbox together with the change
+type OrderEvent struct {
+	ID         string
+	Type       string
+	OccurredAt time.Time
+	Order      Order // order state right after the change
+}
+
+// recordEvent adds an event to the outbox. Must be called with o.mu held,
+// in the same critical section as the change itself, so no change is left
+// without an event and no event is written for a change that didn't happen
+func (o *OrderStorage) recordEvent(eventType string, order Order) {
+	o.outbox = append(o.outbox, OrderEvent{
+		ID:         uuid.NewString(),
+		Type:       eventType,
+		OccurredAt: time.Now().UTC(),
+		Order:      order,
+	})
+}
+
+// PeekOutbox returns up to limit oldest undispatched events
+func (o *OrderStorage) PeekOutbox(limit int) []OrderEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]OrderEvent(nil), o.outbox[:min(limit, len(o.outbox))]...)
+}
+
+// AckOutbox removes count oldest events once they are dispatched
+func (o *OrderStorage) AckOutbox(count int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.outbox = append(o.outbox[:0], o.outbox[min(count, len(o.outbox)):]...)
+}
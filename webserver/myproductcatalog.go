@@ -0,0 +1,365 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Product model
+type Product struct {
+	ID         int64
+	SKU        string
+	Name       string
+	PriceMinor int64 // price in minor units of Currency, e.g. cents
+	Currency   string
+	Stock      int64
+}
+
+type (
+	CreateProductRequest struct {
+		SKU        string `json:"sku" validate:"required,max=64"`
+		Name       string `json:"name" validate:"required,max=256"`
+		PriceMinor int64  `json:"price_minor" validate:"gte=0"`
+		Currency   string `json:"currency" validate:"required,iso4217"`
+		Stock      int64  `json:"stock" validate:"gte=0"`
+	}
+
+	// Fields left as nil are not changed
+	UpdateProductRequest struct {
+		SKU        *string `json:"sku" validate:"omitnil,min=1,max=64"`
+		Name       *string `json:"name" validate:"omitnil,min=1,max=256"`
+		PriceMinor *int64  `json:"price_minor" validate:"omitnil,gte=0"`
+		Currency   *string `json:"currency" validate:"omitnil,iso4217"`
+		Stock      *int64  `json:"stock" validate:"omitnil,gte=0"`
+	}
+
+	ProductResponse struct {
+		ID         int64  `json:"id"`
+		SKU        string `json:"sku"`
+		Name       string `json:"name"`
+		PriceMinor int64  `json:"price_minor"`
+		Currency   string `json:"currency"`
+		Stock      int64  `json:"stock"`
+	}
+
+	ListProductsResponse struct {
+		Products []ProductResponse `json:"products"`
+	}
+)
+
+type ProductGetter interface {
+	GetProduct(productID int64) (Product, error)
+}
+
+type ProductCatalog interface {
+	ProductGetter
+	CreateProduct(product Product) (int64, error)
+	ListProducts() ([]Product, error)
+	UpdateProduct(productID int64, upd UpdateProductRequest) (Product, error)
+	DeleteProduct(productID int64) error
+}
+
+type ProductHandler struct {
+	storage  ProductCatalog
+	validate *validator.Validate
+}
+
+func (h *ProductHandler) CreateProduct(c *fiber.Ctx) error {
+	var req CreateProductRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	productID, err := h.storage.CreateProduct(Product{
+		SKU:        req.SKU,
+		Name:       req.Name,
+		PriceMinor: req.PriceMinor,
+		Currency:   req.Currency,
+		Stock:      req.Stock,
+	})
+	if errors.Is(err, errProductSKUExists) {
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("product creation: %w", err)
+	}
+
+	product, err := h.storage.GetProduct(productID)
+	if err != nil {
+		return fmt.Errorf("get created product: %w", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(ProductResponse(product))
+}
+
+func (h *ProductHandler) ListProducts(c *fiber.Ctx) error {
+	products, err := h.storage.ListProducts()
+	if err != nil {
+		return fmt.Errorf("list products: %w", err)
+	}
+
+	resp := ListProductsResponse{Products: make([]ProductResponse, 0, len(products))}
+	for _, product := range products {
+		resp.Products = append(resp.Products, ProductResponse(product))
+	}
+
+	return c.JSON(resp)
+}
+
+func (h *ProductHandler) GetProduct(c *fiber.Ctx) error {
+	productID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+	}
+
+	product, err := h.storage.GetProduct(productID)
+	if errors.Is(err, errProductNotFound) {
+		return c.Status(fiber.StatusNotFound).SendString("Product not found")
+	}
+	if err != nil {
+		return fmt.Errorf("get product: %w", err)
+	}
+
+	return c.JSON(ProductResponse(product))
+}
+
+func (h *ProductHandler) UpdateProduct(c *fiber.Ctx) error {
+	productID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+	}
+
+	var req UpdateProductRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	product, err := h.storage.UpdateProduct(productID, req)
+	switch {
+	case errors.Is(err, errProductNotFound):
+		return c.Status(fiber.StatusNotFound).SendString("Product not found")
+	case errors.Is(err, errProductSKUExists):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case err != nil:
+		return fmt.Errorf("update product: %w", err)
+	}
+
+	return c.JSON(ProductResponse(product))
+}
+
+func (h *ProductHandler) DeleteProduct(c *fiber.Ctx) error {
+	productID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+	}
+
+	err = h.storage.DeleteProduct(productID)
+	if errors.Is(err, errProductNotFound) {
+		return c.Status(fiber.StatusNotFound).SendString("Product not found")
+	}
+	if err != nil {
+		return fmt.Errorf("delete product: %w", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Storage
+type ProductStorage struct {
+	mu       sync.RWMutex // guards the maps, not the products themselves
+	lastID   int64
+	products map[int64]*productEntry
+	skus     map[string]int64 // SKU -> product ID
+}
+
+// Every product has its own lock, so orders for different products
+// don't wait for each other while stock is being reserved
+type productEntry struct {
+	mu      sync.Mutex
+	product Product
+}
+
+func NewProductStorage() *ProductStorage {
+	return &ProductStorage{
+		products: make(map[int64]*productEntry),
+		skus:     make(map[string]int64),
+	}
+}
+
+var (
+	errProductNotFound   = errors.New("product not found")
+	errProductSKUExists  = errors.New("product with provided SKU already exists")
+	errInsufficientStock = errors.New("insufficient stock")
+)
+
+func (s *ProductStorage) CreateProduct(product Product) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.skus[product.SKU]; exists {
+		return 0, errProductSKUExists
+	}
+
+	s.lastID++
+	product.ID = s.lastID
+	s.products[product.ID] = &productEntry{product: product}
+	s.skus[product.SKU] = product.ID
+
+	return product.ID, nil
+}
+
+func (s *ProductStorage) ListProducts() ([]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := make([]Product, 0, len(s.products))
+	for _, entry := range s.products {
+		entry.mu.Lock()
+		products = append(products, entry.product)
+		entry.mu.Unlock()
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+
+	return products, nil
+}
+
+func (s *ProductStorage) GetProduct(productID int64) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.products[productID]
+	if !ok {
+		return Product{}, errProductNotFound
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	return entry.product, nil
+}
+
+func (s *ProductStorage) UpdateProduct(productID int64, upd UpdateProductRequest) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.products[productID]
+	if !ok {
+		return Product{}, errProductNotFound
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	product := entry.product
+	if upd.SKU != nil && *upd.SKU != product.SKU {
+		if _, exists := s.skus[*upd.SKU]; exists {
+			return Product{}, errProductSKUExists
+		}
+		delete(s.skus, product.SKU)
+		product.SKU = *upd.SKU
+		s.skus[product.SKU] = product.ID
+	}
+	if upd.Name != nil {
+		product.Name = *upd.Name
+	}
+	if upd.PriceMinor != nil {
+		product.PriceMinor = *upd.PriceMinor
+	}
+	if upd.Currency != nil {
+		product.Currency = *upd.Currency
+	}
+	if upd.Stock != nil {
+		product.Stock = *upd.Stock
+	}
+
+	entry.product = product
+
+	return product, nil
+}
+
+func (s *ProductStorage) DeleteProduct(productID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.products[productID]
+	if !ok {
+		return errProductNotFound
+	}
+
+	delete(s.products, productID)
+	delete(s.skus, entry.product.SKU)
+
+	return nil
+}
+
+// TakeStock decrements stock of all provided products (product ID -> quantity)
+// or of none of them if any product doesn't have enough
+func (s *ProductStorage) TakeStock(quantities map[int64]int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	productIDs := make([]int64, 0, len(quantities))
+	for productID := range quantities {
+		productIDs = append(productIDs, productID)
+	}
+	// Locks are always taken in the same order to avoid deadlocks
+	// between orders sharing several products
+	sort.Slice(productIDs, func(i, j int) bool { return productIDs[i] < productIDs[j] })
+
+	entries := make([]*productEntry, 0, len(productIDs))
+	for _, productID := range productIDs {
+		entry, ok := s.products[productID]
+		if !ok {
+			return fmt.Errorf("product %d: %w", productID, errProductNotFound)
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+	}
+
+	for _, entry := range entries {
+		if entry.product.Stock < quantities[entry.product.ID] {
+			return fmt.Errorf("product %d: %w", entry.product.ID, errInsufficientStock)
+		}
+	}
+	for _, entry := range entries {
+		entry.product.Stock -= quantities[entry.product.ID]
+	}
+
+	return nil
+}
+
+// ReturnStock puts quantities taken by TakeStock back. Products deleted
+// in the meantime are skipped
+func (s *ProductStorage) ReturnStock(quantities map[int64]int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for productID, quantity := range quantities {
+		entry, ok := s.products[productID]
+		if !ok {
+			continue
+		}
+
+		entry.mu.Lock()
+		entry.product.Stock += quantity
+		entry.mu.Unlock()
+	}
+}
@@ -0,0 +1,597 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// QR codes are encoded in byte mode only, which is enough for URLs.
+// The encoder follows ISO/IEC 18004
+
+type QRErrorCorrection int
+
+const (
+	QRErrorCorrectionL QRErrorCorrection = iota // ~7% of codewords can be restored
+	QRErrorCorrectionM                          // ~15%
+	QRErrorCorrectionQ                          // ~25%
+	QRErrorCorrectionH                          // ~30%
+)
+
+// ParseQRErrorCorrection parses level names L, M, Q and H
+func ParseQRErrorCorrection(level string) (QRErrorCorrection, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return QRErrorCorrectionL, nil
+	case "M":
+		return QRErrorCorrectionM, nil
+	case "Q":
+		return QRErrorCorrectionQ, nil
+	case "H":
+		return QRErrorCorrectionH, nil
+	default:
+		return 0, fmt.Errorf("unknown error correction level %q", level)
+	}
+}
+
+// Format information bits of the levels, they are not in the L, M, Q, H order
+var qrFormatBits = [4]int{1, 0, 3, 2}
+
+// Error correction codewords per block and number of blocks by level and version,
+// index 0 is unused
+var (
+	qrECCodewordsPerBlock = [4][41]int{
+		{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+		{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	}
+	qrECBlocks = [4][41]int{
+		{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+		{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+		{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+		{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+	}
+)
+
+var (
+	errQRDataTooLong  = errors.New("data is too long for a QR code")
+	errQRSizeTooSmall = errors.New("image size is too small for the QR code")
+)
+
+// QRCode is a square of modules, true modules are dark
+type QRCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // modules of finder, timing, alignment and format patterns
+}
+
+func (q *QRCode) Size() int {
+	return q.size
+}
+
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y][x]
+}
+
+// EncodeQR encodes data with the smallest version that fits and the mask
+// with the lowest penalty
+func EncodeQR(data []byte, level QRErrorCorrection) (*QRCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if len(data) <= qrByteCapacity(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRDataTooLong
+	}
+
+	size := version*4 + 17
+	q := &QRCode{
+		size:     size,
+		modules:  newQRGrid(size),
+		function: newQRGrid(size),
+	}
+	q.drawFunctionPatterns(version, level)
+	q.drawCodewords(qrAddErrorCorrection(qrDataCodewords(data, version, level), version, level))
+
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // masking twice restores the modules
+	}
+	q.applyMask(bestMask)
+	q.drawFormatBits(level, bestMask)
+
+	return q, nil
+}
+
+func newQRGrid(size int) [][]bool {
+	grid := make([][]bool, size)
+	for i := range grid {
+		grid[i] = make([]bool, size)
+	}
+
+	return grid
+}
+
+// qrRawModules is the number of modules available for codewords and
+// remainder bits, after all function patterns are excluded
+func qrRawModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		result -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+
+	return result
+}
+
+func qrDataCapacity(version int, level QRErrorCorrection) int {
+	return qrRawModules(version)/8 - qrECCodewordsPerBlock[level][version]*qrECBlocks[level][version]
+}
+
+func qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+
+	return 16
+}
+
+// qrByteCapacity is the number of bytes which fit in byte mode
+func qrByteCapacity(version int, level QRErrorCorrection) int {
+	headerBits := 4 + qrCountBits(version)
+
+	return (qrDataCapacity(version, level)*8 - headerBits) / 8
+}
+
+type qrBitBuffer []byte // one bit per element
+
+func (b *qrBitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, byte(value>>i&1))
+	}
+}
+
+// qrDataCodewords builds the data segment with the mode, the length,
+// the terminator and the padding
+func qrDataCodewords(data []byte, version int, level QRErrorCorrection) []byte {
+	capacityBits := qrDataCapacity(version, level) * 8
+
+	var bits qrBitBuffer
+	bits.append(0b0100, 4) // byte mode
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, capacityBits-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+
+	codewords := make([]byte, 0, capacityBits/8)
+	for i := 0; i < len(bits); i += 8 {
+		var codeword byte
+		for _, bit := range bits[i : i+8] {
+			codeword = codeword<<1 | bit
+		}
+		codewords = append(codewords, codeword)
+	}
+	for pad := byte(0xEC); len(codewords) < capacityBits/8; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	return codewords
+}
+
+// qrAddErrorCorrection splits data into blocks, appends Reed-Solomon codewords
+// to each block and interleaves the blocks
+func qrAddErrorCorrection(data []byte, version int, level QRErrorCorrection) []byte {
+	blocks := qrECBlocks[level][version]
+	ecLen := qrECCodewordsPerBlock[level][version]
+	rawCodewords := qrRawModules(version) / 8
+	// Short blocks have one data codeword less than long ones
+	shortBlocks := blocks - rawCodewords%blocks
+	shortBlockLen := rawCodewords / blocks
+
+	divisor := reedSolomonDivisor(ecLen)
+	dataBlocks := make([][]byte, blocks)
+	ecBlocks := make([][]byte, blocks)
+	for i, k := 0, 0; i < blocks; i++ {
+		dataLen := shortBlockLen - ecLen
+		if i >= shortBlocks {
+			dataLen++
+		}
+		dataBlocks[i] = data[k : k+dataLen]
+		ecBlocks[i] = reedSolomonRemainder(dataBlocks[i], divisor)
+		k += dataLen
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := 0; i <= shortBlockLen-ecLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+
+	return byte(z)
+}
+
+// reedSolomonDivisor returns coefficients of the generator polynomial of
+// the given degree, from the highest power, without the leading 1
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+
+	return result
+}
+
+func (q *QRCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns(version int, level QRErrorCorrection) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	q.drawFinderPattern(3, 3)
+	q.drawFinderPattern(q.size-4, 3)
+	q.drawFinderPattern(3, q.size-4)
+
+	positions := qrAlignmentPositions(version, q.size)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Corners taken by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			q.drawAlignmentPattern(x, y)
+		}
+	}
+
+	// Reserve format areas, they are drawn for real after masking
+	q.drawFormatBits(level, 0)
+	q.drawVersion(version)
+}
+
+// drawFinderPattern draws the 7x7 pattern with its light separator
+func (q *QRCode) drawFinderPattern(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.size || y < 0 || y >= q.size {
+				continue
+			}
+			distance := max(abs(dx), abs(dy))
+			q.setFunction(x, y, distance != 2 && distance != 4)
+		}
+	}
+}
+
+func (q *QRCode) drawAlignmentPattern(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// qrAlignmentPositions returns centers of alignment patterns on each axis,
+// spaced evenly from the far edge with the first one at 6
+func qrAlignmentPositions(version, size int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	count := version/7 + 2
+	step := (version*8 + count*3 + 5) / (count*4 - 4) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, size-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+
+	return positions
+}
+
+func (q *QRCode) drawFormatBits(level QRErrorCorrection, mask int) {
+	data := qrFormatBits[level]<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	// Around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	// Copy split between the other two finder patterns
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true) // always dark module
+}
+
+func (q *QRCode) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+
+	remainder := version
+	for i := 0; i < 12; i++ {
+		remainder = remainder<<1 ^ (remainder>>11)*0x1F25
+	}
+	bits := version<<12 | remainder
+
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places bits in two module wide columns zigzagging
+// up and down from the bottom right corner, skipping function patterns
+func (q *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 { // vertical timing pattern
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the four rules of the standard: runs of
+// the same color, 2x2 blocks, finder-like patterns and dark/light balance
+func (q *QRCode) penalty() int {
+	penalty := 0
+	line := make([]bool, q.size)
+
+	for _, horizontal := range []bool{true, false} {
+		for i := 0; i < q.size; i++ {
+			for j := 0; j < q.size; j++ {
+				if horizontal {
+					line[j] = q.modules[i][j]
+				} else {
+					line[j] = q.modules[j][i]
+				}
+			}
+			penalty += qrLinePenalty(line)
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				module := q.modules[y][x]
+				if q.modules[y][x+1] == module && q.modules[y+1][x] == module && q.modules[y+1][x+1] == module {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	total := q.size * q.size
+	// Each 5% of deviation from the 50% of dark modules
+	deviation := abs(dark*20-total*10) / total
+	penalty += deviation * 10
+
+	return penalty
+}
+
+var qrFinderLike = []bool{true, false, true, true, true, false, true}
+
+func qrLinePenalty(line []bool) int {
+	penalty := 0
+
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += 3 + run - 5
+		}
+		run = 1
+	}
+
+	// 1:1:3:1:1 pattern with four light modules on either side,
+	// modules outside the symbol are light
+	light := func(from, to int) bool {
+		for i := max(from, 0); i < min(to, len(line)); i++ {
+			if line[i] {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i+len(qrFinderLike) <= len(line); i++ {
+		matches := true
+		for j, dark := range qrFinderLike {
+			if line[i+j] != dark {
+				matches = false
+				break
+			}
+		}
+		if matches && (light(i-4, i) || light(i+7, i+11)) {
+			penalty += 40
+		}
+	}
+
+	return penalty
+}
+
+// qrQuietZone is the light border around the symbol in modules
+const qrQuietZone = 4
+
+// WritePNG renders the code with the quiet zone into a PNG of at most
+// size x size pixels. Modules are whole pixels, so the image may be smaller.
+// Sizes below a pixel per module are an error
+func (q *QRCode) WritePNG(w io.Writer, size int) error {
+	total := q.size + 2*qrQuietZone
+	if size < total {
+		return fmt.Errorf("%w: it needs at least %d pixels", errQRSizeTooSmall, total)
+	}
+	scale := size / total
+
+	img := image.NewPaletted(image.Rect(0, 0, total*scale, total*scale),
+		color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	return png.Encode(w, img)
+}
+
+// WriteSVG renders the code as a single path scaled to size x size pixels
+func (q *QRCode) WriteSVG(w io.Writer, size int) error {
+	total := q.size + 2*qrQuietZone
+
+	var path strings.Builder
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">
+<rect width="100%%" height="100%%" fill="#FFFFFF"/>
+<path d="%s" fill="#000000"/>
+</svg>
+`, size, size, total, total, path.String())
+
+	return err
+}
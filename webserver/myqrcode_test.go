@@ -0,0 +1,400 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// The tests decode encoded symbols with a decoder written from the standard.
+// It shares the block tables with the encoder, alignment positions come from
+// the standard for the versions listed below
+
+// Format information of mask 0 after the XOR with 0x5412, ISO/IEC 18004 table C.1
+var qrTestFormatMask0 = map[QRErrorCorrection]int{
+	QRErrorCorrectionL: 0x77C4,
+	QRErrorCorrectionM: 0x5412,
+	QRErrorCorrectionQ: 0x355F,
+	QRErrorCorrectionH: 0x1689,
+}
+
+// Version information, ISO/IEC 18004 table D.1
+var qrTestVersionBits = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+
+// Centers of alignment patterns, ISO/IEC 18004 table E.1
+var qrTestAlignment = map[int][]int{
+	1: nil, 2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+	14: {6, 26, 46, 66}, 21: {6, 28, 50, 72, 94}, 32: {6, 34, 60, 86, 112, 138},
+	40: {6, 30, 58, 86, 114, 142, 170},
+}
+
+func qrTestFormatCode(level QRErrorCorrection, mask int) int {
+	data := map[QRErrorCorrection]int{QRErrorCorrectionL: 1, QRErrorCorrectionM: 0, QRErrorCorrectionQ: 3, QRErrorCorrectionH: 2}[level]<<3 | mask
+	code := data << 10
+	for bit := 14; bit >= 10; bit-- {
+		if code>>bit&1 != 0 {
+			code ^= 0x537 << (bit - 10)
+		}
+	}
+
+	return (data<<10 | code) ^ 0x5412
+}
+
+// qrTestGF multiplies in GF(2^8) with the QR polynomial by shifts
+func qrTestGF(x, y byte) byte {
+	var product byte
+	for y > 0 {
+		if y&1 != 0 {
+			product ^= x
+		}
+		carry := x&0x80 != 0
+		x <<= 1
+		if carry {
+			x ^= 0x1D
+		}
+		y >>= 1
+	}
+
+	return product
+}
+
+// qrTestSyndromesZero checks that the block is a Reed-Solomon codeword:
+// the polynomial has roots 1, a, ..., a^(ec-1)
+func qrTestSyndromesZero(block []byte, ec int) bool {
+	root := byte(1)
+	for i := 0; i < ec; i++ {
+		var value byte
+		for _, c := range block {
+			value = qrTestGF(value, root) ^ c
+		}
+		if value != 0 {
+			return false
+		}
+		root = qrTestGF(root, 2)
+	}
+
+	return true
+}
+
+// qrTestDecode reads the symbol back into the level and the byte mode data
+func qrTestDecode(q *QRCode) (QRErrorCorrection, []byte, error) {
+	size := q.Size()
+	version := (size - 17) / 4
+	if version < 1 || version > 40 || version*4+17 != size {
+		return 0, nil, fmt.Errorf("invalid size %d", size)
+	}
+	dark := func(x, y int) int {
+		if q.Dark(x, y) {
+			return 1
+		}
+		return 0
+	}
+
+	// Both copies of the format information must be the same code
+	var format, copied int
+	for i := 0; i <= 5; i++ {
+		format |= dark(8, i) << i
+	}
+	format |= dark(8, 7)<<6 | dark(8, 8)<<7 | dark(7, 8)<<8
+	for i := 9; i < 15; i++ {
+		format |= dark(14-i, 8) << i
+	}
+	for i := 0; i < 8; i++ {
+		copied |= dark(size-1-i, 8) << i
+	}
+	for i := 8; i < 15; i++ {
+		copied |= dark(8, size-15+i) << i
+	}
+	if format != copied {
+		return 0, nil, fmt.Errorf("format copies differ: %015b and %015b", format, copied)
+	}
+	level, mask := QRErrorCorrection(-1), -1
+	for l := QRErrorCorrectionL; l <= QRErrorCorrectionH; l++ {
+		for m := 0; m < 8; m++ {
+			if qrTestFormatCode(l, m) == format {
+				level, mask = l, m
+			}
+		}
+	}
+	if mask < 0 {
+		return 0, nil, fmt.Errorf("unknown format %015b", format)
+	}
+	if !q.Dark(8, size-8) {
+		return 0, nil, errors.New("dark module is light")
+	}
+
+	// Modules which don't carry codewords
+	function := newQRGrid(size)
+	fill := func(x0, y0, x1, y1 int) {
+		for y := max(y0, 0); y <= min(y1, size-1); y++ {
+			for x := max(x0, 0); x <= min(x1, size-1); x++ {
+				function[y][x] = true
+			}
+		}
+	}
+	fill(0, 0, 8, 8)
+	fill(size-8, 0, size-1, 8)
+	fill(0, size-8, 8, size-1)
+	fill(6, 0, 6, size-1)
+	fill(0, 6, size-1, 6)
+	positions, ok := qrTestAlignment[version]
+	if !ok {
+		positions = qrAlignmentPositions(version, size)
+	}
+	for i, x := range positions {
+		for j, y := range positions {
+			// Corners of finder patterns
+			last := len(positions) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			fill(x-2, y-2, x+2, y+2)
+		}
+	}
+	if version >= 7 {
+		var bits, mirrored int
+		for i := 0; i < 18; i++ {
+			bits |= dark(size-11+i%3, i/3) << i
+			mirrored |= dark(i/3, size-11+i%3) << i
+		}
+		if bits != mirrored || bits>>12 != version {
+			return 0, nil, fmt.Errorf("version information %018b and %018b", bits, mirrored)
+		}
+		if want, ok := qrTestVersionBits[version]; ok && bits != want {
+			return 0, nil, fmt.Errorf("version information %018b, want %018b", bits, want)
+		}
+		fill(size-11, 0, size-9, 5)
+		fill(0, size-11, 5, size-9)
+	}
+
+	masked := func(x, y int) bool {
+		switch mask {
+		case 0:
+			return (y+x)%2 == 0
+		case 1:
+			return y%2 == 0
+		case 2:
+			return x%3 == 0
+		case 3:
+			return (y+x)%3 == 0
+		case 4:
+			return (y/2+x/3)%2 == 0
+		case 5:
+			return (y*x)%2+(y*x)%3 == 0
+		case 6:
+			return ((y*x)%2+(y*x)%3)%2 == 0
+		default:
+			return ((y+x)%2+(y*x)%3)%2 == 0
+		}
+	}
+
+	// Codewords go in pairs of columns from the right, up and down in turns
+	var codewords []byte
+	var current byte
+	bits := 0
+	upward := true
+	for right := size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for i := 0; i < size; i++ {
+			y := i
+			if upward {
+				y = size - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if function[y][x] {
+					continue
+				}
+				bit := q.Dark(x, y) != masked(x, y)
+				current <<= 1
+				if bit {
+					current |= 1
+				}
+				if bits++; bits%8 == 0 {
+					codewords = append(codewords, current)
+					current = 0
+				}
+			}
+		}
+		upward = !upward
+	}
+
+	// Blocks are interleaved, short ones come first
+	blocks := qrECBlocks[level][version]
+	ec := qrECCodewordsPerBlock[level][version]
+	shortLen := len(codewords) / blocks
+	short := blocks - len(codewords)%blocks
+	dataBlocks := make([][]byte, blocks)
+	ecBlocks := make([][]byte, blocks)
+	next := 0
+	for i := 0; i < shortLen-ec+1; i++ {
+		for b := 0; b < blocks; b++ {
+			if i == shortLen-ec && b < short {
+				continue
+			}
+			dataBlocks[b] = append(dataBlocks[b], codewords[next])
+			next++
+		}
+	}
+	for i := 0; i < ec; i++ {
+		for b := 0; b < blocks; b++ {
+			ecBlocks[b] = append(ecBlocks[b], codewords[next])
+			next++
+		}
+	}
+	var data []byte
+	for b := range dataBlocks {
+		if !qrTestSyndromesZero(append(slices.Clone(dataBlocks[b]), ecBlocks[b]...), ec) {
+			return 0, nil, fmt.Errorf("block %d isn't a Reed-Solomon codeword", b)
+		}
+		data = append(data, dataBlocks[b]...)
+	}
+
+	// Byte mode segment: mode 0100, the length and the bytes
+	bit := func(i int) int { return int(data[i/8]>>(7-i%8)) & 1 }
+	read := func(from, length int) int {
+		value := 0
+		for i := from; i < from+length; i++ {
+			value = value<<1 | bit(i)
+		}
+		return value
+	}
+	if mode := read(0, 4); mode != 0b0100 {
+		return 0, nil, fmt.Errorf("mode %04b is not byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	length := read(4, countBits)
+	if 4+countBits+length*8 > len(data)*8 {
+		return 0, nil, fmt.Errorf("length %d doesn't fit", length)
+	}
+	decoded := make([]byte, length)
+	for i := range decoded {
+		decoded[i] = byte(read(4+countBits+i*8, 8))
+	}
+
+	return level, decoded, nil
+}
+
+func TestQRCapacity(t *testing.T) {
+	// Byte mode capacities, ISO/IEC 18004 table 7
+	capacities := map[int][4]int{
+		1:  {17, 14, 11, 7},
+		2:  {32, 26, 20, 14},
+		7:  {154, 122, 86, 64},
+		10: {271, 213, 151, 119},
+		40: {2953, 2331, 1663, 1273},
+	}
+	for version, want := range capacities {
+		for level := QRErrorCorrectionL; level <= QRErrorCorrectionH; level++ {
+			if got := qrByteCapacity(version, level); got != want[level] {
+				t.Errorf("version %d, level %d: capacity %d, want %d", version, level, got, want[level])
+			}
+		}
+	}
+
+	for version, want := range qrTestAlignment {
+		if got := qrAlignmentPositions(version, version*4+17); !slices.Equal(got, want) {
+			t.Errorf("version %d: alignment %v, want %v", version, got, want)
+		}
+	}
+
+	for level, want := range qrTestFormatMask0 {
+		if got := qrTestFormatCode(level, 0); got != want {
+			t.Errorf("level %d: format %015b, want %015b", level, got, want)
+		}
+	}
+
+	if _, err := EncodeQR(make([]byte, 2954), QRErrorCorrectionL); !errors.Is(err, errQRDataTooLong) {
+		t.Errorf("got %v, want %v", err, errQRDataTooLong)
+	}
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for level := QRErrorCorrectionL; level <= QRErrorCorrectionH; level++ {
+		for _, version := range []int{1, 2, 6, 7, 9, 10, 14, 21, 32, 40} {
+			// Data which just fits picks the version, one more byte the next one
+			for _, extra := range []int{0, 1} {
+				length := qrByteCapacity(version, level) + extra
+				if version == 40 && extra == 1 {
+					continue
+				}
+				data := make([]byte, length)
+				random.Read(data)
+
+				q, err := EncodeQR(data, level)
+				if err != nil {
+					t.Fatalf("level %d, %d bytes: %v", level, length, err)
+				}
+				if want := (version+extra)*4 + 17; q.Size() != want {
+					t.Errorf("level %d, %d bytes: size %d, want %d", level, length, q.Size(), want)
+				}
+
+				decodedLevel, decoded, err := qrTestDecode(q)
+				if err != nil {
+					t.Fatalf("level %d, %d bytes: decode: %v", level, length, err)
+				}
+				if decodedLevel != level || !bytes.Equal(decoded, data) {
+					t.Errorf("level %d, %d bytes: decoded level %d, data differs: %t", level, length, decodedLevel, !bytes.Equal(decoded, data))
+				}
+			}
+		}
+	}
+
+	q, err := EncodeQR([]byte("https://example.com/abc123"), QRErrorCorrectionM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, decoded, err := qrTestDecode(q); err != nil || string(decoded) != "https://example.com/abc123" {
+		t.Errorf("decoded %q, %v", decoded, err)
+	}
+}
+
+func TestQRWritePNG(t *testing.T) {
+	q, err := EncodeQR([]byte("https://example.com/abc123"), QRErrorCorrectionM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := q.Size() + 2*qrQuietZone
+
+	for _, size := range []int{total, total*3 + total - 1, 256} {
+		var buf bytes.Buffer
+		if err := q.WritePNG(&buf, size); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("size %d: decode PNG: %v", size, err)
+		}
+
+		scale := size / total
+		bounds := img.Bounds()
+		if bounds.Dx() != total*scale || bounds.Dy() != total*scale || bounds.Dx() > size {
+			t.Fatalf("size %d: image is %v, want %d pixels", size, bounds, total*scale)
+		}
+		for y := 0; y < total; y++ {
+			for x := 0; x < total; x++ {
+				want := x >= qrQuietZone && y >= qrQuietZone && x < total-qrQuietZone && y < total-qrQuietZone &&
+					q.Dark(x-qrQuietZone, y-qrQuietZone)
+				r, _, _, _ := img.At(x*scale+scale-1, y*scale).RGBA()
+				if got := r == 0; got != want {
+					t.Fatalf("size %d: module %d,%d is dark: %t, want %t", size, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	// Smaller images can't have a pixel per module
+	if err := q.WritePNG(&bytes.Buffer{}, total-1); !errors.Is(err, errQRSizeTooSmall) {
+		t.Errorf("got %v, want %v", err, errQRSizeTooSmall)
+	}
+}
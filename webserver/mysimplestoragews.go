@@ -3,8 +3,11 @@ package webserver
 import (
 	"errors"
 	"fmt"
+	"math"
 	"sync"
+	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -12,44 +15,156 @@ import (
 
 type (
 	CreateOrderRequest struct {
-		UserID     int64   `json:"user_id"`
-		ProductIDs []int64 `json:"product_ids"`
+		UserID int64                    `json:"user_id" validate:"required"`
+		Items  []CreateOrderItemRequest `json:"items" validate:"required,min=1,dive"`
+	}
+
+	CreateOrderItemRequest struct {
+		ProductID int64 `json:"product_id" validate:"required"`
+		Quantity  int64 `json:"quantity" validate:"required,gte=1"`
 	}
 
 	CreateOrderResponse struct {
-		ID string `json:"id"`
+		ID         string      `json:"id"`
+		Status     OrderStatus `json:"status"`
+		TotalMinor int64       `json:"total_minor"`
+		Currency   string      `json:"currency"`
 	}
 
 	GetOrderResponse struct {
-		ID         string  `json:"id"`
-		UserID     int64   `json:"user_id"`
-		ProductIDs []int64 `json:"product_ids"`
+		ID         string              `json:"id"`
+		UserID     int64               `json:"user_id"`
+		Status     OrderStatus         `json:"status"`
+		CreatedAt  time.Time           `json:"created_at"`
+		Items      []OrderItemResponse `json:"items"`
+		TotalMinor int64               `json:"total_minor"`
+		Currency   string              `json:"currency"`
+	}
+
+	OrderItemResponse struct {
+		ProductID      int64  `json:"product_id"`
+		SKU            string `json:"sku"`
+		Name           string `json:"name"`
+		Quantity       int64  `json:"quantity"`
+		UnitPriceMinor int64  `json:"unit_price_minor"`
+		LineTotalMinor int64  `json:"line_total_minor"`
 	}
 )
 
+func newGetOrderResponse(order Order) GetOrderResponse {
+	resp := GetOrderResponse{
+		ID:         order.ID,
+		UserID:     order.UserID,
+		Status:     order.Status,
+		CreatedAt:  order.CreatedAt,
+		Items:      make([]OrderItemResponse, 0, len(order.Items)),
+		TotalMinor: order.TotalMinor,
+		Currency:   order.Currency,
+	}
+	for _, item := range order.Items {
+		resp.Items = append(resp.Items, OrderItemResponse(item))
+	}
+
+	return resp
+}
+
 func StartSimpleStorageServer() {
 	webApp := fiber.New()
+	validate := validator.New()
 
+	productStorage := NewProductStorage()
+	productHandler := &ProductHandler{
+		storage:  productStorage,
+		validate: validate,
+	}
+	orderStorage := NewOrderStorage()
+	inventory := NewInventory(productStorage, orderReservationTTL)
 	orderHandler := &OrderHandler{
-		storage: &OrderStorage{
-			orders: make(map[string]Order),
-		},
+		storage:   orderStorage,
+		products:  productStorage,
+		inventory: inventory,
+		validate:  validate,
+	}
+
+	cartHandler := &CartHandler{
+		storage:  NewCartStorage(),
+		products: productStorage,
+		orders:   orderHandler,
+		validate: validate,
 	}
 
-	webApp.Post("/orders", orderHandler.CreateOrder)
+	webhookStorage := NewWebhookStorage()
+	webhookHandler, err := NewWebhookHandler(webhookStorage, validate)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	webhookDispatcher := NewWebhookDispatcher(
+		orderStorage,
+		webhookStorage,
+		NewWebhookHTTPClient(10*time.Second),
+		defaultWebhookRetryPolicy,
+	)
+
+	go webhookDispatcher.Run(time.Second)
+	go inventory.RunExpirySweeper(time.Second, func(orderID string) {
+		if _, err := orderStorage.SetOrderStatus(orderID, OrderStatusExpired); err != nil {
+			logrus.WithError(err).WithField("order_id", orderID).Error("expire order")
+		}
+	})
+
+	idempotency := NewIdempotencyMiddleware(NewIdempotencyStorage(idempotencyKeyTTL))
+
+	webApp.Post("/products", idempotency, productHandler.CreateProduct)
+	webApp.Get("/products", productHandler.ListProducts)
+	webApp.Get("/products/:id", productHandler.GetProduct)
+	webApp.Patch("/products/:id", productHandler.UpdateProduct)
+	webApp.Delete("/products/:id", productHandler.DeleteProduct)
+
+	webApp.Post("/orders", idempotency, orderHandler.CreateOrder)
+	webApp.Get("/orders", orderHandler.ListOrders)
+	webApp.Get("/orders/export", orderHandler.ExportOrders)
+	webApp.Post("/orders/import", orderHandler.ImportOrders)
 	webApp.Get("/orders/:id", orderHandler.GetOrder)
+	webApp.Post("/orders/:id/confirm", orderHandler.ConfirmOrder)
+	webApp.Post("/orders/:id/cancel", orderHandler.CancelOrder)
+
+	cartGroup := webApp.Group("/cart", OptionalAuth)
+	cartGroup.Get("", cartHandler.GetCart)
+	cartGroup.Post("/items", cartHandler.AddItem)
+	cartGroup.Put("/items/:productId", cartHandler.UpdateItem)
+	cartGroup.Delete("/items/:productId", cartHandler.RemoveItem)
+	cartGroup.Post("/merge", cartHandler.MergeCart)
+	cartGroup.Post("/checkout", idempotency, cartHandler.Checkout)
+
+	registerWebhooks(webApp, webhookHandler)
 
 	port := "8080"
 	logrus.Fatal(webApp.Listen(":" + port))
 }
 
+// Pending orders not confirmed within this time are expired
+// and their stock is returned
+const orderReservationTTL = 15 * time.Minute
+
 type OrderCreatorGetter interface {
 	CreateOrder(order Order) (string, error)
 	GetOrder(orderID string) (Order, error)
+	SetOrderStatus(orderID string, status OrderStatus) (Order, error)
+	ListOrders(filter OrderFilter) ([]Order, *orderKey, error)
+	ImportOrder(order Order) error
+}
+
+type OrderReserver interface {
+	Reserve(orderID string, items []OrderItem) error
+	Release(orderID string) error
+	Commit(orderID string) error
 }
 
 type OrderHandler struct {
-	storage OrderCreatorGetter
+	storage   OrderCreatorGetter
+	products  ProductGetter
+	inventory OrderReserver
+	validate  *validator.Validate
 }
 
 func (h *OrderHandler) CreateOrder(c *fiber.Ctx) error {
@@ -58,17 +173,125 @@ func (h *OrderHandler) CreateOrder(c *fiber.Ctx) error {
 		return fmt.Errorf("body parsing: %w", err)
 	}
 
+	if err := h.validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	order, err := h.placeOrder(req.UserID, req.Items)
+	if status, ok := placeOrderErrorStatus(err); ok {
+		return c.Status(status).SendString(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("place order: %w", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(CreateOrderResponse{
+		ID:         order.ID,
+		Status:     order.Status,
+		TotalMinor: order.TotalMinor,
+		Currency:   order.Currency,
+	})
+}
+
+// placeOrder prices the items, reserves their stock and saves a pending order
+func (h *OrderHandler) placeOrder(userID int64, reqItems []CreateOrderItemRequest) (Order, error) {
+	items, currency, total, err := h.priceOrderItems(reqItems)
+	if err != nil {
+		return Order{}, fmt.Errorf("order pricing: %w", err)
+	}
+
 	order := Order{
 		ID:         uuid.NewString(),
-		UserID:     req.UserID,
-		ProductIDs: req.ProductIDs,
+		UserID:     userID,
+		Status:     OrderStatusPending,
+		CreatedAt:  time.Now().UTC(),
+		Items:      items,
+		Currency:   currency,
+		TotalMinor: total,
 	}
-	orderID, err := h.storage.CreateOrder(order)
-	if err != nil {
-		return fmt.Errorf("order creation: %w", err)
+
+	if err := h.inventory.Reserve(order.ID, order.Items); err != nil {
+		return Order{}, fmt.Errorf("stock reservation: %w", err)
+	}
+
+	if _, err := h.storage.CreateOrder(order); err != nil {
+		if releaseErr := h.inventory.Release(order.ID); releaseErr != nil {
+			logrus.WithError(releaseErr).WithField("order_id", order.ID).Error("release stock")
+		}
+		return Order{}, fmt.Errorf("order creation: %w", err)
+	}
+
+	return order, nil
+}
+
+// placeOrderErrorStatus maps errors caused by the order contents to HTTP statuses
+func placeOrderErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, errInsufficientStock):
+		return fiber.StatusConflict, true
+	case errors.Is(err, errProductNotFound),
+		errors.Is(err, errOrderCurrencyMismatch),
+		errors.Is(err, errOrderTotalOverflow),
+		errors.Is(err, errOrderItemQuantity):
+		return fiber.StatusUnprocessableEntity, true
 	}
 
-	return c.JSON(CreateOrderResponse{ID: orderID})
+	return 0, false
+}
+
+var (
+	errOrderCurrencyMismatch = errors.New("all order items must have the same currency")
+	errOrderTotalOverflow    = errors.New("order total is too large")
+	errOrderItemQuantity     = errors.New("order item quantity must be positive")
+)
+
+// priceOrderItems snapshots the current product data into order line items
+// and computes the order total on the server side
+func (h *OrderHandler) priceOrderItems(reqItems []CreateOrderItemRequest) ([]OrderItem, string, int64, error) {
+	items := make([]OrderItem, 0, len(reqItems))
+	var (
+		currency string
+		total    int64
+	)
+
+	for _, reqItem := range reqItems {
+		// Items of carts are not validated as requests are
+		if reqItem.Quantity < 1 {
+			return nil, "", 0, errOrderItemQuantity
+		}
+
+		product, err := h.products.GetProduct(reqItem.ProductID)
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("product %d: %w", reqItem.ProductID, err)
+		}
+
+		if currency == "" {
+			currency = product.Currency
+		}
+		if product.Currency != currency {
+			return nil, "", 0, errOrderCurrencyMismatch
+		}
+
+		if product.PriceMinor != 0 && reqItem.Quantity > math.MaxInt64/product.PriceMinor {
+			return nil, "", 0, errOrderTotalOverflow
+		}
+		lineTotal := product.PriceMinor * reqItem.Quantity
+		if total > math.MaxInt64-lineTotal {
+			return nil, "", 0, errOrderTotalOverflow
+		}
+		total += lineTotal
+
+		items = append(items, OrderItem{
+			ProductID:      product.ID,
+			SKU:            product.SKU,
+			Name:           product.Name,
+			Quantity:       reqItem.Quantity,
+			UnitPriceMinor: product.PriceMinor,
+			LineTotalMinor: lineTotal,
+		})
+	}
+
+	return items, currency, total, nil
 }
 
 func (h *OrderHandler) GetOrder(c *fiber.Ctx) error {
@@ -79,31 +302,144 @@ func (h *OrderHandler) GetOrder(c *fiber.Ctx) error {
 		return fmt.Errorf("get order: %w", err)
 	}
 
-	return c.JSON(GetOrderResponse(order))
+	return c.JSON(newGetOrderResponse(order))
 }
 
-// Order model
-type Order struct {
-	ID         string
-	UserID     int64
-	ProductIDs []int64
+// ConfirmOrder turns the stock reservation of a pending order into a sale
+func (h *OrderHandler) ConfirmOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+
+	if _, err := h.storage.GetOrder(orderID); err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Order not found")
+	}
+
+	// Reservation is gone if the order was already cancelled or expired
+	if err := h.inventory.Commit(orderID); err != nil {
+		return c.Status(fiber.StatusConflict).SendString("Order is not pending")
+	}
+
+	order, err := h.storage.SetOrderStatus(orderID, OrderStatusConfirmed)
+	if err != nil {
+		return fmt.Errorf("confirm order: %w", err)
+	}
+
+	return c.JSON(newGetOrderResponse(order))
+}
+
+// CancelOrder cancels a pending order and returns its reserved stock
+func (h *OrderHandler) CancelOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+
+	if _, err := h.storage.GetOrder(orderID); err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Order not found")
+	}
+
+	if err := h.inventory.Release(orderID); err != nil {
+		return c.Status(fiber.StatusConflict).SendString("Order is not pending")
+	}
+
+	order, err := h.storage.SetOrderStatus(orderID, OrderStatusCancelled)
+	if err != nil {
+		return fmt.Errorf("cancel order: %w", err)
+	}
+
+	return c.JSON(newGetOrderResponse(order))
 }
 
+// Order model
+type (
+	Order struct {
+		ID         string
+		UserID     int64
+		Status     OrderStatus
+		CreatedAt  time.Time
+		Items      []OrderItem
+		Currency   string
+		TotalMinor int64
+	}
+
+	// Product data is copied into the line item at order time, so later
+	// catalog changes don't affect existing orders
+	OrderItem struct {
+		ProductID      int64
+		SKU            string
+		Name           string
+		Quantity       int64
+		UnitPriceMinor int64
+		LineTotalMinor int64
+	}
+)
+
+type OrderStatus string
+
+const (
+	OrderStatusPending   OrderStatus = "pending"
+	OrderStatusConfirmed OrderStatus = "confirmed"
+	OrderStatusCancelled OrderStatus = "cancelled"
+	OrderStatusExpired   OrderStatus = "expired"
+)
+
 // Storage
 type OrderStorage struct {
 	mu     sync.Mutex
 	orders map[string]Order
+
+	// Secondary indexes for listing
+	all      orderIndex
+	byUser   map[int64]orderIndex
+	byStatus map[OrderStatus]orderIndex
+
+	outbox []OrderEvent
+}
+
+func NewOrderStorage() *OrderStorage {
+	return &OrderStorage{
+		orders:   make(map[string]Order),
+		byUser:   make(map[int64]orderIndex),
+		byStatus: make(map[OrderStatus]orderIndex),
+	}
 }
 
+var errOrderExists = errors.New("order with provided ID already exists")
+
 func (o *OrderStorage) CreateOrder(order Order) (string, error) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
-	o.orders[order.ID] = order
+	if err := o.insert(order); err != nil {
+		return "", err
+	}
+
+	o.recordEvent(OrderEventCreated, order)
 
 	return order.ID, nil
 }
 
+// ImportOrder saves an order created elsewhere. Unlike CreateOrder
+// it doesn't notify subscribers, the order is not new
+func (o *OrderStorage) ImportOrder(order Order) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.insert(order)
+}
+
+// Must be called with o.mu held
+func (o *OrderStorage) insert(order Order) error {
+	if _, exists := o.orders[order.ID]; exists {
+		return errOrderExists
+	}
+
+	o.orders[order.ID] = order
+
+	key := newOrderKey(order)
+	o.all = o.all.insert(key)
+	o.byUser[order.UserID] = o.byUser[order.UserID].insert(key)
+	o.byStatus[order.Status] = o.byStatus[order.Status].insert(key)
+
+	return nil
+}
+
 var errOrderNotFound = errors.New("order not found")
 
 func (o *OrderStorage) GetOrder(orderID string) (Order, error) {
@@ -117,3 +453,30 @@ func (o *OrderStorage) GetOrder(orderID string) (Order, error) {
 
 	return order, nil
 }
+
+var errOrderStatusTransition = errors.New("order status can't be changed")
+
+// Only pending orders may change their status
+func (o *OrderStorage) SetOrderStatus(orderID string, status OrderStatus) (Order, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	order, ok := o.orders[orderID]
+	if !ok {
+		return Order{}, errOrderNotFound
+	}
+	if order.Status != OrderStatusPending {
+		return Order{}, fmt.Errorf("%w: order is %s", errOrderStatusTransition, order.Status)
+	}
+
+	key := newOrderKey(order)
+	o.byStatus[order.Status] = o.byStatus[order.Status].remove(key)
+	o.byStatus[status] = o.byStatus[status].insert(key)
+
+	order.Status = status
+	o.orders[order.ID] = order
+
+	o.recordEvent(OrderEventStatusChanged, order)
+
+	return order, nil
+}
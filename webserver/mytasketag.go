@@ -0,0 +1,65 @@
+package webserver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var errTaskPrecondition = errors.New("task was changed, ETag doesn't match If-Match")
+
+// Tasks have strong ETags made of their version, which grows on every change
+func taskETag(task Task) string {
+	return `"` + strconv.FormatInt(task.Version, 10) + `"`
+}
+
+// etagListMatches checks the ETag against a header with a list of ETags or "*".
+// Weak comparison ignores the W/ prefix, strong one never matches weak ETags
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// taskIfMatch returns the If-Match check of the request, nil if there is
+// no header. Storage runs it on the current task before changing it
+func taskIfMatch(ctx *fiber.Ctx) func(task Task) error {
+	ifMatch := ctx.Get(fiber.HeaderIfMatch)
+	if ifMatch == "" {
+		return nil
+	}
+
+	return func(task Task) error {
+		if !etagListMatches(ifMatch, taskETag(task), false) {
+			return errTaskPrecondition
+		}
+		return nil
+	}
+}
+
+// taskNotModified sets the ETag of the task and reports whether
+// the client's copy from If-None-Match is still current
+func taskNotModified(ctx *fiber.Ctx, task Task) bool {
+	etag := taskETag(task)
+	ctx.Set(fiber.HeaderETag, etag)
+
+	ifNoneMatch := ctx.Get(fiber.HeaderIfNoneMatch)
+
+	return ifNoneMatch != "" && etagListMatches(ifNoneMatch, etag, true)
+}
@@ -0,0 +1,371 @@
+package webserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Changes of tasks are published to the broker as events and streamed to
+// users who can view the tasks over Server-Sent Events or WebSocket.
+// Clients resume after reconnects from the ID of the last event they got.
+// IDs are "<epoch>-<sequence>", the epoch changes with every start of the
+// server, so IDs from before a restart aren't taken for new ones
+
+type TaskEventType string
+
+const (
+	TaskEventCreated TaskEventType = "task.created"
+	TaskEventUpdated TaskEventType = "task.updated"
+	TaskEventDeleted TaskEventType = "task.deleted"
+	// Events after the last event ID of the client are no longer kept,
+	// it has to reload tasks
+	TaskEventReset TaskEventType = "reset"
+)
+
+const (
+	taskEventHistorySize = 1000
+	// Events buffered for the subscriber, slower ones are disconnected
+	// and resume from the history
+	taskEventBufferSize = 64
+	taskEventHeartbeat  = 15 * time.Second
+	// Reconnection delay for EventSource clients
+	taskEventRetry = 3 * time.Second
+)
+
+type TaskEvent struct {
+	ID      string        `json:"id"`
+	Type    TaskEventType `json:"type"`
+	TaskID  int64         `json:"task_id,omitempty"`
+	ActorID int64         `json:"actor_id,omitempty"`
+	At      int64         `json:"at"`
+	// State of the task after the change, the last one for deleted tasks
+	Task *Task `json:"task,omitempty"`
+
+	// Users who can view the task
+	viewers map[int64]bool
+	// Sequence number within the epoch of the broker
+	seq int64
+}
+
+// TaskEventBroker keeps recent events and fans them out to subscribers
+type TaskEventBroker struct {
+	mu          sync.Mutex
+	epoch       string
+	lastSeq     int64
+	historySize int
+	// The latest events, the oldest first
+	history     []TaskEvent
+	subscribers map[*TaskEventSubscription]bool
+}
+
+// TaskEventSubscription receives events for tasks its user can view.
+// Events is closed when the subscriber falls behind or is closed
+type TaskEventSubscription struct {
+	Events <-chan TaskEvent
+	// Events missed since the last event ID, sent before Events
+	Missed []TaskEvent
+
+	broker *TaskEventBroker
+	userID int64
+	events chan TaskEvent
+}
+
+func NewTaskEventBroker(historySize int) *TaskEventBroker {
+	return &TaskEventBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		historySize: historySize,
+		subscribers: make(map[*TaskEventSubscription]bool),
+	}
+}
+
+// Publish assigns the next ID to the event and sends it to subscribers
+// who can view the task. It never blocks
+func (b *TaskEventBroker) Publish(event TaskEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastSeq++
+	event.seq = b.lastSeq
+	event.ID = b.eventID(b.lastSeq)
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = append(b.history[:0:0], b.history[len(b.history)-b.historySize:]...)
+	}
+
+	for sub := range b.subscribers {
+		if !event.viewers[sub.userID] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			b.unsubscribe(sub)
+		}
+	}
+}
+
+func (b *TaskEventBroker) eventID(seq int64) string {
+	return b.epoch + "-" + strconv.FormatInt(seq, 10)
+}
+
+// parseTaskEventID splits the event ID into the epoch and the sequence number
+func parseTaskEventID(id string) (string, int64, error) {
+	epoch, seqValue, ok := strings.Cut(id, "-")
+	seq, err := strconv.ParseInt(seqValue, 10, 64)
+	if !ok || epoch == "" || err != nil || seq < 0 {
+		return "", 0, fmt.Errorf("invalid event ID %q", id)
+	}
+
+	return epoch, seq, nil
+}
+
+// Subscribe subscribes the user to events after lastEventID, empty means
+// only new events. If the missed events are no longer kept, or the ID is
+// from another epoch, Missed is a single reset event
+func (b *TaskEventBroker) Subscribe(userID int64, lastEventID string) *TaskEventSubscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make(chan TaskEvent, taskEventBufferSize)
+	sub := &TaskEventSubscription{Events: events, broker: b, userID: userID, events: events}
+	b.subscribers[sub] = true
+
+	if lastEventID == "" {
+		return sub
+	}
+	epoch, seq, err := parseTaskEventID(lastEventID)
+	switch {
+	case err == nil && epoch == b.epoch && seq == b.lastSeq:
+	case err != nil || epoch != b.epoch || seq > b.lastSeq || len(b.history) == 0 || seq < b.history[0].seq-1:
+		sub.Missed = []TaskEvent{{ID: b.eventID(b.lastSeq), Type: TaskEventReset, At: time.Now().Unix(), seq: b.lastSeq}}
+	default:
+		for _, event := range b.history[seq-b.history[0].seq+1:] {
+			if event.viewers[userID] {
+				sub.Missed = append(sub.Missed, event)
+			}
+		}
+	}
+
+	return sub
+}
+
+// unsubscribe removes the subscriber and closes its events. Must be called with b.mu held
+func (b *TaskEventBroker) unsubscribe(sub *TaskEventSubscription) {
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (sub *TaskEventSubscription) Close() {
+	sub.broker.mu.Lock()
+	defer sub.broker.mu.Unlock()
+
+	sub.broker.unsubscribe(sub)
+}
+
+// viewers returns users who can view the task: owners, assignees and users
+// it's shared with of the task and its ancestors. Must be called with s.mu held
+func (s *TaskStorageInMemory) viewers(t Task) map[int64]bool {
+	viewers := make(map[int64]bool)
+	for {
+		viewers[t.OwnerID] = true
+		if t.AssigneeID != 0 {
+			viewers[t.AssigneeID] = true
+		}
+		for _, share := range t.Shares {
+			viewers[share.UserID] = true
+		}
+
+		parent, ok := s.tasks[t.ParentID]
+		if t.ParentID == 0 || !ok {
+			return viewers
+		}
+		t = parent
+	}
+}
+
+// publish sends the event of the revision. Must be called with s.mu held
+func (s *TaskStorageInMemory) publish(action TaskAction, actorID int64, task Task) {
+	eventType := TaskEventUpdated
+	switch action {
+	case TaskActionCreated, TaskActionRestored:
+		eventType = TaskEventCreated
+	case TaskActionDeleted:
+		eventType = TaskEventDeleted
+	}
+
+	s.events.Publish(TaskEvent{
+		Type:    eventType,
+		TaskID:  task.ID,
+		ActorID: actorID,
+		At:      task.UpdatedAt,
+		Task:    &task,
+		viewers: s.viewers(task),
+	})
+}
+
+// Subscribe subscribes the user to changes of tasks they can view
+func (s *TaskStorageInMemory) Subscribe(userID int64, lastEventID string) *TaskEventSubscription {
+	return s.events.Subscribe(userID, lastEventID)
+}
+
+// requireStreamAuth is RequireAuth which also takes the access token from
+// the access_token query parameter, since EventSource and WebSocket in
+// browsers can't send headers. Tokens in URLs get into logs, so headers
+// are preferred when the client can send them
+func requireStreamAuth(ctx *fiber.Ctx) error {
+	if token := ctx.Query("access_token"); token != "" && ctx.Get(fiber.HeaderAuthorization) == "" {
+		ctx.Request().Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+
+	return RequireAuth(ctx)
+}
+
+// lastTaskEventID returns the ID from the Last-Event-ID header, which
+// EventSource sends on reconnects, or from the last_event_id parameter
+func lastTaskEventID(ctx *fiber.Ctx) (string, error) {
+	id := ctx.Get("Last-Event-ID")
+	if id == "" {
+		id = ctx.Query("last_event_id")
+	}
+	if id == "" {
+		return "", nil
+	}
+
+	if _, _, err := parseTaskEventID(id); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// taskEvents handles GET /tasks/events. WebSocket upgrade requests get
+// events as JSON text messages, others get an event stream
+func taskEvents(ctx *fiber.Ctx, storage *TaskStorageInMemory) error {
+	lastEventID, err := lastTaskEventID(ctx)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	userID, _ := authUserID(ctx)
+
+	if strings.EqualFold(ctx.Get(fiber.HeaderUpgrade), "websocket") {
+		return upgradeWebSocket(ctx, func(ws *webSocketConn) {
+			streamTaskEventsWebSocket(ws, storage.Subscribe(userID, lastEventID))
+		})
+	}
+
+	ctx.Set(fiber.HeaderContentType, "text/event-stream")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	// Proxies like nginx buffer responses unless told otherwise
+	ctx.Set("X-Accel-Buffering", "no")
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		streamTaskEventsSSE(w, storage.Subscribe(userID, lastEventID))
+	})
+
+	return nil
+}
+
+// streamTaskEventsSSE writes events until the client goes away, heartbeat
+// comments find closed connections
+func streamTaskEventsSSE(w *bufio.Writer, sub *TaskEventSubscription) {
+	defer sub.Close()
+
+	write := func(event TaskEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return w.Flush()
+	}
+
+	fmt.Fprintf(w, "retry: %d\n\n", taskEventRetry.Milliseconds())
+	if err := w.Flush(); err != nil {
+		return
+	}
+	for _, event := range sub.Missed {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(taskEventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			// Slow clients reconnect and get missed events from the history
+			if !ok {
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			w.WriteString(": heartbeat\n\n")
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamTaskEventsWebSocket sends events as text messages until the client
+// closes the connection. Messages from the client other than control ones
+// are ignored
+func streamTaskEventsWebSocket(ws *webSocketConn, sub *TaskEventSubscription) {
+	defer sub.Close()
+
+	write := func(event TaskEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(webSocketOpText, data)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		if err := ws.ReadUntilClose(); err != nil {
+			logrus.WithError(err).Debug("WebSocket read")
+		}
+	}()
+
+	for _, event := range sub.Missed {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(taskEventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Clients resume with the ID of the last event they got
+				_ = ws.Close(webSocketCloseTryAgainLater, "too slow, reconnect with last_event_id")
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := ws.WriteMessage(webSocketOpPing, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package webserver
+
+import (
+	"fmt"
+	"testing"
+)
+
+func missedIDs(sub *TaskEventSubscription) []string {
+	ids := make([]string, 0, len(sub.Missed))
+	for _, event := range sub.Missed {
+		id := event.ID
+		if event.Type == TaskEventReset {
+			id = "reset " + id
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Subscribers resume from the history while their last event is in it or
+// right before it, otherwise they get a reset with the latest ID
+func TestTaskEventBrokerResume(t *testing.T) {
+	const user int64 = 1
+
+	empty := NewTaskEventBroker(3)
+	for lastEventID, want := range map[string][]string{
+		"":                 {},
+		empty.eventID(0):   {},
+		empty.eventID(1):   {"reset " + empty.eventID(0)},
+		"other-0":          {"reset " + empty.eventID(0)},
+		empty.epoch + "-x": {"reset " + empty.eventID(0)},
+	} {
+		sub := empty.Subscribe(user, lastEventID)
+		if got := missedIDs(sub); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("empty history, last event %q: got %v, want %v", lastEventID, got, want)
+		}
+		sub.Close()
+	}
+
+	broker := NewTaskEventBroker(3)
+	for seq := 1; seq <= 5; seq++ {
+		viewers := map[int64]bool{user: true}
+		// Events of tasks the user can't view are not sent
+		if seq == 4 {
+			viewers = map[int64]bool{user + 1: true}
+		}
+		broker.Publish(TaskEvent{Type: TaskEventUpdated, TaskID: int64(seq), viewers: viewers})
+	}
+	// The history keeps events 3, 4 and 5
+	id := broker.eventID
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{"only new events", "", []string{}},
+		{"up to date", id(5), []string{}},
+		{"one behind", id(4), []string{id(5)}},
+		{"first kept event", id(3), []string{id(5)}},
+		{"right before the history", id(2), []string{id(3), id(5)}},
+		{"before the history", id(1), []string{"reset " + id(5)}},
+		{"from the future", id(6), []string{"reset " + id(5)}},
+		{"previous epoch", "0-4", []string{"reset " + id(5)}},
+		{"malformed", "5", []string{"reset " + id(5)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := broker.Subscribe(user, tt.lastEventID)
+			defer sub.Close()
+
+			if got := missedIDs(sub); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Subscribers get new events they can view, slow ones are disconnected
+func TestTaskEventBrokerDelivery(t *testing.T) {
+	const user int64 = 1
+	broker := NewTaskEventBroker(taskEventHistorySize)
+	sub := broker.Subscribe(user, "")
+
+	broker.Publish(TaskEvent{Type: TaskEventCreated, TaskID: 1, viewers: map[int64]bool{user + 1: true}})
+	broker.Publish(TaskEvent{Type: TaskEventCreated, TaskID: 2, viewers: map[int64]bool{user: true}})
+	if event := <-sub.Events; event.TaskID != 2 || event.ID != broker.eventID(2) {
+		t.Fatalf("got %+v, want event %s of task 2", event, broker.eventID(2))
+	}
+
+	for i := 0; i <= taskEventBufferSize; i++ {
+		broker.Publish(TaskEvent{Type: TaskEventUpdated, TaskID: 2, viewers: map[int64]bool{user: true}})
+	}
+	received := 0
+	for range sub.Events {
+		received++
+	}
+	if received != taskEventBufferSize {
+		t.Fatalf("got %d events before the disconnect, want %d", received, taskEventBufferSize)
+	}
+	// Closing a disconnected subscription is a no-op
+	sub.Close()
+}
@@ -0,0 +1,225 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every change of a task is a revision with the user who made it and
+// the changed fields. The last maxTaskRevisions revisions are kept while
+// the task is live or in the trash, a task can be reverted to the state
+// of any of them
+
+type TaskAction string
+
+const (
+	TaskActionCreated  TaskAction = "created"
+	TaskActionUpdated  TaskAction = "updated"
+	TaskActionDeleted  TaskAction = "deleted"
+	TaskActionRestored TaskAction = "restored"
+	TaskActionReverted TaskAction = "reverted"
+)
+
+// Older revisions are dropped, so frequently changed tasks don't grow
+// the memory without a bound
+const maxTaskRevisions = 100
+
+var errTaskRevisionNotFound = errors.New("revision not found")
+
+type (
+	// TaskFieldChange is the change of a field of the task, values are
+	// the JSON of the field as in task responses
+	TaskFieldChange struct {
+		Field string          `json:"field"`
+		From  json.RawMessage `json:"from"`
+		To    json.RawMessage `json:"to"`
+	}
+
+	// ActorID is 0 for changes made by the server, such as overdue marks
+	TaskRevision struct {
+		ID      int64             `json:"id"`
+		TaskID  int64             `json:"task_id"`
+		Version int64             `json:"version"`
+		Action  TaskAction        `json:"action"`
+		ActorID int64             `json:"actor_id"`
+		At      int64             `json:"at"`
+		Changes []TaskFieldChange `json:"changes"`
+
+		// State of the task after the revision
+		task Task
+	}
+
+	ListTaskHistoryResponse struct {
+		Revisions []TaskRevision `json:"revisions"`
+	}
+
+	RevertTaskRequest struct {
+		Revision int64 `json:"revision"`
+	}
+)
+
+// Fields which never change or change with every revision aren't part of diffs
+var taskDiffIgnored = map[string]bool{"ID": true, "CreatedAt": true, "Version": true, "UpdatedAt": true}
+
+// diffTasks returns changed fields of the task sorted by name. Empty and
+// missing lists are the same
+func diffTasks(before, after Task) []TaskFieldChange {
+	fields := func(t Task) map[string]json.RawMessage {
+		var m map[string]json.RawMessage
+		// Task has only plain fields, so it always marshals
+		data, _ := json.Marshal(t)
+		_ = json.Unmarshal(data, &m)
+		return m
+	}
+	isEmpty := func(v json.RawMessage) bool {
+		return string(v) == "null" || string(v) == "[]"
+	}
+
+	from, to := fields(before), fields(after)
+	changes := make([]TaskFieldChange, 0)
+	for field, value := range to {
+		if taskDiffIgnored[field] || bytes.Equal(from[field], value) || isEmpty(from[field]) && isEmpty(value) {
+			continue
+		}
+		changes = append(changes, TaskFieldChange{Field: field, From: from[field], To: value})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+
+	return changes
+}
+
+// put stores the task and records its revision. Must be called with s.mu held
+func (s *TaskStorageInMemory) put(action TaskAction, actorID int64, task Task) {
+	before := s.tasks[task.ID]
+	s.tasks[task.ID] = task
+	s.record(action, actorID, before, task)
+}
+
+// record adds the revision of the task changed from before to after and
+// publishes its event. Updates which change nothing but the version aren't
+// recorded. Must be called with s.mu held
+func (s *TaskStorageInMemory) record(action TaskAction, actorID int64, before, after Task) {
+	changes := diffTasks(before, after)
+	if action == TaskActionUpdated && len(changes) == 0 {
+		return
+	}
+
+	revisions := append(s.revisions[after.ID], TaskRevision{
+		ID:      s.revisionIDs.NextID(),
+		TaskID:  after.ID,
+		Version: after.Version,
+		Action:  action,
+		ActorID: actorID,
+		At:      after.UpdatedAt,
+		Changes: changes,
+		task:    after,
+	})
+	if len(revisions) > maxTaskRevisions {
+		revisions = append(revisions[:0:0], revisions[len(revisions)-maxTaskRevisions:]...)
+	}
+	s.revisions[after.ID] = revisions
+	s.publish(action, actorID, after)
+}
+
+// History returns the kept revisions of the task, the oldest first
+func (s *TaskStorageInMemory) History(id int64, check func(task Task) error) ([]TaskRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return nil, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return nil, err
+	}
+
+	return append(make([]TaskRevision, 0, len(s.revisions[id])), s.revisions[id]...), nil
+}
+
+// Revert returns the task to its state after the revision. Access, the
+// overdue mark and series of recurring tasks are kept, relations are
+// checked as in updates
+func (s *TaskStorageInMemory) Revert(id int64, actorID int64, revisionID int64, check func(task Task) error) (Task, error) {
+	return s.updateWith(TaskActionReverted, id, actorID, check, func(task Task) (Task, error) {
+		var state Task
+		found := false
+		for _, revision := range s.revisions[id] {
+			if revision.ID == revisionID {
+				state, found = revision.task, true
+				break
+			}
+		}
+		if !found {
+			return Task{}, errTaskRevisionNotFound
+		}
+
+		task.Description = state.Description
+		task.Deadline = state.Deadline
+		task.Status = state.Status
+		task.Priority = state.Priority
+		task.Tags = state.Tags
+		task.Recurrence = state.Recurrence
+		task.ProjectID = state.ProjectID
+		task.ParentID = state.ParentID
+		task.BlockedBy = state.BlockedBy
+
+		return task, nil
+	})
+}
+
+// registerTaskHistory adds history and revert routes
+func registerTaskHistory(webApp *fiber.App, storage *TaskStorageInMemory) {
+	// Get revisions of task, everyone who can view it can see them
+	webApp.Get("/tasks/:id/history", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		revisions, err := storage.History(id, storage.Authorize(userID, taskAccessView))
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+
+		return ctx.JSON(ListTaskHistoryResponse{Revisions: revisions})
+	})
+
+	// Revert task to the revision, it's a new revision itself
+	webApp.Post("/tasks/:id/revert", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		var req RevertTaskRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return fmt.Errorf("body parser: %w", err)
+		}
+
+		userID, _ := authUserID(ctx)
+		task, err := storage.Revert(id, userID, req.Revision, taskChecks(storage.Authorize(userID, taskAccessEdit), taskIfMatch(ctx)))
+		switch {
+		case errors.Is(err, errTaskPrecondition):
+			return ctx.Status(fiber.StatusPreconditionFailed).SendString(err.Error())
+		case errors.Is(err, errTaskRevisionNotFound):
+			return ctx.Status(fiber.StatusNotFound).SendString(err.Error())
+		case taskValidationError(err) || taskRelationError(err):
+			return ctx.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		case errors.Is(err, errTaskBlocked):
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		case err != nil:
+			return sendTaskError(ctx, err)
+		}
+		ctx.Set(fiber.HeaderETag, taskETag(task))
+
+		return ctx.JSON(GetTaskResponse{Task: task})
+	})
+}
@@ -0,0 +1,669 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ermakovov/learn-golang/webserver2"
+	"github.com/gofiber/fiber/v2"
+)
+
+// iCalendar (RFC 5545) feed of task deadlines and import of .ics files
+
+const (
+	icalDateTimeUTC   = "20060102T150405Z"
+	icalDateTimeLocal = "20060102T150405"
+	icalDate          = "20060102"
+	icalProdID        = "-//learn-golang//todo server//EN"
+	icalLineLength    = 75
+
+	icalComponentEvent = "VEVENT"
+	icalComponentTodo  = "VTODO"
+
+	maxICalImportItems = 1000
+	// Transitions of the feed time zone written to VTIMEZONE
+	maxICalZoneTransitions = 100
+)
+
+var (
+	errICalInvalid      = errors.New("invalid iCalendar data")
+	errICalTooLarge     = fmt.Errorf("calendar must contain at most %d tasks", maxICalImportItems)
+	errICalTimeZone     = errors.New("unknown time zone")
+	errICalNoSummary    = errors.New("SUMMARY or DESCRIPTION is required")
+	errICalCancelled    = errors.New("cancelled items are not imported")
+	errICalInvalidValue = errors.New("invalid property value")
+)
+
+type (
+	FeedTokenResponse struct {
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+
+	ImportTasksResponse struct {
+		Imported int                 `json:"imported"`
+		Results  []ImportTasksResult `json:"results"`
+	}
+
+	// Item is the 1-based position of the VTODO or VEVENT in the calendar
+	ImportTasksResult struct {
+		Item   int    `json:"item"`
+		UID    string `json:"uid,omitempty"`
+		Status int    `json:"status"`
+		ID     int64  `json:"id,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+)
+
+// icalFeed is the calendar of tasks with deadlines. Times are written in
+// Location with its VTIMEZONE, or in UTC
+type icalFeed struct {
+	Component string
+	Location  *time.Location
+	// Host part of UIDs, so they are globally unique
+	Host string
+	Now  time.Time
+}
+
+type icalWriter struct {
+	buf bytes.Buffer
+}
+
+// line writes the content line folded at 75 octets without splitting characters
+func (w *icalWriter) line(name, value string) {
+	length := 0
+	for _, r := range name + ":" + value {
+		size := utf8.RuneLen(r)
+		if length+size > icalLineLength {
+			w.buf.WriteString("\r\n ")
+			length = 1
+		}
+		w.buf.WriteRune(r)
+		length += size
+	}
+	w.buf.WriteString("\r\n")
+}
+
+func escapeICalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func unescapeICalText(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// timeLine writes the date-time property in the feed time zone
+func (f icalFeed) timeLine(w *icalWriter, name string, unix int64) {
+	t := time.Unix(unix, 0)
+	if f.Location == time.UTC {
+		w.line(name, t.UTC().Format(icalDateTimeUTC))
+		return
+	}
+
+	w.line(name+";TZID="+f.Location.String(), t.In(f.Location).Format(icalDateTimeLocal))
+}
+
+// Write writes the calendar with the tasks which have deadlines
+func (f icalFeed) Write(out io.Writer, tasks []Task) error {
+	w := &icalWriter{}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", icalProdID)
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", "Tasks")
+
+	var from, to int64
+	for _, task := range tasks {
+		if task.Deadline == 0 {
+			continue
+		}
+		if from == 0 || task.Deadline < from {
+			from = task.Deadline
+		}
+		to = max(to, task.Deadline)
+	}
+	if from != 0 && f.Location != time.UTC {
+		writeVTimezone(w, f.Location, time.Unix(from, 0), time.Unix(to, 0))
+	}
+
+	for _, task := range tasks {
+		if task.Deadline != 0 {
+			f.writeTask(w, task)
+		}
+	}
+
+	w.line("END", "VCALENDAR")
+	_, err := out.Write(w.buf.Bytes())
+
+	return err
+}
+
+func (f icalFeed) uid(taskID int64) string {
+	return "task-" + strconv.FormatInt(taskID, 10) + "@" + f.Host
+}
+
+func (f icalFeed) writeTask(w *icalWriter, task Task) {
+	w.line("BEGIN", f.Component)
+	w.line("UID", f.uid(task.ID))
+	w.line("DTSTAMP", f.Now.UTC().Format(icalDateTimeUTC))
+	w.line("CREATED", time.Unix(task.CreatedAt, 0).UTC().Format(icalDateTimeUTC))
+	w.line("LAST-MODIFIED", time.Unix(task.UpdatedAt, 0).UTC().Format(icalDateTimeUTC))
+	w.line("SEQUENCE", strconv.FormatInt(task.Version-1, 10))
+	w.line("SUMMARY", escapeICalText(task.Description))
+
+	if f.Component == icalComponentTodo {
+		f.timeLine(w, "DUE", task.Deadline)
+		switch task.Status {
+		case TaskStatusDone:
+			w.line("STATUS", "COMPLETED")
+			w.line("COMPLETED", time.Unix(task.CompletedAt, 0).UTC().Format(icalDateTimeUTC))
+		case TaskStatusInProgress:
+			w.line("STATUS", "IN-PROCESS")
+		default:
+			w.line("STATUS", "NEEDS-ACTION")
+		}
+		if task.ParentID != 0 {
+			w.line("RELATED-TO", f.uid(task.ParentID))
+		}
+	} else {
+		f.timeLine(w, "DTSTART", task.Deadline)
+		w.line("TRANSP", "TRANSPARENT")
+	}
+
+	switch task.Priority {
+	case TaskPriorityHigh:
+		w.line("PRIORITY", "1")
+	case TaskPriorityMedium:
+		w.line("PRIORITY", "5")
+	case TaskPriorityLow:
+		w.line("PRIORITY", "9")
+	}
+
+	if len(task.Tags) > 0 {
+		categories := make([]string, 0, len(task.Tags))
+		for _, tag := range task.Tags {
+			categories = append(categories, escapeICalText(tag))
+		}
+		w.line("CATEGORIES", strings.Join(categories, ","))
+	}
+
+	// Every occurrence is a separate task, so the open one carries
+	// the rest of the series
+	if task.Recurrence != "" && task.Status != TaskStatusDone {
+		if rule, err := ParseRecurrenceRule(task.Recurrence); err == nil {
+			if rule.Count != 0 {
+				rule.Count = max(rule.Count-task.Occurrence+1, 1)
+			}
+			w.line("RRULE", rule.String())
+		}
+	}
+
+	w.line("END", f.Component)
+}
+
+// writeVTimezone writes the time zone with all its transitions between
+// the beginnings of the years of from and of the year after to
+func writeVTimezone(w *icalWriter, loc *time.Location, from, to time.Time) {
+	start := time.Date(from.In(loc).Year(), time.January, 1, 0, 0, 0, 0, loc)
+	end := time.Date(to.In(loc).Year()+1, time.January, 1, 0, 0, 0, 0, loc)
+
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+
+	observance := func(onset time.Time, offsetFrom int) {
+		name, offset := onset.In(loc).Zone()
+		kind := "STANDARD"
+		if onset.In(loc).IsDST() {
+			kind = "DAYLIGHT"
+		}
+
+		w.line("BEGIN", kind)
+		// Onset is in the local time before the transition
+		w.line("DTSTART", onset.UTC().Add(time.Duration(offsetFrom)*time.Second).Format(icalDateTimeLocal))
+		w.line("TZOFFSETFROM", formatUTCOffset(offsetFrom))
+		w.line("TZOFFSETTO", formatUTCOffset(offset))
+		w.line("TZNAME", name)
+		w.line("END", kind)
+	}
+
+	_, offset := start.Zone()
+	observance(start, offset)
+	for t, i := start, 0; i < maxICalZoneTransitions; i++ {
+		_, next := t.ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		observance(next, offset)
+		_, offset = next.In(loc).Zone()
+		t = next
+	}
+
+	w.line("END", "VTIMEZONE")
+}
+
+func formatUTCOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+
+	formatted := fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds%3600/60)
+	if seconds%60 != 0 {
+		formatted += fmt.Sprintf("%02d", seconds%60)
+	}
+
+	return formatted
+}
+
+type (
+	icalProperty struct {
+		Name   string
+		Params map[string]string
+		Value  string
+	}
+
+	icalComponent struct {
+		Name       string
+		Properties []icalProperty
+	}
+)
+
+func (c icalComponent) property(name string) (icalProperty, bool) {
+	for _, property := range c.Properties {
+		if property.Name == name {
+			return property, true
+		}
+	}
+
+	return icalProperty{}, false
+}
+
+// parseICal returns VTODO and VEVENT components of the calendar with their
+// own properties, nested components like VALARM are skipped
+func parseICal(data []byte) ([]icalComponent, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.NewReplacer("\n ", "", "\n\t", "").Replace(text)
+
+	var (
+		components []icalComponent
+		stack      []string
+	)
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		property, err := parseICalLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", errICalInvalid, i+1, err)
+		}
+		if len(stack) == 0 && (property.Name != "BEGIN" || strings.ToUpper(property.Value) != "VCALENDAR") {
+			return nil, fmt.Errorf("%w: calendar must start with BEGIN:VCALENDAR", errICalInvalid)
+		}
+
+		switch property.Name {
+		case "BEGIN":
+			name := strings.ToUpper(property.Value)
+			stack = append(stack, name)
+			if len(stack) == 2 && (name == icalComponentTodo || name == icalComponentEvent) {
+				if len(components) == maxICalImportItems {
+					return nil, errICalTooLarge
+				}
+				components = append(components, icalComponent{Name: name})
+			}
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1] != strings.ToUpper(property.Value) {
+				return nil, fmt.Errorf("%w: line %d: unexpected END:%s", errICalInvalid, i+1, property.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 2 && (stack[1] == icalComponentTodo || stack[1] == icalComponentEvent) {
+				last := &components[len(components)-1]
+				last.Properties = append(last.Properties, property)
+			}
+		}
+	}
+	if len(stack) != 0 {
+		return nil, fmt.Errorf("%w: %s is not closed", errICalInvalid, stack[len(stack)-1])
+	}
+
+	return components, nil
+}
+
+// parseICalLine parses "NAME;PARAM=value;PARAM="quoted:value":VALUE"
+func parseICalLine(line string) (icalProperty, error) {
+	property := icalProperty{Params: make(map[string]string)}
+
+	end := strings.IndexAny(line, ";:")
+	if end <= 0 {
+		return icalProperty{}, errors.New("property name is missing")
+	}
+	property.Name = strings.ToUpper(line[:end])
+	rest := line[end:]
+
+	for strings.HasPrefix(rest, ";") {
+		rest = rest[1:]
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return icalProperty{}, fmt.Errorf("parameter of %s has no value", property.Name)
+		}
+
+		if strings.HasPrefix(value, `"`) {
+			quoted, after, ok := strings.Cut(value[1:], `"`)
+			if !ok {
+				return icalProperty{}, fmt.Errorf("parameter of %s is not closed", property.Name)
+			}
+			property.Params[strings.ToUpper(name)] = quoted
+			rest = after
+		} else {
+			end := strings.IndexAny(value, ";:")
+			if end < 0 {
+				return icalProperty{}, fmt.Errorf("%s has no value", property.Name)
+			}
+			property.Params[strings.ToUpper(name)] = value[:end]
+			rest = value[end:]
+		}
+	}
+
+	value, ok := strings.CutPrefix(rest, ":")
+	if !ok {
+		return icalProperty{}, fmt.Errorf("%s has no value", property.Name)
+	}
+	property.Value = value
+
+	return property, nil
+}
+
+// parseICalTime parses DATE and DATE-TIME values. Times without TZID and
+// without the UTC suffix, as well as dates, are in the floating location
+func parseICalTime(property icalProperty, floating *time.Location) (time.Time, error) {
+	loc := floating
+	if tzid := property.Params["TZID"]; tzid != "" {
+		var err error
+		if loc, err = time.LoadLocation(strings.TrimPrefix(tzid, "/")); err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s", errICalTimeZone, tzid)
+		}
+	}
+
+	value := property.Value
+	var (
+		t   time.Time
+		err error
+	)
+	switch {
+	case property.Params["VALUE"] == "DATE" || len(value) == len(icalDate):
+		t, err = time.ParseInLocation(icalDate, value, loc)
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse(icalDateTimeUTC, value)
+	default:
+		t, err = time.ParseInLocation(icalDateTimeLocal, value, loc)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s %q", errICalInvalidValue, property.Name, value)
+	}
+
+	return t, nil
+}
+
+// icalTask maps the component to a task: SUMMARY is the description, DUE of
+// VTODO or DTSTART is the deadline
+func icalTask(c icalComponent, floating *time.Location) (Task, error) {
+	var task Task
+
+	if summary, ok := c.property("SUMMARY"); ok {
+		task.Description = strings.TrimSpace(unescapeICalText(summary.Value))
+	}
+	if description, ok := c.property("DESCRIPTION"); ok && task.Description == "" {
+		task.Description = strings.TrimSpace(unescapeICalText(description.Value))
+	}
+	if task.Description == "" {
+		return Task{}, errICalNoSummary
+	}
+
+	deadline, ok := c.property("DUE")
+	if !ok || c.Name != icalComponentTodo {
+		deadline, ok = c.property("DTSTART")
+	}
+	if ok {
+		t, err := parseICalTime(deadline, floating)
+		if err != nil {
+			return Task{}, err
+		}
+		task.Deadline = t.Unix()
+	}
+
+	if status, ok := c.property("STATUS"); ok {
+		switch strings.ToUpper(status.Value) {
+		case "COMPLETED":
+			task.Status = TaskStatusDone
+		case "IN-PROCESS":
+			task.Status = TaskStatusInProgress
+		case "CANCELLED":
+			return Task{}, errICalCancelled
+		}
+	}
+
+	if priority, ok := c.property("PRIORITY"); ok {
+		value, err := strconv.Atoi(priority.Value)
+		if err != nil || value < 0 || value > 9 {
+			return Task{}, fmt.Errorf("%w: PRIORITY %q", errICalInvalidValue, priority.Value)
+		}
+		switch {
+		case value == 0:
+		case value <= 4:
+			task.Priority = TaskPriorityHigh
+		case value == 5:
+			task.Priority = TaskPriorityMedium
+		default:
+			task.Priority = TaskPriorityLow
+		}
+	}
+
+	for _, property := range c.Properties {
+		if property.Name != "CATEGORIES" {
+			continue
+		}
+		// Commas escaped as \, are part of the category
+		for _, category := range strings.Split(strings.ReplaceAll(property.Value, `\,`, "\x00"), ",") {
+			task.Tags = append(task.Tags, unescapeICalText(strings.ReplaceAll(category, "\x00", `\,`)))
+		}
+	}
+
+	if rrule, ok := c.property("RRULE"); ok {
+		task.Recurrence = rrule.Value
+	}
+
+	return task, nil
+}
+
+// icalLocation returns the location of the tz query param, UTC by default
+func icalLocation(ctx *fiber.Ctx) (*time.Location, error) {
+	tz := ctx.Query("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errICalTimeZone, tz)
+	}
+
+	return loc, nil
+}
+
+// FeedTokenStore keeps the ID of the current feed token of every user.
+// Issuing a token revokes the previous one of the user
+type FeedTokenStore struct {
+	mu     sync.Mutex
+	tokens map[int64]string
+}
+
+func NewFeedTokenStore() *FeedTokenStore {
+	return &FeedTokenStore{tokens: make(map[int64]string)}
+}
+
+func (s *FeedTokenStore) issue(claims webserver2.FeedTokenClaims) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[claims.UserID] = claims.TokenID
+}
+
+func (s *FeedTokenStore) revoke(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tokens, userID)
+}
+
+// valid reports whether the token is the current one of its user
+func (s *FeedTokenStore) valid(claims webserver2.FeedTokenClaims) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens[claims.UserID] == claims.TokenID
+}
+
+// issueFeedToken handles POST /tasks/feed-token, the returned URL can be
+// subscribed to from calendar apps. The previous URL of the user stops working
+func issueFeedToken(ctx *fiber.Ctx, tokens *FeedTokenStore) error {
+	userID, _ := authUserID(ctx)
+	email, _ := ctx.Locals(localsUserEmail).(string)
+
+	token, claims, err := webserver2.IssueFeedToken(webserver2.AccessTokenClaims{Email: email, UserID: userID})
+	if err != nil {
+		return fmt.Errorf("issue feed token: %w", err)
+	}
+	tokens.issue(claims)
+
+	return ctx.JSON(FeedTokenResponse{
+		Token: token,
+		URL:   ctx.BaseURL() + "/tasks.ics?token=" + token,
+	})
+}
+
+// taskFeed handles GET /tasks.ics?token=&tz=&component= with tasks the user
+// of the token can view. Deadlines are VEVENTs by default, component=vtodo
+// makes them VTODOs
+func taskFeed(ctx *fiber.Ctx, storage *TaskStorageInMemory, tokens *FeedTokenStore) error {
+	claims, err := webserver2.ParseFeedToken(ctx.Query("token"))
+	if err != nil || !tokens.valid(claims) {
+		return ctx.Status(fiber.StatusUnauthorized).SendString("Invalid feed token")
+	}
+
+	loc, err := icalLocation(ctx)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	feed := icalFeed{Location: loc, Host: ctx.Hostname(), Now: time.Now()}
+	switch strings.ToUpper(ctx.Query("component", icalComponentEvent)) {
+	case icalComponentEvent:
+		feed.Component = icalComponentEvent
+	case icalComponentTodo:
+		feed.Component = icalComponentTodo
+	default:
+		return ctx.Status(fiber.StatusBadRequest).SendString("component must be vevent or vtodo")
+	}
+
+	tasks := storage.WithDeadlines(claims.UserID)
+	ctx.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	ctx.Set(fiber.HeaderContentDisposition, `inline; filename="tasks.ics"`)
+
+	return feed.Write(ctx, tasks)
+}
+
+// importTasks handles POST /tasks/import with a text/calendar body or
+// a multipart form with the file field. tz is the location of floating times
+func importTasks(ctx *fiber.Ctx, storage *TaskStorageInMemory) error {
+	floating, err := icalLocation(ctx)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	data := ctx.Body()
+	mediaType, _, _ := mime.ParseMediaType(ctx.Get(fiber.HeaderContentType))
+	if mediaType == fiber.MIMEMultipartForm {
+		header, err := ctx.FormFile("file")
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("file field is required")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return fmt.Errorf("open uploaded file: %w", err)
+		}
+		defer file.Close()
+
+		if data, err = io.ReadAll(file); err != nil {
+			return fmt.Errorf("read uploaded file: %w", err)
+		}
+	}
+
+	components, err := parseICal(data)
+	if errors.Is(err, errICalTooLarge) {
+		return ctx.Status(fiber.StatusRequestEntityTooLarge).SendString(err.Error())
+	}
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	ownerID, _ := authUserID(ctx)
+	resp := ImportTasksResponse{Results: make([]ImportTasksResult, 0, len(components))}
+	for i, component := range components {
+		result := ImportTasksResult{Item: i + 1}
+		if uid, ok := component.property("UID"); ok {
+			result.UID = uid.Value
+		}
+
+		task, err := icalTask(component, floating)
+		task.OwnerID = ownerID
+		if err == nil {
+			result.ID, err = storage.Create(task)
+		}
+
+		switch {
+		case err == nil:
+			result.Status = fiber.StatusCreated
+			resp.Imported++
+		case errors.Is(err, errTaskBlocked):
+			result.Status = fiber.StatusConflict
+		default:
+			result.Status = fiber.StatusUnprocessableEntity
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	return ctx.JSON(resp)
+}
+
+// WithDeadlines returns tasks with deadlines the user can view by deadline
+func (s *TaskStorageInMemory) WithDeadlines(userID int64) []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := make([]Task, 0)
+	for _, task := range s.tasks {
+		if task.Deadline != 0 && s.access(task, userID) != taskAccessNone {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return taskLess(tasks[i].Deadline, tasks[i].ID, tasks[j].Deadline, tasks[j].ID, false)
+	})
+
+	return tasks
+}
@@ -0,0 +1,122 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TaskIDGenerator returns unique positive IDs which grow in the order
+// of calls. IDs are not dense, failed creations leave gaps.
+//
+// Task IDs are int64 in paths, cursors, dependencies and calendar UIDs, so
+// 128-bit UUIDv7 and ULID don't fit them. TimeOrderedIDGenerator has the same
+// layout in 63 bits: milliseconds followed by random bits
+type TaskIDGenerator interface {
+	NextID() int64
+}
+
+// SequenceIDGenerator counts from the start ID. IDs are small and safe for
+// JSON clients which parse numbers as doubles, but unique per instance only
+type SequenceIDGenerator struct {
+	last atomic.Int64
+}
+
+func NewSequenceIDGenerator(start int64) *SequenceIDGenerator {
+	g := &SequenceIDGenerator{}
+	g.last.Store(start - 1)
+
+	return g
+}
+
+func (g *SequenceIDGenerator) NextID() int64 {
+	return g.last.Add(1)
+}
+
+// Custom epoch of time based IDs, their 41 bits of milliseconds last until 2093
+var taskIDEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	maxSnowflakeNode      = 1<<snowflakeNodeBits - 1
+	maxSnowflakeSequence  = 1<<snowflakeSequenceBits - 1
+
+	timeOrderedRandomBits = 22
+)
+
+// SnowflakeIDGenerator makes IDs of 41 bits of milliseconds since the epoch,
+// 10 bits of the node and 12 bits of the sequence within the millisecond.
+// IDs are unique across up to 1024 nodes with distinct node numbers
+type SnowflakeIDGenerator struct {
+	mu       sync.Mutex
+	node     int64
+	lastMs   int64
+	sequence int64
+	now      func() time.Time
+}
+
+func NewSnowflakeIDGenerator(node int64) (*SnowflakeIDGenerator, error) {
+	if node < 0 || node > maxSnowflakeNode {
+		return nil, fmt.Errorf("snowflake node must be between 0 and %d", maxSnowflakeNode)
+	}
+
+	return &SnowflakeIDGenerator{node: node, now: time.Now}, nil
+}
+
+func (g *SnowflakeIDGenerator) NextID() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().Sub(taskIDEpoch).Milliseconds()
+	switch {
+	// Clock went back, IDs keep growing from the last millisecond
+	case ms <= g.lastMs:
+		g.sequence++
+		if g.sequence > maxSnowflakeSequence {
+			g.lastMs++
+			g.sequence = 0
+		}
+	default:
+		g.lastMs = ms
+		g.sequence = 0
+	}
+
+	return g.lastMs<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence
+}
+
+// TimeOrderedIDGenerator makes IDs of 41 bits of milliseconds since the epoch
+// and 22 random bits, like UUIDv7 and ULID. IDs of the same millisecond grow
+// by a random step, so they are unique per instance and hard to guess, and
+// colliding between instances is unlikely
+type TimeOrderedIDGenerator struct {
+	mu     sync.Mutex
+	lastID int64
+	now    func() time.Time
+}
+
+func NewTimeOrderedIDGenerator() *TimeOrderedIDGenerator {
+	return &TimeOrderedIDGenerator{now: time.Now}
+}
+
+func (g *TimeOrderedIDGenerator) NextID() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var random [8]byte
+	// crypto/rand.Read never fails
+	_, _ = rand.Read(random[:])
+	bits := int64(binary.BigEndian.Uint64(random[:]) >> (64 - timeOrderedRandomBits))
+
+	id := g.now().Sub(taskIDEpoch).Milliseconds()<<timeOrderedRandomBits | bits
+	if id <= g.lastID {
+		// Small step keeps room for more IDs in the millisecond
+		id = g.lastID + 1 + bits&0xFF
+	}
+	g.lastID = id
+
+	return id
+}
@@ -0,0 +1,304 @@
+package webserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultTasksPageSize = 50
+	maxTasksPageSize     = 100
+)
+
+type TaskSortField string
+
+const (
+	TaskSortCreated  TaskSortField = "created"
+	TaskSortDeadline TaskSortField = "deadline"
+)
+
+// TaskFilter selects tasks the viewer can view for the list. Zero values don't filter.
+// Deadline bounds are unix seconds, DeadlineTo is exclusive, tasks
+// without a deadline never match a deadline range
+type TaskFilter struct {
+	ViewerID int64
+
+	DeadlineFrom int64
+	DeadlineTo   int64
+	// Case insensitive substring of the description
+	Query    string
+	Status   TaskStatus
+	Priority TaskPriority
+	Tag      string
+	// Tasks of the project or subtasks of the task
+	ProjectID  int64
+	ParentID   int64
+	AssigneeID int64
+
+	Sort       TaskSortField
+	Descending bool
+	Cursor     *taskCursor
+	Limit      int
+}
+
+// taskCursor is the position after the last task of the previous page
+// in the order the page was sorted by
+type taskCursor struct {
+	sort       TaskSortField
+	descending bool
+	value      int64
+	id         int64
+}
+
+var errInvalidTaskCursor = errors.New("invalid cursor")
+
+// Encoded as base64url of "sort:desc:value:id", the sort is kept
+// so a cursor can't be used with a different order
+func (c taskCursor) String() string {
+	raw := fmt.Sprintf("%s:%t:%d:%d", c.sort, c.descending, c.value, c.id)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseTaskCursor(s string) (taskCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return taskCursor{}, errInvalidTaskCursor
+	}
+
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 4 {
+		return taskCursor{}, errInvalidTaskCursor
+	}
+
+	cursor := taskCursor{sort: TaskSortField(parts[0])}
+	if cursor.descending, err = strconv.ParseBool(parts[1]); err != nil {
+		return taskCursor{}, errInvalidTaskCursor
+	}
+	if cursor.value, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return taskCursor{}, errInvalidTaskCursor
+	}
+	if cursor.id, err = strconv.ParseInt(parts[3], 10, 64); err != nil {
+		return taskCursor{}, errInvalidTaskCursor
+	}
+
+	return cursor, nil
+}
+
+// taskSortValue returns the value tasks are sorted by. Tasks without
+// a deadline go after all others in both directions
+func taskSortValue(t Task, field TaskSortField, descending bool) int64 {
+	if field == TaskSortDeadline {
+		if t.Deadline == 0 {
+			if descending {
+				return math.MinInt64
+			}
+			return math.MaxInt64
+		}
+		return t.Deadline
+	}
+
+	return t.CreatedAt
+}
+
+// taskLess compares (value, id) pairs in the sort direction
+func taskLess(value1, id1, value2, id2 int64, descending bool) bool {
+	if value1 != value2 {
+		return (value1 < value2) != descending
+	}
+
+	return (id1 < id2) != descending
+}
+
+func (f TaskFilter) matches(t Task) bool {
+	if f.DeadlineFrom != 0 || f.DeadlineTo != 0 {
+		if t.Deadline == 0 || t.Deadline < f.DeadlineFrom {
+			return false
+		}
+		if f.DeadlineTo != 0 && t.Deadline >= f.DeadlineTo {
+			return false
+		}
+	}
+
+	if f.Status != "" && t.Status != f.Status {
+		return false
+	}
+	if f.Priority != "" && t.Priority != f.Priority {
+		return false
+	}
+	if f.Tag != "" && !slices.Contains(t.Tags, f.Tag) {
+		return false
+	}
+	if f.ProjectID != 0 && t.ProjectID != f.ProjectID {
+		return false
+	}
+	if f.ParentID != 0 && t.ParentID != f.ParentID {
+		return false
+	}
+	if f.AssigneeID != 0 && t.AssigneeID != f.AssigneeID {
+		return false
+	}
+
+	if f.Query != "" && !strings.Contains(strings.ToLower(t.Description), strings.ToLower(f.Query)) {
+		return false
+	}
+
+	return true
+}
+
+func (s *TaskStorageInMemory) List(filter TaskFilter) ([]Task, *taskCursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if filter.Sort == "" {
+		filter.Sort = TaskSortCreated
+	}
+	if filter.Cursor != nil && (filter.Cursor.sort != filter.Sort || filter.Cursor.descending != filter.Descending) {
+		return nil, nil, errInvalidTaskCursor
+	}
+
+	tasks := make([]Task, 0)
+	for _, t := range s.tasks {
+		if filter.matches(t) && s.access(t, filter.ViewerID) != taskAccessNone {
+			tasks = append(tasks, t)
+		}
+	}
+
+	value := func(t Task) int64 { return taskSortValue(t, filter.Sort, filter.Descending) }
+	sort.Slice(tasks, func(i, j int) bool {
+		return taskLess(value(tasks[i]), tasks[i].ID, value(tasks[j]), tasks[j].ID, filter.Descending)
+	})
+
+	if filter.Cursor != nil {
+		start := sort.Search(len(tasks), func(i int) bool {
+			return taskLess(filter.Cursor.value, filter.Cursor.id, value(tasks[i]), tasks[i].ID, filter.Descending)
+		})
+		tasks = tasks[start:]
+	}
+
+	if filter.Limit <= 0 || len(tasks) <= filter.Limit {
+		return tasks, nil, nil
+	}
+
+	tasks = tasks[:filter.Limit]
+	last := tasks[len(tasks)-1]
+	next := &taskCursor{
+		sort:       filter.Sort,
+		descending: filter.Descending,
+		value:      value(last),
+		id:         last.ID,
+	}
+
+	return tasks, next, nil
+}
+
+// parseTaskFilter reads the filter from query params: deadline_from,
+// deadline_to, q, status, priority, tag, project_id, parent_id, assignee_id,
+// sort (created, deadline, -created, -deadline), limit and cursor
+func parseTaskFilter(ctx *fiber.Ctx) (TaskFilter, error) {
+	filter := TaskFilter{
+		Query:    ctx.Query("q"),
+		Status:   TaskStatus(ctx.Query("status")),
+		Priority: TaskPriority(ctx.Query("priority")),
+		Tag:      strings.ToLower(strings.TrimSpace(ctx.Query("tag"))),
+		Limit:    ctx.QueryInt("limit", defaultTasksPageSize),
+	}
+	var err error
+	if filter.ProjectID, err = queryTaskID(ctx, "project_id"); err != nil {
+		return TaskFilter{}, err
+	}
+	if filter.ParentID, err = queryTaskID(ctx, "parent_id"); err != nil {
+		return TaskFilter{}, err
+	}
+	if filter.AssigneeID, err = queryTaskID(ctx, "assignee_id"); err != nil {
+		return TaskFilter{}, err
+	}
+	filter.ViewerID, _ = authUserID(ctx)
+	if filter.Limit < 1 || filter.Limit > maxTasksPageSize {
+		return TaskFilter{}, fmt.Errorf("limit must be between 1 and %d", maxTasksPageSize)
+	}
+	if filter.Status != "" && !filter.Status.valid() {
+		return TaskFilter{}, errTaskStatus
+	}
+	if filter.Priority != "" && !filter.Priority.valid() {
+		return TaskFilter{}, errTaskPriority
+	}
+
+	if deadlineFrom := ctx.Query("deadline_from"); deadlineFrom != "" {
+		if filter.DeadlineFrom, err = strconv.ParseInt(deadlineFrom, 10, 64); err != nil {
+			return TaskFilter{}, errors.New("deadline_from must be a unix time")
+		}
+	}
+	if deadlineTo := ctx.Query("deadline_to"); deadlineTo != "" {
+		if filter.DeadlineTo, err = strconv.ParseInt(deadlineTo, 10, 64); err != nil {
+			return TaskFilter{}, errors.New("deadline_to must be a unix time")
+		}
+	}
+
+	sortParam := ctx.Query("sort", string(TaskSortCreated))
+	sortField, descending := strings.CutPrefix(sortParam, "-")
+	filter.Sort = TaskSortField(sortField)
+	filter.Descending = descending
+	switch filter.Sort {
+	case TaskSortCreated, TaskSortDeadline:
+	default:
+		return TaskFilter{}, errors.New("sort must be created or deadline, optionally prefixed with '-'")
+	}
+
+	if cursorParam := ctx.Query("cursor"); cursorParam != "" {
+		cursor, err := parseTaskCursor(cursorParam)
+		if err != nil {
+			return TaskFilter{}, err
+		}
+		filter.Cursor = &cursor
+	}
+
+	return filter, nil
+}
+
+// queryTaskID parses the ID filter param, zero when it's not set means no filter.
+// Invalid values are errors rather than no filter
+func queryTaskID(ctx *fiber.Ctx, name string) (int64, error) {
+	value := ctx.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+
+	return id, nil
+}
+
+// setTaskListLinks sets the Link header with the first and the next pages,
+// they keep all query params of the request except the cursor
+func setTaskListLinks(ctx *fiber.Ctx, next *taskCursor) {
+	query, err := url.ParseQuery(string(ctx.Request().URI().QueryString()))
+	if err != nil {
+		return
+	}
+	pageURL := func(cursor string) string {
+		query.Del("cursor")
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		return ctx.BaseURL() + ctx.Path() + "?" + query.Encode()
+	}
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(""))}
+	if next != nil {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(next.String())))
+	}
+	ctx.Set(fiber.HeaderLink, strings.Join(links, ", "))
+}
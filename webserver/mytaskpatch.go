@@ -0,0 +1,76 @@
+package webserver
+
+import (
+	"errors"
+
+	"github.com/ermakovov/learn-golang/jsonpatch"
+	"github.com/gofiber/fiber/v2"
+)
+
+// taskDocument is the part of the task that patch documents change,
+// zero members like a missing deadline or parent are omitted
+type taskDocument struct {
+	Description string       `json:"description"`
+	Deadline    int64        `json:"deadline,omitempty"`
+	Status      TaskStatus   `json:"status"`
+	Priority    TaskPriority `json:"priority"`
+	Tags        []string     `json:"tags"`
+	Recurrence  string       `json:"recurrence,omitempty"`
+	ProjectID   int64        `json:"project_id,omitempty"`
+	ParentID    int64        `json:"parent_id,omitempty"`
+	BlockedBy   []int64      `json:"blocked_by,omitempty"`
+}
+
+func newTaskDocument(task Task) taskDocument {
+	return taskDocument{
+		Description: task.Description,
+		Deadline:    task.Deadline,
+		Status:      task.Status,
+		Priority:    task.Priority,
+		Tags:        task.Tags,
+		Recurrence:  task.Recurrence,
+		ProjectID:   task.ProjectID,
+		ParentID:    task.ParentID,
+		BlockedBy:   task.BlockedBy,
+	}
+}
+
+func (d taskDocument) apply(task Task) Task {
+	task.Description = d.Description
+	task.Deadline = d.Deadline
+	task.Status = d.Status
+	task.Priority = d.Priority
+	task.Tags = d.Tags
+	task.Recurrence = d.Recurrence
+	task.ProjectID = d.ProjectID
+	task.ParentID = d.ParentID
+	task.BlockedBy = d.BlockedBy
+
+	return task
+}
+
+// patchTask applies a merge patch or a JSON patch from the request body
+func patchTask(storage *TaskStorageInMemory, id int64, actorID int64, check func(task Task) error, mediaType string, patch []byte) (Task, error) {
+	return storage.UpdateWith(id, actorID, check, func(task Task) (Task, error) {
+		doc := newTaskDocument(task)
+		if err := jsonpatch.ApplyTo(mediaType, patch, &doc); err != nil {
+			return Task{}, err
+		}
+
+		return doc.apply(task), nil
+	})
+}
+
+// patchErrorStatus maps errors of patch documents to response statuses
+func patchErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, jsonpatch.ErrInvalidPatch):
+		return fiber.StatusBadRequest, true
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		return fiber.StatusConflict, true
+	case errors.Is(err, jsonpatch.ErrPathNotFound), errors.Is(err, jsonpatch.ErrInvalidResult):
+		return fiber.StatusUnprocessableEntity, true
+	default:
+		return 0, false
+	}
+}
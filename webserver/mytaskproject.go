@@ -0,0 +1,325 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxProjectNameLength = 100
+	maxTaskBlockers      = 50
+)
+
+var (
+	errProjectNotFound     = errors.New("project not found")
+	errProjectForbidden    = errors.New("project belongs to another user")
+	errProjectName         = fmt.Errorf("project name must be 1-%d characters long", maxProjectNameLength)
+	errTaskParent          = errors.New("parent task not found")
+	errTaskParentCycle     = errors.New("task can't be a subtask of itself or of its subtasks")
+	errTaskBlocker         = errors.New("blocking task not found")
+	errTaskBlockers        = fmt.Errorf("task can be blocked by at most %d tasks", maxTaskBlockers)
+	errTaskDependencyCycle = errors.New("blocking dependencies form a cycle")
+	errTaskBlocked         = errors.New("task has open blockers or subtasks")
+)
+
+// Project groups tasks of its owner into a list, tasks without a project
+// have ProjectID 0
+type Project struct {
+	ID        int64
+	OwnerID   int64
+	Name      string
+	CreatedAt int64
+}
+
+type (
+	CreateProjectRequest struct {
+		Name string `json:"name"`
+	}
+
+	CreateProjectResponse struct {
+		ID int64 `json:"id"`
+	}
+
+	ProjectResponse struct {
+		Project
+		OpenTasks int `json:"open_tasks"`
+	}
+
+	ListProjectsResponse struct {
+		Projects []ProjectResponse `json:"projects"`
+	}
+
+	// TaskTree is the task with its subtasks, recursively
+	TaskTree struct {
+		Task
+		Subtasks []TaskTree `json:"subtasks"`
+	}
+)
+
+func (s *TaskStorageInMemory) CreateProject(name string, ownerID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxProjectNameLength {
+		return 0, errProjectName
+	}
+
+	project := Project{ID: s.projectIDs.NextID(), OwnerID: ownerID, Name: name, CreatedAt: time.Now().Unix()}
+	s.projects[project.ID] = project
+
+	return project.ID, nil
+}
+
+// ListProjects returns projects of the owner by ID with numbers of their open tasks
+func (s *TaskStorageInMemory) ListProjects(ownerID int64) []ProjectResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	openTasks := make(map[int64]int)
+	for _, task := range s.tasks {
+		if task.Status != TaskStatusDone {
+			openTasks[task.ProjectID]++
+		}
+	}
+
+	projects := make([]ProjectResponse, 0, len(s.projects))
+	for _, project := range s.projects {
+		if project.OwnerID != ownerID {
+			continue
+		}
+		projects = append(projects, ProjectResponse{Project: project, OpenTasks: openTasks[project.ID]})
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].ID < projects[j].ID })
+
+	return projects
+}
+
+// DeleteProject removes the project, its tasks are left without a project
+func (s *TaskStorageInMemory) DeleteProject(id int64, ownerID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	project, ok := s.projects[id]
+	if !ok {
+		return errProjectNotFound
+	}
+	if project.OwnerID != ownerID {
+		return errProjectForbidden
+	}
+	delete(s.projects, id)
+
+	now := time.Now().Unix()
+	for _, task := range s.tasks {
+		if task.ProjectID == id {
+			task.ProjectID = 0
+			task.UpdatedAt = now
+			task.Version++
+			s.put(TaskActionUpdated, ownerID, task)
+		}
+	}
+
+	return nil
+}
+
+// checkRelations checks the project, the parent and the blockers of the task
+// against the storage and sorts the blockers. The owner of the task must own
+// the project, be able to edit the parent and to view the blockers, others
+// look missing. Must be called with s.mu held
+func (s *TaskStorageInMemory) checkRelations(t *Task) error {
+	if t.ProjectID != 0 {
+		if project, ok := s.projects[t.ProjectID]; !ok || project.OwnerID != t.OwnerID {
+			return errProjectNotFound
+		}
+	}
+
+	for id := t.ParentID; id != 0; id = s.tasks[id].ParentID {
+		if id == t.ID {
+			return errTaskParentCycle
+		}
+		if _, ok := s.tasks[id]; !ok {
+			return errTaskParent
+		}
+	}
+	if parent, ok := s.tasks[t.ParentID]; ok {
+		switch s.access(parent, t.OwnerID) {
+		case taskAccessNone:
+			return errTaskParent
+		case taskAccessView:
+			return errTaskReadOnly
+		}
+	}
+
+	blockers := slices.Clone(t.BlockedBy)
+	slices.Sort(blockers)
+	blockers = slices.Compact(blockers)
+	if len(blockers) > maxTaskBlockers {
+		return errTaskBlockers
+	}
+	for _, id := range blockers {
+		if blocker, ok := s.tasks[id]; id != t.ID && (!ok || s.access(blocker, t.OwnerID) == taskAccessNone) {
+			return errTaskBlocker
+		}
+	}
+	t.BlockedBy = blockers
+
+	// The task is in a cycle if it's reachable from its own blockers
+	visited := make(map[int64]bool)
+	stack := slices.Clone(blockers)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == t.ID {
+			return errTaskDependencyCycle
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		stack = append(stack, s.tasks[id].BlockedBy...)
+	}
+
+	return nil
+}
+
+func taskRelationError(err error) bool {
+	return errors.Is(err, errProjectNotFound) || errors.Is(err, errTaskParent) ||
+		errors.Is(err, errTaskParentCycle) || errors.Is(err, errTaskBlocker) ||
+		errors.Is(err, errTaskBlockers) || errors.Is(err, errTaskDependencyCycle)
+}
+
+// openBlockers returns IDs of open tasks blocking the task and of its open
+// subtasks, the task can't be done until there are none. Must be called with s.mu held
+func (s *TaskStorageInMemory) openBlockers(t Task) []int64 {
+	var open []int64
+	for _, id := range t.BlockedBy {
+		if blocker, ok := s.tasks[id]; ok && blocker.Status != TaskStatusDone {
+			open = append(open, id)
+		}
+	}
+	for _, task := range s.tasks {
+		if task.ParentID == t.ID && task.Status != TaskStatusDone {
+			open = append(open, task.ID)
+		}
+	}
+	slices.Sort(open)
+
+	return slices.Compact(open)
+}
+
+// checkNotBlocked returns errTaskBlocked with IDs of open blockers.
+// Must be called with s.mu held
+func (s *TaskStorageInMemory) checkNotBlocked(t Task) error {
+	if open := s.openBlockers(t); len(open) > 0 {
+		return fmt.Errorf("%w: %v", errTaskBlocked, open)
+	}
+
+	return nil
+}
+
+// touchAncestors bumps versions of the ancestors of a changed task,
+// since their subtrees are part of them. Must be called with s.mu held
+func (s *TaskStorageInMemory) touchAncestors(parentID int64) {
+	for id := parentID; id != 0; {
+		task, ok := s.tasks[id]
+		if !ok {
+			return
+		}
+		task.Version++
+		s.tasks[id] = task
+		id = task.ParentID
+	}
+}
+
+// subtasks returns IDs of children of every task. Must be called with s.mu held
+func (s *TaskStorageInMemory) subtasks() map[int64][]int64 {
+	children := make(map[int64][]int64)
+	for _, task := range s.tasks {
+		if task.ParentID != 0 {
+			children[task.ParentID] = append(children[task.ParentID], task.ID)
+		}
+	}
+	for _, ids := range children {
+		slices.Sort(ids)
+	}
+
+	return children
+}
+
+// ReadTree returns the task with all its subtasks if check passes
+func (s *TaskStorageInMemory) ReadTree(id int64, check func(task Task) error) (TaskTree, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return TaskTree{}, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return TaskTree{}, err
+	}
+
+	children := s.subtasks()
+	var build func(id int64) TaskTree
+	build = func(id int64) TaskTree {
+		tree := TaskTree{Task: s.tasks[id], Subtasks: make([]TaskTree, 0, len(children[id]))}
+		for _, child := range children[id] {
+			tree.Subtasks = append(tree.Subtasks, build(child))
+		}
+		return tree
+	}
+
+	return build(id), nil
+}
+
+// deleteTree removes the task with its subtasks and drops them from blockers
+// of other tasks. It returns the removed tasks with subtasks after their
+// parents and the dropped blockers by IDs of tasks they blocked.
+// Must be called with s.mu held
+func (s *TaskStorageInMemory) deleteTree(id int64, actorID int64, now int64) ([]Task, map[int64][]int64) {
+	children := s.subtasks()
+	deleted := make(map[int64]bool)
+	var tasks []Task
+	var collect func(id int64)
+	collect = func(id int64) {
+		deleted[id] = true
+		tasks = append(tasks, s.tasks[id])
+		for _, child := range children[id] {
+			collect(child)
+		}
+	}
+	collect(id)
+
+	// Deletions are recorded while ancestors are still there to find
+	// who can view the tasks
+	for i, task := range tasks {
+		tasks[i].Version++
+		tasks[i].UpdatedAt = now
+		s.record(TaskActionDeleted, actorID, task, tasks[i])
+	}
+	s.touchAncestors(s.tasks[id].ParentID)
+	for id := range deleted {
+		delete(s.tasks, id)
+	}
+
+	blocked := make(map[int64][]int64)
+	for _, task := range s.tasks {
+		blockers := slices.DeleteFunc(slices.Clone(task.BlockedBy), func(id int64) bool { return deleted[id] })
+		if len(blockers) != len(task.BlockedBy) {
+			for _, blocker := range task.BlockedBy {
+				if deleted[blocker] {
+					blocked[task.ID] = append(blocked[task.ID], blocker)
+				}
+			}
+			task.BlockedBy = blockers
+			task.Version++
+			s.put(TaskActionUpdated, actorID, task)
+		}
+	}
+
+	return tasks, blocked
+}
@@ -0,0 +1,543 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Recurring tasks carry an iCalendar RRULE (RFC 5545) with a subset of parts:
+// FREQ (DAILY, WEEKLY, MONTHLY), INTERVAL, BYDAY, COUNT, UNTIL and WKST.
+// The deadline of the first task of the series is DTSTART and counts as the
+// first occurrence. Times are in UTC
+
+const (
+	RecurrenceDaily   = "DAILY"
+	RecurrenceWeekly  = "WEEKLY"
+	RecurrenceMonthly = "MONTHLY"
+
+	// Periods scanned without an occurrence before the rule is considered
+	// exhausted, for rules like the 5th Monday which are rare
+	maxRecurrenceEmptyPeriods = 1000
+	// Calendars repeat every 400 years, which is 4800 months
+	recurrenceMonthlyCycle = 4800
+	// Occurrences are expanded up to the end of 9999, as in iCalendar
+	maxRecurrenceTime = 253402300799
+
+	maxOccurrencesWindow = 366 * 24 * time.Hour
+	maxOccurrences       = 1000
+)
+
+var (
+	errTaskRecurrence         = errors.New("invalid recurrence rule")
+	errTaskRecurrenceDeadline = errors.New("recurring task must have a deadline before year 10000")
+)
+
+type RecurrenceRule struct {
+	Freq     string
+	Interval int
+	ByDay    []recurrenceDay
+	// Zero values mean no limit
+	Count int
+	Until time.Time
+	// First day of the week for weekly rules
+	WeekStart time.Weekday
+}
+
+// recurrenceDay is a BYDAY entry like MO or -1FR. Ordinal is the number of
+// the weekday in the month, negative from the end, zero for every one
+type recurrenceDay struct {
+	Ordinal int
+	Weekday time.Weekday
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// ParseRecurrenceRule parses the value of RRULE, with or without the "RRULE:" prefix
+func ParseRecurrenceRule(s string) (RecurrenceRule, error) {
+	rule := RecurrenceRule{Interval: 1, WeekStart: time.Monday}
+	invalid := func(format string, args ...any) (RecurrenceRule, error) {
+		return RecurrenceRule{}, fmt.Errorf("%w: %s", errTaskRecurrence, fmt.Sprintf(format, args...))
+	}
+
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return invalid("part %q must be NAME=VALUE", part)
+		}
+		if seen[name] {
+			return invalid("%s is repeated", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			switch value {
+			case RecurrenceDaily, RecurrenceWeekly, RecurrenceMonthly:
+				rule.Freq = value
+			default:
+				return invalid("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+		case "INTERVAL":
+			if rule.Interval, err = strconv.Atoi(value); err != nil || rule.Interval < 1 {
+				return invalid("INTERVAL must be a positive number")
+			}
+		case "COUNT":
+			if rule.Count, err = strconv.Atoi(value); err != nil || rule.Count < 1 {
+				return invalid("COUNT must be a positive number")
+			}
+		case "UNTIL":
+			if rule.Until, err = parseRecurrenceUntil(value); err != nil {
+				return invalid("UNTIL must be a date or a UTC date-time")
+			}
+		case "WKST":
+			weekday, ok := weekdayCodes[value]
+			if !ok {
+				return invalid("unknown WKST %q", value)
+			}
+			rule.WeekStart = weekday
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				parsed, err := parseRecurrenceDay(day)
+				if err != nil {
+					return invalid("%s", err)
+				}
+				rule.ByDay = append(rule.ByDay, parsed)
+			}
+		default:
+			return invalid("%s is not supported", name)
+		}
+	}
+
+	if rule.Freq == "" {
+		return invalid("FREQ is required")
+	}
+	if rule.Count != 0 && !rule.Until.IsZero() {
+		return invalid("COUNT and UNTIL can't be used together")
+	}
+	if rule.Freq != RecurrenceMonthly {
+		for _, day := range rule.ByDay {
+			if day.Ordinal != 0 {
+				return invalid("BYDAY ordinals are allowed only in MONTHLY rules")
+			}
+		}
+	}
+
+	return rule, nil
+}
+
+// String formats the rule as the value of RRULE
+func (r RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, 0, len(r.ByDay))
+		for _, day := range r.ByDay {
+			code := strings.ToUpper(day.Weekday.String()[:2])
+			if day.Ordinal != 0 {
+				code = strconv.Itoa(day.Ordinal) + code
+			}
+			days = append(days, code)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count != 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+strings.ToUpper(r.WeekStart.String()[:2]))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+func parseRecurrenceUntil(value string) (time.Time, error) {
+	if until, err := time.Parse("20060102T150405Z", value); err == nil {
+		return until, nil
+	}
+
+	// Date only UNTIL includes the whole day
+	until, err := time.Parse("20060102", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return until.Add(24*time.Hour - time.Second), nil
+}
+
+func parseRecurrenceDay(value string) (recurrenceDay, error) {
+	if len(value) < 2 {
+		return recurrenceDay{}, fmt.Errorf("invalid BYDAY %q", value)
+	}
+
+	weekday, ok := weekdayCodes[value[len(value)-2:]]
+	if !ok {
+		return recurrenceDay{}, fmt.Errorf("invalid BYDAY %q", value)
+	}
+
+	day := recurrenceDay{Weekday: weekday}
+	if ordinal := value[:len(value)-2]; ordinal != "" {
+		n, err := strconv.Atoi(ordinal)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return recurrenceDay{}, fmt.Errorf("invalid BYDAY %q", value)
+		}
+		day.Ordinal = n
+	}
+
+	return day, nil
+}
+
+// Occurrences calls yield with 1-based indexes and times of occurrences
+// starting from start in order, until yield returns false or the rule ends.
+// Periods which end before after are skipped without calling yield, a few
+// occurrences before after may still be yielded. UNTIL before start still
+// leaves start as the only occurrence
+func (r RecurrenceRule) Occurrences(start, after time.Time, yield func(index int, at time.Time) bool) {
+	start = start.UTC()
+	// DTSTART is the first occurrence even if the rule doesn't match it
+	if !yield(1, start) || r.Count == 1 {
+		return
+	}
+	index := 1
+	emptyPeriods := 0
+
+	for period := 0; emptyPeriods < maxRecurrenceEmptyPeriods; period += r.Interval {
+		found := false
+		for _, at := range r.periodOccurrences(start, period) {
+			if !at.After(start) {
+				continue
+			}
+			if !r.Until.IsZero() && at.After(r.Until) {
+				return
+			}
+
+			found = true
+			index++
+			if !yield(index, at) || (r.Count != 0 && index >= r.Count) {
+				return
+			}
+		}
+
+		if found {
+			emptyPeriods = 0
+		} else {
+			emptyPeriods++
+		}
+
+		if period == 0 {
+			var ok bool
+			if period, index, ok = r.skip(start, after, index); !ok {
+				return
+			}
+		}
+	}
+}
+
+// skip returns the last period before which all occurrences are before
+// after, and the index of the last occurrence before it. Periods are skipped
+// in whole cycles after which days of the week repeat, occurrences of one
+// cycle are counted and multiplied. False means the rule ends before after
+func (r RecurrenceRule) skip(start, after time.Time, index int) (int, int, bool) {
+	var units int64
+	switch r.Freq {
+	case RecurrenceDaily:
+		units = (after.Unix() - start.Unix()) / (24 * 60 * 60)
+	case RecurrenceWeekly:
+		units = (after.Unix() - start.Unix()) / (7 * 24 * 60 * 60)
+	default:
+		units = int64(after.Year()-start.Year())*12 + int64(after.Month()-start.Month())
+	}
+	// Occurrences of the period before the one of after may be after it
+	periods := int(units/int64(r.Interval)) - 1
+
+	cycle := 1
+	switch {
+	case r.Freq == RecurrenceMonthly:
+		cycle = recurrenceMonthlyCycle
+	case r.Freq == RecurrenceDaily && len(r.ByDay) > 0:
+		cycle = 7
+	}
+	// Cycles start after the first period, which may miss days before start
+	cycles := (periods - 1) / cycle
+	if periods < 1 || cycles < 1 {
+		return 0, index, true
+	}
+
+	perCycle := 0
+	for i := 1; i <= cycle; i++ {
+		perCycle += len(r.periodOccurrences(start, i*r.Interval))
+	}
+	if perCycle == 0 {
+		return 0, index, false
+	}
+	index += cycles * perCycle
+	if r.Count != 0 && index >= r.Count {
+		return 0, index, false
+	}
+
+	return cycles * cycle * r.Interval, index, true
+}
+
+// periodOccurrences returns sorted candidates in the day, week or month
+// which is period units after the one of start, at the time of day of start
+func (r RecurrenceRule) periodOccurrences(start time.Time, period int) []time.Time {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+	}
+
+	switch r.Freq {
+	case RecurrenceDaily:
+		day := start.AddDate(0, 0, period)
+		if len(r.ByDay) > 0 && !r.matchesWeekday(day.Weekday()) {
+			return nil
+		}
+		return []time.Time{day}
+
+	case RecurrenceWeekly:
+		offset := (int(start.Weekday()) - int(r.WeekStart) + 7) % 7
+		weekStart := start.AddDate(0, 0, period*7-offset)
+		var days []time.Time
+		for i := 0; i < 7; i++ {
+			day := weekStart.AddDate(0, 0, i)
+			if (len(r.ByDay) == 0 && day.Weekday() == start.Weekday()) || r.matchesWeekday(day.Weekday()) {
+				days = append(days, day)
+			}
+		}
+		return days
+
+	default:
+		year, month := start.Year(), start.Month()+time.Month(period)
+		// Normalized by time.Date, the 1st of the month always exists
+		first := at(year, month, 1)
+		year, month = first.Year(), first.Month()
+		daysInMonth := first.AddDate(0, 1, -1).Day()
+
+		if len(r.ByDay) == 0 {
+			// Months without the day, like the 31st, are skipped
+			if start.Day() > daysInMonth {
+				return nil
+			}
+			return []time.Time{at(year, month, start.Day())}
+		}
+
+		var days []time.Time
+		for day := 1; day <= daysInMonth; day++ {
+			date := at(year, month, day)
+			fromStart := (day-1)/7 + 1
+			fromEnd := -((daysInMonth-day)/7 + 1)
+			for _, byDay := range r.ByDay {
+				if byDay.Weekday == date.Weekday() &&
+					(byDay.Ordinal == 0 || byDay.Ordinal == fromStart || byDay.Ordinal == fromEnd) {
+					days = append(days, date)
+					break
+				}
+			}
+		}
+		return days
+	}
+}
+
+func (r RecurrenceRule) matchesWeekday(weekday time.Weekday) bool {
+	for _, day := range r.ByDay {
+		if day.Weekday == weekday {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRecurrence checks the rule of the task and normalizes it
+func (t *Task) validateRecurrence() error {
+	if t.Recurrence == "" {
+		return nil
+	}
+	if t.Deadline <= 0 || t.Deadline > maxRecurrenceTime {
+		return errTaskRecurrenceDeadline
+	}
+
+	if _, err := ParseRecurrenceRule(t.Recurrence); err != nil {
+		return err
+	}
+	t.Recurrence = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(t.Recurrence)), "RRULE:")
+
+	return nil
+}
+
+// nextOccurrence returns the occurrence of the series after the task,
+// false if the series has ended
+func (t Task) nextOccurrence() (int, int64, bool) {
+	rule, err := ParseRecurrenceRule(t.Recurrence)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var (
+		nextIndex int
+		nextAt    int64
+	)
+	rule.Occurrences(time.Unix(t.SeriesStart, 0), time.Unix(t.Deadline, 0), func(index int, at time.Time) bool {
+		if at.Unix() <= t.Deadline {
+			return true
+		}
+		nextIndex, nextAt = index, at.Unix()
+		return false
+	})
+
+	return nextIndex, nextAt, nextIndex != 0
+}
+
+// spawnNextOccurrence creates the next task of the series when an
+// occurrence is done. Each occurrence spawns the next one only once.
+// Must be called with s.mu held
+func (s *TaskStorageInMemory) spawnNextOccurrence(task *Task, actorID int64, now int64) {
+	if task.Recurrence == "" || task.NextOccurrenceID != 0 {
+		return
+	}
+
+	index, at, ok := task.nextOccurrence()
+	if !ok {
+		return
+	}
+
+	next := Task{
+		ID:          s.ids.NextID(),
+		Description: task.Description,
+		Deadline:    at,
+		Status:      TaskStatusTodo,
+		Priority:    task.Priority,
+		Tags:        task.Tags,
+		OwnerID:     task.OwnerID,
+		AssigneeID:  task.AssigneeID,
+		Shares:      task.Shares,
+		ProjectID:   task.ProjectID,
+		ParentID:    task.ParentID,
+		Recurrence:  task.Recurrence,
+		SeriesStart: task.SeriesStart,
+		Occurrence:  index,
+		Version:     1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	s.put(TaskActionCreated, actorID, next)
+	s.touchAncestors(next.ParentID)
+
+	task.NextOccurrenceID = next.ID
+}
+
+type TaskOccurrence struct {
+	TaskID      int64  `json:"task_id"`
+	Description string `json:"description"`
+	// Unix time
+	At         int64 `json:"at"`
+	Occurrence int   `json:"occurrence,omitempty"`
+}
+
+// Occurrences returns deadlines of open tasks the user can view in [from, to),
+// recurring tasks are expanded into their future occurrences. At most limit
+// occurrences are returned, the earliest first
+func (s *TaskStorageInMemory) Occurrences(from, to int64, limit int, userID int64) []TaskOccurrence {
+	// Series are expanded without the lock
+	s.mu.Lock()
+	tasks := make([]Task, 0)
+	for _, task := range s.tasks {
+		if task.Status != TaskStatusDone && task.Deadline != 0 && s.access(task, userID) != taskAccessNone {
+			tasks = append(tasks, task)
+		}
+	}
+	s.mu.Unlock()
+
+	occurrences := make([]TaskOccurrence, 0)
+
+	for _, task := range tasks {
+		if task.Recurrence == "" {
+			if task.Deadline >= from && task.Deadline < to {
+				occurrences = append(occurrences, TaskOccurrence{
+					TaskID: task.ID, Description: task.Description, At: task.Deadline,
+				})
+			}
+			continue
+		}
+
+		rule, err := ParseRecurrenceRule(task.Recurrence)
+		if err != nil {
+			continue
+		}
+		found := 0
+		after := time.Unix(max(from, task.Deadline), 0)
+		rule.Occurrences(time.Unix(task.SeriesStart, 0), after, func(index int, at time.Time) bool {
+			unix := at.Unix()
+			if unix >= to || found >= limit {
+				return false
+			}
+			// Earlier occurrences are done already
+			if unix < task.Deadline || unix < from {
+				return true
+			}
+
+			occurrences = append(occurrences, TaskOccurrence{
+				TaskID: task.ID, Description: task.Description, At: unix, Occurrence: index,
+			})
+			found++
+			return true
+		})
+	}
+
+	sort.Slice(occurrences, func(i, j int) bool {
+		if occurrences[i].At != occurrences[j].At {
+			return occurrences[i].At < occurrences[j].At
+		}
+		if occurrences[i].TaskID != occurrences[j].TaskID {
+			return occurrences[i].TaskID < occurrences[j].TaskID
+		}
+		return occurrences[i].Occurrence < occurrences[j].Occurrence
+	})
+	if len(occurrences) > limit {
+		occurrences = occurrences[:limit]
+	}
+
+	return occurrences
+}
+
+type ListOccurrencesResponse struct {
+	Occurrences []TaskOccurrence `json:"occurrences"`
+}
+
+// listOccurrences handles GET /tasks/occurrences?from=&to= with unix times
+// up to the end of 9999, the window is limited to a year
+func listOccurrences(ctx *fiber.Ctx, storage *TaskStorageInMemory) error {
+	from, err := strconv.ParseInt(ctx.Query("from"), 10, 64)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("from must be a unix time")
+	}
+	to, err := strconv.ParseInt(ctx.Query("to"), 10, 64)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("to must be a unix time")
+	}
+	if from < 0 || to > maxRecurrenceTime {
+		return ctx.Status(fiber.StatusBadRequest).SendString("from and to must be between 1970 and 9999")
+	}
+	if to <= from || to-from > int64(maxOccurrencesWindow/time.Second) {
+		return ctx.Status(fiber.StatusBadRequest).SendString("to must be after from and at most a year later")
+	}
+
+	userID, _ := authUserID(ctx)
+
+	return ctx.JSON(ListOccurrencesResponse{Occurrences: storage.Occurrences(from, to, maxOccurrences, userID)})
+}
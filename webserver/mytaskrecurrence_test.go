@@ -0,0 +1,170 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testOccurrence struct {
+	index int
+	at    time.Time
+}
+
+func (o testOccurrence) String() string {
+	return fmt.Sprintf("#%d %s", o.index, o.at.Format(time.RFC3339))
+}
+
+// expand returns up to limit occurrences of the rule at or after after.
+// With skip Occurrences may skip periods before after, otherwise every
+// period is walked
+func expand(t *testing.T, rrule string, start, after time.Time, limit int, skip bool) []testOccurrence {
+	t.Helper()
+
+	rule, err := ParseRecurrenceRule(rrule)
+	if err != nil {
+		t.Fatalf("parse %q: %v", rrule, err)
+	}
+
+	skipBefore := start
+	if skip {
+		skipBefore = after
+	}
+	var occurrences []testOccurrence
+	rule.Occurrences(start, skipBefore, func(index int, at time.Time) bool {
+		if !at.Before(after) {
+			occurrences = append(occurrences, testOccurrence{index: index, at: at})
+		}
+		return len(occurrences) < limit
+	})
+
+	return occurrences
+}
+
+// checkSkip compares occurrences with and without skipping
+func checkSkip(t *testing.T, rrule string, start, after time.Time) []testOccurrence {
+	t.Helper()
+
+	got := expand(t, rrule, start, after, 10, true)
+	want := expand(t, rrule, start, after, 10, false)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	return got
+}
+
+func checkOccurrences(t *testing.T, got []testOccurrence, want []time.Time) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].at.Equal(want[i]) || got[i].index != i+1 {
+			t.Fatalf("occurrence %d: got %v, want #%d %s", i, got[i], i+1, want[i].Format(time.RFC3339))
+		}
+	}
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 10, 0, 0, 0, time.UTC)
+}
+
+func TestRecurrenceMonthlyByDayOrdinals(t *testing.T) {
+	// Second Tuesday and last Friday of every month
+	got := expand(t, "FREQ=MONTHLY;BYDAY=2TU,-1FR", date(2024, 1, 9), date(2024, 1, 9), 8, true)
+	checkOccurrences(t, got, []time.Time{
+		date(2024, 1, 9), date(2024, 1, 26), date(2024, 2, 13), date(2024, 2, 23),
+		date(2024, 3, 12), date(2024, 3, 29), date(2024, 4, 9), date(2024, 4, 26),
+	})
+
+	// Months without a fifth Monday are skipped
+	got = expand(t, "FREQ=MONTHLY;BYDAY=5MO", date(2024, 1, 29), date(2024, 1, 29), 6, true)
+	checkOccurrences(t, got, []time.Time{
+		date(2024, 1, 29), date(2024, 4, 29), date(2024, 7, 29),
+		date(2024, 9, 30), date(2024, 12, 30), date(2025, 3, 31),
+	})
+}
+
+// BYMONTHDAY is not supported, monthly rules repeat the day of DTSTART.
+// Months without the day are skipped rather than clamped
+func TestRecurrenceMonthlyDay31(t *testing.T) {
+	got := expand(t, "FREQ=MONTHLY", date(2024, 1, 31), date(2024, 1, 31), 8, true)
+	checkOccurrences(t, got, []time.Time{
+		date(2024, 1, 31), date(2024, 3, 31), date(2024, 5, 31), date(2024, 7, 31),
+		date(2024, 8, 31), date(2024, 10, 31), date(2024, 12, 31), date(2025, 1, 31),
+	})
+
+	got = expand(t, "FREQ=MONTHLY;INTERVAL=2", date(2024, 1, 31), date(2024, 1, 31), 5, true)
+	checkOccurrences(t, got, []time.Time{
+		date(2024, 1, 31), date(2024, 3, 31), date(2024, 5, 31), date(2024, 7, 31), date(2025, 1, 31),
+	})
+
+	if _, err := ParseRecurrenceRule("FREQ=MONTHLY;BYMONTHDAY=31"); !errors.Is(err, errTaskRecurrence) {
+		t.Fatalf("got %v, want %v", err, errTaskRecurrence)
+	}
+}
+
+// Skipping whole cycles must give the same occurrences and indexes
+// as walking every period
+func TestRecurrenceSkipMatchesWalk(t *testing.T) {
+	start := date(2024, 1, 31)
+	rules := []string{
+		"FREQ=DAILY",
+		"FREQ=DAILY;INTERVAL=3;BYDAY=MO,WE",
+		"FREQ=WEEKLY;INTERVAL=3;BYDAY=TU,SA;WKST=SU",
+		"FREQ=MONTHLY",
+		"FREQ=MONTHLY;BYDAY=-1FR,1MO",
+		"FREQ=MONTHLY;INTERVAL=5;BYDAY=5MO",
+	}
+	afters := []time.Time{
+		start.Add(time.Hour),
+		start.AddDate(0, 0, 9),
+		start.AddDate(3, 2, 1),
+		// Past a 400-year cycle of monthly rules
+		start.AddDate(401, 0, 0),
+		start.AddDate(823, 7, 13),
+	}
+
+	for _, rrule := range rules {
+		for _, after := range afters {
+			t.Run(rrule+"/"+after.Format("2006-01-02"), func(t *testing.T) {
+				checkSkip(t, rrule, start, after)
+			})
+		}
+	}
+}
+
+// COUNT and UNTIL may end the rule inside the skipped periods,
+// or right after them
+func TestRecurrenceLimitsInSkippedRange(t *testing.T) {
+	start := date(2024, 1, 1)
+	after := start.AddDate(450, 0, 0)
+
+	tests := []struct {
+		name  string
+		rrule string
+		// Index of the last occurrence at or after after, zero if there are none
+		last int
+	}{
+		{"count before after", "FREQ=DAILY;BYDAY=MO;COUNT=10", 0},
+		{"count in a skipped cycle", "FREQ=MONTHLY;BYDAY=-1FR;COUNT=5000", 0},
+		{"count right after after", "FREQ=MONTHLY;BYDAY=-1FR;COUNT=5404", 5404},
+		{"until in a skipped cycle", "FREQ=MONTHLY;BYDAY=2TU;UNTIL=24500101", 0},
+		{"until right after after", "FREQ=MONTHLY;BYDAY=2TU;UNTIL=24740301", 5403},
+		{"daily count right after after", "FREQ=DAILY;INTERVAL=2;BYDAY=SA,SU;COUNT=23483", 23483},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkSkip(t, tt.rrule, start, after)
+			switch {
+			case tt.last == 0 && len(got) != 0:
+				t.Fatalf("got %v after the rule has ended", got)
+			case tt.last != 0 && (len(got) == 0 || got[len(got)-1].index != tt.last):
+				t.Fatalf("got %v, want the last occurrence to be #%d", got, tt.last)
+			}
+		})
+	}
+}
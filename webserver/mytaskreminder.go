@@ -0,0 +1,280 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	TaskReminderBeforeDeadline = "task.reminder"
+	TaskReminderOverdue        = "task.overdue"
+
+	taskReminderInterval = 30 * time.Second
+)
+
+var defaultTaskReminderOffsets = []time.Duration{24 * time.Hour, time.Hour}
+
+// TaskReminder is a notification about a task deadline. Offset is how long
+// before the deadline the reminder fires, zero for overdue ones
+type TaskReminder struct {
+	Kind        string    `json:"kind"`
+	TaskID      int64     `json:"task_id"`
+	OwnerID     int64     `json:"owner_id"`
+	AssigneeID  int64     `json:"assignee_id,omitempty"`
+	Description string    `json:"description"`
+	Deadline    time.Time `json:"deadline"`
+	Offset      int64     `json:"offset_seconds"`
+	FireAt      time.Time `json:"fire_at"`
+}
+
+type TaskReminderNotifier interface {
+	Notify(reminder TaskReminder) error
+}
+
+// LogReminderNotifier writes reminders to the log
+type LogReminderNotifier struct{}
+
+func (LogReminderNotifier) Notify(reminder TaskReminder) error {
+	logrus.WithFields(logrus.Fields{
+		"kind":     reminder.Kind,
+		"task_id":  reminder.TaskID,
+		"deadline": reminder.Deadline,
+	}).Info(reminder.Description)
+
+	return nil
+}
+
+// WebhookReminderNotifier posts reminders as JSON signed like order
+// webhooks, see SignWebhookPayload
+type WebhookReminderNotifier struct {
+	URL    string
+	Secret string
+	// defaultReminderClient is used if nil
+	Client *http.Client
+}
+
+// Reminders are sent one by one, a hanging receiver mustn't stall them
+var defaultReminderClient = &http.Client{Timeout: 10 * time.Second}
+
+func (n WebhookReminderNotifier) Notify(reminder TaskReminder) error {
+	payload, err := json.Marshal(reminder)
+	if err != nil {
+		return fmt.Errorf("marshal reminder: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(headerWebhookEvent, reminder.Kind)
+	req.Header.Set(headerWebhookSignature, SignWebhookPayload(n.Secret, time.Now(), payload))
+
+	client := n.Client
+	if client == nil {
+		client = defaultReminderClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send reminder: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("send reminder: unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// EmailReminderNotifier is a stub which logs the email it would send
+type EmailReminderNotifier struct {
+	From string
+	To   string
+}
+
+func (n EmailReminderNotifier) Notify(reminder TaskReminder) error {
+	subject := "Reminder: " + reminder.Description
+	if reminder.Kind == TaskReminderOverdue {
+		subject = "Overdue: " + reminder.Description
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n", n.From, n.To, subject)
+	fmt.Fprintf(&body, "Task %d is due at %s.\r\n", reminder.TaskID, reminder.Deadline.Format(time.RFC1123))
+
+	logrus.WithField("to", n.To).Info("email stub: " + body.String())
+
+	return nil
+}
+
+// scheduledReminder is a pending or fired reminder
+type scheduledReminder struct {
+	TaskReminder
+	Fired         bool
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+func (r scheduledReminder) key() string {
+	return fmt.Sprintf("%d:%s:%d:%d", r.TaskID, r.Kind, r.Deadline.Unix(), r.Offset)
+}
+
+// TaskReminderScheduler fires reminders at offsets before task deadlines
+// and marks tasks overdue when deadlines pass. Reminders are kept in memory
+// like the tasks they are about, so none survive a restart
+type TaskReminderScheduler struct {
+	storage   *TaskStorageInMemory
+	notifier  TaskReminderNotifier
+	offsets   []time.Duration
+	policy    WebhookRetryPolicy
+	reminders map[string]scheduledReminder
+}
+
+func NewTaskReminderScheduler(storage *TaskStorageInMemory, notifier TaskReminderNotifier, offsets []time.Duration) *TaskReminderScheduler {
+	return &TaskReminderScheduler{
+		storage:   storage,
+		notifier:  notifier,
+		offsets:   offsets,
+		policy:    defaultWebhookRetryPolicy,
+		reminders: make(map[string]scheduledReminder),
+	}
+}
+
+// Run schedules and fires reminders every interval. It never returns
+func (s *TaskReminderScheduler) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.RunOnce(now)
+	}
+}
+
+// RunOnce schedules reminders of current deadlines and fires due ones
+func (s *TaskReminderScheduler) RunOnce(now time.Time) {
+	s.schedule(now)
+
+	for _, key := range s.due(now) {
+		reminder := s.reminders[key]
+		if err := s.fire(reminder.TaskReminder, now); err != nil {
+			reminder.Attempts++
+			logger := logrus.WithError(err).WithField("task_id", reminder.TaskID)
+			if reminder.Attempts >= s.policy.MaxAttempts {
+				logger.Error("give up task reminder")
+				reminder.Fired = true
+			} else {
+				logger.Warn("send task reminder")
+				reminder.NextAttemptAt = now.Add(s.policy.backoff(reminder.Attempts))
+			}
+		} else {
+			reminder.Fired = true
+		}
+
+		s.reminders[key] = reminder
+	}
+}
+
+// schedule adds reminders of open tasks with deadlines and drops the ones
+// of deleted, done or rescheduled tasks. Reminders which should have fired
+// before the task was scheduled are skipped, overdue ones never are
+func (s *TaskReminderScheduler) schedule(now time.Time) {
+	current := make(map[string]bool)
+
+	for _, task := range s.storage.OpenDeadlines() {
+		deadline := time.Unix(task.Deadline, 0).UTC()
+		candidates := []scheduledReminder{{TaskReminder: TaskReminder{
+			Kind: TaskReminderOverdue, TaskID: task.ID, OwnerID: task.OwnerID, AssigneeID: task.AssigneeID,
+			Description: task.Description, Deadline: deadline, FireAt: deadline,
+		}}}
+		for _, offset := range s.offsets {
+			candidates = append(candidates, scheduledReminder{TaskReminder: TaskReminder{
+				Kind: TaskReminderBeforeDeadline, TaskID: task.ID, OwnerID: task.OwnerID, AssigneeID: task.AssigneeID,
+				Description: task.Description, Deadline: deadline, Offset: int64(offset / time.Second), FireAt: deadline.Add(-offset),
+			}})
+		}
+
+		for _, reminder := range candidates {
+			key := reminder.key()
+			current[key] = true
+			if _, ok := s.reminders[key]; ok {
+				continue
+			}
+			reminder.Fired = reminder.Kind == TaskReminderBeforeDeadline && reminder.FireAt.Before(now)
+			s.reminders[key] = reminder
+		}
+	}
+
+	for key := range s.reminders {
+		if !current[key] {
+			delete(s.reminders, key)
+		}
+	}
+}
+
+// due returns keys of pending reminders to fire, the earliest first
+func (s *TaskReminderScheduler) due(now time.Time) []string {
+	var keys []string
+	for key, reminder := range s.reminders {
+		if !reminder.Fired && !reminder.FireAt.After(now) && !reminder.NextAttemptAt.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.reminders[keys[i]].FireAt.Before(s.reminders[keys[j]].FireAt)
+	})
+
+	return keys
+}
+
+func (s *TaskReminderScheduler) fire(reminder TaskReminder, now time.Time) error {
+	if reminder.Kind == TaskReminderOverdue {
+		s.storage.MarkOverdue(reminder.TaskID, reminder.Deadline.Unix(), now.Unix())
+	}
+
+	return s.notifier.Notify(reminder)
+}
+
+// OpenDeadlines returns tasks with deadlines which are not done
+func (s *TaskStorageInMemory) OpenDeadlines() []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []Task
+	for _, task := range s.tasks {
+		if task.Deadline != 0 && task.Status != TaskStatusDone {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks
+}
+
+// MarkOverdue marks the open task overdue if its deadline is still the given one
+func (s *TaskStorageInMemory) MarkOverdue(id int64, deadline int64, now int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok || task.Deadline != deadline || task.Status == TaskStatusDone || task.OverdueAt != 0 {
+		return false
+	}
+
+	task.OverdueAt = now
+	task.Version++
+	task.UpdatedAt = now
+	s.put(TaskActionUpdated, 0, task)
+	s.touchAncestors(task.ParentID)
+
+	return true
+}
@@ -0,0 +1,537 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Tasks are owned by the user who creates them. Owners share tasks with
+// view or edit permission and assign them to users, assignees can edit.
+// Editors can assign tasks only to themselves or to users who can already
+// edit them. Access to a task is also access to its subtasks
+
+type TaskPermission string
+
+const (
+	TaskPermissionView TaskPermission = "view"
+	TaskPermissionEdit TaskPermission = "edit"
+)
+
+// taskAccess levels are ordered, each one allows everything the lower ones do
+type taskAccess int
+
+const (
+	taskAccessNone taskAccess = iota
+	taskAccessView
+	taskAccessEdit
+	taskAccessOwner
+)
+
+func (p TaskPermission) access() taskAccess {
+	switch p {
+	case TaskPermissionView:
+		return taskAccessView
+	case TaskPermissionEdit:
+		return taskAccessEdit
+	default:
+		return taskAccessNone
+	}
+}
+
+type TaskShare struct {
+	UserID     int64          `json:"user_id"`
+	Permission TaskPermission `json:"permission"`
+}
+
+type TaskComment struct {
+	ID       int64  `json:"id"`
+	TaskID   int64  `json:"task_id"`
+	AuthorID int64  `json:"author_id"`
+	Body     string `json:"body"`
+	// Lower case emails mentioned as @user@example.com
+	Mentions  []string `json:"mentions"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+const (
+	maxTaskCommentLength = 4000
+	maxTaskShares        = 100
+	maxMentionsPageSize  = 100
+)
+
+var (
+	errTaskForbidden        = errors.New("task is not shared with the user")
+	errTaskReadOnly         = errors.New("task is shared with the user read-only")
+	errTaskNotOwner         = errors.New("only the owner of the task can do this")
+	errTaskPermission       = errors.New("permission must be view or edit")
+	errTaskShareUser        = errors.New("user_id must be a positive number other than the owner")
+	errTaskAssignee         = errors.New("assignee must be a user who signed in to the server")
+	errTaskAssignForbidden  = errors.New("only the owner can assign the task to users who can't edit it")
+	errTaskShares           = fmt.Errorf("task can be shared with at most %d users", maxTaskShares)
+	errTaskCommentBody      = fmt.Errorf("comment must be 1-%d characters long", maxTaskCommentLength)
+	errTaskCommentNotFound  = errors.New("comment not found")
+	errTaskCommentForbidden = errors.New("only the author or the owner of the task can delete the comment")
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w.@])@([\w.%+-]+@[\w-]+(?:\.[\w-]+)*\.[A-Za-z]{2,})`)
+
+// parseMentions returns sorted unique lower case emails mentioned in the text
+func parseMentions(text string) []string {
+	mentions := make([]string, 0)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		mentions = append(mentions, strings.ToLower(match[1]))
+	}
+	slices.Sort(mentions)
+
+	return slices.Compact(mentions)
+}
+
+// access returns the access of the user to the task, the best of the ones
+// given by the task and its ancestors. Must be called with s.mu held
+func (s *TaskStorageInMemory) access(t Task, userID int64) taskAccess {
+	best := taskAccessNone
+	for {
+		if t.OwnerID == userID {
+			return taskAccessOwner
+		}
+		if t.AssigneeID == userID {
+			best = max(best, taskAccessEdit)
+		}
+		for _, share := range t.Shares {
+			if share.UserID == userID {
+				best = max(best, share.Permission.access())
+			}
+		}
+
+		parent, ok := s.tasks[t.ParentID]
+		if t.ParentID == 0 || !ok {
+			return best
+		}
+		t = parent
+	}
+}
+
+// Authorize returns the check of the user's access to the task for storage
+// methods, it runs under the storage lock
+func (s *TaskStorageInMemory) Authorize(userID int64, need taskAccess) func(task Task) error {
+	return func(task Task) error {
+		switch access := s.access(task, userID); {
+		case access >= need:
+			return nil
+		case access == taskAccessNone:
+			return errTaskForbidden
+		case need == taskAccessOwner:
+			return errTaskNotOwner
+		default:
+			return errTaskReadOnly
+		}
+	}
+}
+
+// taskChecks combines checks, nil ones are skipped. The first error is returned
+func taskChecks(checks ...func(task Task) error) func(task Task) error {
+	return func(task Task) error {
+		for _, check := range checks {
+			if check == nil {
+				continue
+			}
+			if err := check(task); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func taskAccessError(err error) bool {
+	return errors.Is(err, errTaskForbidden) || errors.Is(err, errTaskReadOnly) ||
+		errors.Is(err, errTaskNotOwner) || errors.Is(err, errTaskCommentForbidden) ||
+		errors.Is(err, errTaskAssignForbidden)
+}
+
+// modify changes the task with change if check passes and bumps its version
+func (s *TaskStorageInMemory) modify(id int64, actorID int64, check func(task Task) error, change func(task *Task) error) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return Task{}, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return Task{}, err
+	}
+	if err := change(&task); err != nil {
+		return Task{}, err
+	}
+
+	task.Version++
+	task.UpdatedAt = time.Now().Unix()
+	s.put(TaskActionUpdated, actorID, task)
+	s.touchAncestors(task.ParentID)
+
+	return task, nil
+}
+
+// Share gives the user the permission, replacing the one they had
+func (s *TaskStorageInMemory) Share(id int64, actorID int64, check func(task Task) error, share TaskShare) (Task, error) {
+	if share.Permission.access() == taskAccessNone {
+		return Task{}, errTaskPermission
+	}
+
+	return s.modify(id, actorID, check, func(task *Task) error {
+		if share.UserID <= 0 || share.UserID == task.OwnerID {
+			return errTaskShareUser
+		}
+
+		shares := slices.DeleteFunc(slices.Clone(task.Shares), func(s TaskShare) bool { return s.UserID == share.UserID })
+		if len(shares) >= maxTaskShares {
+			return errTaskShares
+		}
+		shares = append(shares, share)
+		sort.Slice(shares, func(i, j int) bool { return shares[i].UserID < shares[j].UserID })
+		task.Shares = shares
+
+		return nil
+	})
+}
+
+func (s *TaskStorageInMemory) Unshare(id int64, actorID int64, check func(task Task) error, userID int64) (Task, error) {
+	return s.modify(id, actorID, check, func(task *Task) error {
+		task.Shares = slices.DeleteFunc(slices.Clone(task.Shares), func(s TaskShare) bool { return s.UserID == userID })
+		return nil
+	})
+}
+
+// Assign assigns the task to the user, zero unassigns it. Assignees get
+// edit access, so only the owner assigns users who can't edit the task yet
+// and unassigns others
+func (s *TaskStorageInMemory) Assign(id int64, actorID int64, check func(task Task) error, assigneeID int64) (Task, error) {
+	if assigneeID < 0 {
+		return Task{}, errTaskShareUser
+	}
+
+	return s.modify(id, actorID, check, func(task *Task) error {
+		owner := s.access(*task, actorID) == taskAccessOwner
+		switch {
+		case assigneeID == task.AssigneeID || assigneeID == actorID:
+		case assigneeID == 0:
+			if !owner && actorID != task.AssigneeID {
+				return errTaskNotOwner
+			}
+		case !s.users[assigneeID]:
+			return errTaskAssignee
+		case !owner && s.access(*task, assigneeID) < taskAccessEdit:
+			return errTaskAssignForbidden
+		}
+
+		task.AssigneeID = assigneeID
+		return nil
+	})
+}
+
+// RememberUser records the user who signed in, tasks can be assigned to them
+func (s *TaskStorageInMemory) RememberUser(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[userID] = true
+}
+
+// rememberTaskUsers records users authenticated by the routes after they run
+func rememberTaskUsers(storage *TaskStorageInMemory) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		err := ctx.Next()
+		if userID, ok := authUserID(ctx); ok {
+			storage.RememberUser(userID)
+		}
+
+		return err
+	}
+}
+
+func (s *TaskStorageInMemory) AddComment(taskID int64, check func(task Task) error, authorID int64, body string) (TaskComment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return TaskComment{}, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return TaskComment{}, err
+	}
+
+	body = strings.TrimSpace(body)
+	if body == "" || len(body) > maxTaskCommentLength {
+		return TaskComment{}, errTaskCommentBody
+	}
+
+	comment := TaskComment{
+		ID:        s.commentIDs.NextID(),
+		TaskID:    taskID,
+		AuthorID:  authorID,
+		Body:      body,
+		Mentions:  parseMentions(body),
+		CreatedAt: time.Now().Unix(),
+	}
+	s.comments[taskID] = append(s.comments[taskID], comment)
+
+	return comment, nil
+}
+
+// Comments returns comments of the task, the oldest first
+func (s *TaskStorageInMemory) Comments(taskID int64, check func(task Task) error) ([]TaskComment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return nil, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return nil, err
+	}
+
+	return append(make([]TaskComment, 0, len(s.comments[taskID])), s.comments[taskID]...), nil
+}
+
+// DeleteComment deletes the comment if the user is its author or the owner of the task
+func (s *TaskStorageInMemory) DeleteComment(taskID, commentID int64, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return errTaskNotFound
+	}
+	if s.access(task, userID) == taskAccessNone {
+		return errTaskForbidden
+	}
+
+	comments := s.comments[taskID]
+	i := slices.IndexFunc(comments, func(c TaskComment) bool { return c.ID == commentID })
+	if i < 0 {
+		return errTaskCommentNotFound
+	}
+	if comments[i].AuthorID != userID && s.access(task, userID) != taskAccessOwner {
+		return errTaskCommentForbidden
+	}
+	s.comments[taskID] = slices.Delete(slices.Clone(comments), i, i+1)
+
+	return nil
+}
+
+// Mentions returns comments mentioning the email on tasks the user can view,
+// the newest first
+func (s *TaskStorageInMemory) Mentions(email string, userID int64, limit int) []TaskComment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email = strings.ToLower(email)
+	mentions := make([]TaskComment, 0)
+	for taskID, comments := range s.comments {
+		if s.access(s.tasks[taskID], userID) == taskAccessNone {
+			continue
+		}
+		for _, comment := range comments {
+			if slices.Contains(comment.Mentions, email) {
+				mentions = append(mentions, comment)
+			}
+		}
+	}
+	sort.Slice(mentions, func(i, j int) bool { return mentions[i].ID > mentions[j].ID })
+	if len(mentions) > limit {
+		mentions = mentions[:limit]
+	}
+
+	return mentions
+}
+
+type (
+	ShareTaskRequest struct {
+		UserID     int64          `json:"user_id"`
+		Permission TaskPermission `json:"permission"`
+	}
+
+	AssignTaskRequest struct {
+		// Zero unassigns the task
+		UserID int64 `json:"user_id"`
+	}
+
+	CreateCommentRequest struct {
+		Body string `json:"body"`
+	}
+
+	ListCommentsResponse struct {
+		Comments []TaskComment `json:"comments"`
+	}
+)
+
+// sendTaskError answers errors of sharing, assignment and comments
+func sendTaskError(ctx *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errTaskNotFound), errors.Is(err, errTaskCommentNotFound):
+		return ctx.Status(fiber.StatusNotFound).SendString(err.Error())
+	case taskAccessError(err):
+		return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+	case errors.Is(err, errTaskPermission), errors.Is(err, errTaskShareUser), errors.Is(err, errTaskAssignee),
+		errors.Is(err, errTaskShares), errors.Is(err, errTaskCommentBody):
+		return ctx.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	default:
+		return err
+	}
+}
+
+// registerTaskSharing adds sharing, assignment and comment routes, all of them
+// require authentication
+func registerTaskSharing(webApp *fiber.App, storage *TaskStorageInMemory) {
+	taskID := func(ctx *fiber.Ctx) (int64, bool) {
+		id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		return id, err == nil
+	}
+
+	// Share task with the user or change their permission, owner only
+	webApp.Put("/tasks/:id/shares", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, ok := taskID(ctx)
+		if !ok {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		var req ShareTaskRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return fmt.Errorf("body parser: %w", err)
+		}
+
+		userID, _ := authUserID(ctx)
+		task, err := storage.Share(id, userID, storage.Authorize(userID, taskAccessOwner), TaskShare(req))
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+		ctx.Set(fiber.HeaderETag, taskETag(task))
+
+		return ctx.JSON(GetTaskResponse{Task: task})
+	})
+
+	// Stop sharing task with the user. The owner removes anyone,
+	// users can remove themselves
+	webApp.Delete("/tasks/:id/shares/:userId", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, ok := taskID(ctx)
+		if !ok {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+		shareUserID, err := strconv.ParseInt(ctx.Params("userId"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		need := taskAccessOwner
+		if shareUserID == userID {
+			need = taskAccessView
+		}
+		task, err := storage.Unshare(id, userID, storage.Authorize(userID, need), shareUserID)
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+		ctx.Set(fiber.HeaderETag, taskETag(task))
+
+		return ctx.JSON(GetTaskResponse{Task: task})
+	})
+
+	// Assign task to a user who signed in, editors assign themselves or
+	// users who can edit the task
+	webApp.Put("/tasks/:id/assignee", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, ok := taskID(ctx)
+		if !ok {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		var req AssignTaskRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return fmt.Errorf("body parser: %w", err)
+		}
+
+		userID, _ := authUserID(ctx)
+		task, err := storage.Assign(id, userID, taskChecks(storage.Authorize(userID, taskAccessEdit), taskIfMatch(ctx)), req.UserID)
+		if errors.Is(err, errTaskPrecondition) {
+			return ctx.Status(fiber.StatusPreconditionFailed).SendString(err.Error())
+		}
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+		ctx.Set(fiber.HeaderETag, taskETag(task))
+
+		return ctx.JSON(GetTaskResponse{Task: task})
+	})
+
+	webApp.Get("/tasks/:id/comments", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, ok := taskID(ctx)
+		if !ok {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		comments, err := storage.Comments(id, storage.Authorize(userID, taskAccessView))
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+
+		return ctx.JSON(ListCommentsResponse{Comments: comments})
+	})
+
+	// Comment on task, everyone who can view it can comment
+	webApp.Post("/tasks/:id/comments", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, ok := taskID(ctx)
+		if !ok {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		var req CreateCommentRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return fmt.Errorf("body parser: %w", err)
+		}
+
+		userID, _ := authUserID(ctx)
+		comment, err := storage.AddComment(id, storage.Authorize(userID, taskAccessView), userID, req.Body)
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+
+		return ctx.Status(fiber.StatusCreated).JSON(comment)
+	})
+
+	webApp.Delete("/tasks/:id/comments/:commentId", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, ok := taskID(ctx)
+		if !ok {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+		commentID, err := strconv.ParseInt(ctx.Params("commentId"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid comment ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		if err := storage.DeleteComment(id, commentID, userID); err != nil {
+			return sendTaskError(ctx, err)
+		}
+
+		return ctx.SendStatus(fiber.StatusOK)
+	})
+
+	// Get comments mentioning the user by the email of the access token
+	webApp.Get("/mentions", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		email, _ := ctx.Locals(localsUserEmail).(string)
+
+		return ctx.JSON(ListCommentsResponse{Comments: storage.Mentions(email, userID, maxMentionsPageSize)})
+	})
+}
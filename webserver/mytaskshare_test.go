@@ -0,0 +1,78 @@
+package webserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// An editor must not gain ownership of a task by moving it under a task
+// of their own, or hand it to another user by moving it under theirs
+func TestTaskMoveDoesNotEscalateAccess(t *testing.T) {
+	const (
+		owner  int64 = 1
+		editor int64 = 2
+		other  int64 = 3
+	)
+
+	storage := NewTaskStorage(NewSequenceIDGenerator(1), time.Hour)
+	create := func(ownerID int64) int64 {
+		id, err := storage.Create(Task{Description: "Task", OwnerID: ownerID})
+		if err != nil {
+			t.Fatalf("create task: %v", err)
+		}
+		return id
+	}
+	share := func(id, actorID, userID int64) {
+		share := TaskShare{UserID: userID, Permission: TaskPermissionEdit}
+		if _, err := storage.Share(id, actorID, storage.Authorize(actorID, taskAccessOwner), share); err != nil {
+			t.Fatalf("share task %d: %v", id, err)
+		}
+	}
+
+	task := create(owner)
+	share(task, owner, editor)
+	// Shares don't need consent of the user, so the owner can edit both
+	editorParent := create(editor)
+	share(editorParent, editor, owner)
+	otherParent := create(other)
+	share(otherParent, other, editor)
+	share(otherParent, other, owner)
+
+	for _, parentID := range []int64{editorParent, otherParent} {
+		_, err := storage.Update(task, editor, PatchTaskRequest{ParentID: parentID}, storage.Authorize(editor, taskAccessEdit))
+		if !errors.Is(err, errTaskNotOwner) {
+			t.Fatalf("move under %d: got %v, want %v", parentID, err, errTaskNotOwner)
+		}
+		_, err = storage.UpdateWith(task, editor, storage.Authorize(editor, taskAccessEdit), func(task Task) (Task, error) {
+			task.ParentID = parentID
+			return task, nil
+		})
+		if !errors.Is(err, errTaskNotOwner) {
+			t.Fatalf("patch parent to %d: got %v, want %v", parentID, err, errTaskNotOwner)
+		}
+	}
+
+	current, _ := storage.Read(task)
+	if current.ParentID != 0 {
+		t.Fatalf("task moved under %d", current.ParentID)
+	}
+	if err := storage.Delete(task, editor, storage.Authorize(editor, taskAccessOwner)); !errors.Is(err, errTaskNotOwner) {
+		t.Fatalf("delete by editor: got %v, want %v", err, errTaskNotOwner)
+	}
+	if err := storage.Authorize(other, taskAccessView)(current); !errors.Is(err, errTaskForbidden) {
+		t.Fatalf("access of other user: got %v, want %v", err, errTaskForbidden)
+	}
+
+	// Editors still edit other fields, owners still move their tasks
+	if _, err := storage.Update(task, editor, PatchTaskRequest{Description: "Edited"}, storage.Authorize(editor, taskAccessEdit)); err != nil {
+		t.Fatalf("edit by editor: %v", err)
+	}
+	moved, err := storage.Update(task, owner, PatchTaskRequest{ParentID: editorParent}, storage.Authorize(owner, taskAccessEdit))
+	if err != nil {
+		t.Fatalf("move by owner: %v", err)
+	}
+	if moved.ParentID != editorParent {
+		t.Fatalf("parent %d, want %d", moved.ParentID, editorParent)
+	}
+}
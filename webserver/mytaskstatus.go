@@ -0,0 +1,235 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type TaskStatus string
+
+const (
+	TaskStatusTodo       TaskStatus = "todo"
+	TaskStatusInProgress TaskStatus = "in-progress"
+	TaskStatusDone       TaskStatus = "done"
+)
+
+func (s TaskStatus) valid() bool {
+	switch s {
+	case TaskStatusTodo, TaskStatusInProgress, TaskStatusDone:
+		return true
+	default:
+		return false
+	}
+}
+
+type TaskPriority string
+
+const (
+	TaskPriorityLow    TaskPriority = "low"
+	TaskPriorityMedium TaskPriority = "medium"
+	TaskPriorityHigh   TaskPriority = "high"
+)
+
+func (p TaskPriority) valid() bool {
+	switch p {
+	case TaskPriorityLow, TaskPriorityMedium, TaskPriorityHigh:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	maxTaskTags      = 20
+	maxTaskTagLength = 32
+)
+
+var (
+	errTaskNotFound    = errors.New("Task with provided ID not found")
+	errTaskStatus      = errors.New("status must be todo, in-progress or done")
+	errTaskPriority    = errors.New("priority must be low, medium or high")
+	errTaskTags        = fmt.Errorf("task can have at most %d tags", maxTaskTags)
+	errTaskTag         = fmt.Errorf("tags must be 1-%d characters long", maxTaskTagLength)
+	errTaskNotDone     = errors.New("task is not done")
+	errTaskAlreadyDone = errors.New("task is already done")
+)
+
+// normalizeTaskTags trims and lower cases tags, drops duplicates and sorts them
+func normalizeTaskTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxTaskTagLength {
+			return nil, errTaskTag
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTaskTags {
+		return nil, errTaskTags
+	}
+	sort.Strings(normalized)
+
+	return normalized, nil
+}
+
+// validate checks the task and normalizes its tags and recurrence
+func (t *Task) validate() error {
+	if !t.Status.valid() {
+		return errTaskStatus
+	}
+	if !t.Priority.valid() {
+		return errTaskPriority
+	}
+
+	tags, err := normalizeTaskTags(t.Tags)
+	if err != nil {
+		return err
+	}
+	t.Tags = tags
+
+	return t.validateRecurrence()
+}
+
+func taskValidationError(err error) bool {
+	return errors.Is(err, errTaskStatus) || errors.Is(err, errTaskPriority) ||
+		errors.Is(err, errTaskTags) || errors.Is(err, errTaskTag) ||
+		errors.Is(err, errTaskRecurrence) || errors.Is(err, errTaskRecurrenceDeadline)
+}
+
+// changeTaskStatus handles complete and reopen requests
+func changeTaskStatus(ctx *fiber.Ctx, change func(id int64, now int64) (Task, error)) error {
+	taskID, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+	}
+
+	task, err := change(taskID, time.Now().Unix())
+	switch {
+	case errors.Is(err, errTaskNotFound):
+		return ctx.Status(fiber.StatusNotFound).SendString(err.Error())
+	case taskAccessError(err):
+		return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+	case errors.Is(err, errTaskAlreadyDone), errors.Is(err, errTaskNotDone), errors.Is(err, errTaskBlocked):
+		return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+	case err != nil:
+		return fmt.Errorf("change task status: %w", err)
+	}
+
+	ctx.Set(fiber.HeaderETag, taskETag(task))
+
+	return ctx.JSON(GetTaskResponse{Task: task})
+}
+
+// setStatus changes the status and keeps the completion time in sync with it
+func (t *Task) setStatus(status TaskStatus, now int64) {
+	if t.Status == status {
+		return
+	}
+
+	t.Status = status
+	if status == TaskStatusDone {
+		t.CompletedAt = now
+	} else {
+		t.CompletedAt = 0
+	}
+}
+
+// Complete marks the task done if check passes and it has no open blockers
+// or subtasks, the next occurrence of a recurring task is created
+func (s *TaskStorageInMemory) Complete(id int64, actorID int64, now int64, check func(task Task) error) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return Task{}, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return Task{}, err
+	}
+	if task.Status == TaskStatusDone {
+		return Task{}, errTaskAlreadyDone
+	}
+	if err := s.checkNotBlocked(task); err != nil {
+		return Task{}, err
+	}
+
+	task.setStatus(TaskStatusDone, now)
+	task.UpdatedAt = now
+	task.Version++
+	s.spawnNextOccurrence(&task, actorID, now)
+	s.put(TaskActionUpdated, actorID, task)
+	s.touchAncestors(task.ParentID)
+
+	return task, nil
+}
+
+// Reopen moves the done task back to todo if check passes
+func (s *TaskStorageInMemory) Reopen(id int64, actorID int64, now int64, check func(task Task) error) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return Task{}, errTaskNotFound
+	}
+	if err := check(task); err != nil {
+		return Task{}, err
+	}
+	if task.Status != TaskStatusDone {
+		return Task{}, errTaskNotDone
+	}
+
+	task.setStatus(TaskStatusTodo, now)
+	task.UpdatedAt = now
+	task.Version++
+	s.put(TaskActionUpdated, actorID, task)
+	s.touchAncestors(task.ParentID)
+
+	return task, nil
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// TagCounts returns tags of tasks the user can view with the number of
+// tasks having them, the most used first
+func (s *TaskStorageInMemory) TagCounts(userID int64) []TagCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, task := range s.tasks {
+		if s.access(task, userID) == taskAccessNone {
+			continue
+		}
+		for _, tag := range task.Tags {
+			counts[tag]++
+		}
+	}
+
+	tags := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+
+	return tags
+}
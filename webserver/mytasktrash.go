@@ -0,0 +1,259 @@
+package webserver
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Deleted tasks go to the trash with their subtasks, comments and history.
+// They can be restored until the retention passes, then they are purged
+
+const defaultTaskTrashRetention = 30 * 24 * time.Hour
+
+var errTrashedTaskNotFound = errors.New("task not found in trash")
+
+type (
+	// TrashedTask is the deleted task, its subtasks are restored with it
+	TrashedTask struct {
+		Task
+		Subtasks  []int64 `json:"subtasks"`
+		DeletedBy int64   `json:"deleted_by"`
+		DeletedAt int64   `json:"deleted_at"`
+		ExpiresAt int64   `json:"expires_at"`
+
+		// Deleted tasks with subtasks after their parents
+		tasks []Task
+		// IDs of deleted blockers of tasks which were blocked by them
+		blocked map[int64][]int64
+	}
+
+	ListTrashResponse struct {
+		Tasks []TrashedTask `json:"tasks"`
+	}
+)
+
+// Delete moves the task with its subtasks to the trash if check, when set, passes
+func (s *TaskStorageInMemory) Delete(id int64, actorID int64, check func(task Task) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return errTaskNotFound
+	}
+	if check != nil {
+		if err := check(task); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	s.sweepTrash(now)
+
+	deleted, blocked := s.deleteTree(task.ID, actorID, now.Unix())
+	entry := TrashedTask{
+		Task:      deleted[0],
+		Subtasks:  make([]int64, 0, len(deleted)-1),
+		DeletedBy: actorID,
+		DeletedAt: now.Unix(),
+		ExpiresAt: now.Add(s.trashRetention).Unix(),
+		tasks:     deleted,
+		blocked:   blocked,
+	}
+	for _, t := range deleted[1:] {
+		entry.Subtasks = append(entry.Subtasks, t.ID)
+	}
+	s.trash[task.ID] = entry
+	// Zero retention deletes tasks permanently
+	s.sweepTrash(now)
+
+	return nil
+}
+
+// sweepTrash purges tasks whose retention has passed. Must be called with s.mu held
+func (s *TaskStorageInMemory) sweepTrash(now time.Time) {
+	for id, entry := range s.trash {
+		if now.Unix() >= entry.ExpiresAt {
+			s.purge(id)
+		}
+	}
+}
+
+// purge deletes the trashed task with its subtasks, comments and history
+// permanently. Must be called with s.mu held
+func (s *TaskStorageInMemory) purge(id int64) {
+	for _, task := range s.trash[id].tasks {
+		delete(s.comments, task.ID)
+		delete(s.revisions, task.ID)
+	}
+	delete(s.trash, id)
+}
+
+// Trash returns tasks deleted by the user or from their tasks, the latest first
+func (s *TaskStorageInMemory) Trash(userID int64) []TrashedTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweepTrash(time.Now())
+
+	trashed := make([]TrashedTask, 0)
+	for _, entry := range s.trash {
+		if entry.DeletedBy == userID || s.access(entry.Task, userID) == taskAccessOwner {
+			trashed = append(trashed, entry)
+		}
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		if trashed[i].DeletedAt != trashed[j].DeletedAt {
+			return trashed[i].DeletedAt > trashed[j].DeletedAt
+		}
+		return trashed[i].ID > trashed[j].ID
+	})
+
+	return trashed
+}
+
+// trashed returns the trash entry if the user deleted it or owns the task.
+// Must be called with s.mu held
+func (s *TaskStorageInMemory) trashed(id int64, userID int64) (TrashedTask, error) {
+	s.sweepTrash(time.Now())
+
+	entry, ok := s.trash[id]
+	if !ok {
+		return TrashedTask{}, errTrashedTaskNotFound
+	}
+	if entry.DeletedBy != userID && s.access(entry.Task, userID) != taskAccessOwner {
+		return TrashedTask{}, errTaskNotOwner
+	}
+
+	return entry, nil
+}
+
+// Restore brings the task with its subtasks back from the trash. Relations
+// to tasks and projects which are gone or no longer accessible are dropped,
+// tasks blocked by the restored ones are blocked again
+func (s *TaskStorageInMemory) Restore(id int64, userID int64) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.trashed(id, userID)
+	if err != nil {
+		return Task{}, err
+	}
+	delete(s.trash, id)
+
+	now := time.Now().Unix()
+	for _, task := range entry.tasks {
+		before := task
+		s.reattach(&task)
+		task.Version++
+		task.UpdatedAt = now
+		s.tasks[task.ID] = task
+		s.record(TaskActionRestored, userID, before, task)
+	}
+	s.touchAncestors(s.tasks[id].ParentID)
+
+	ids := make([]int64, 0, len(entry.blocked))
+	for taskID := range entry.blocked {
+		ids = append(ids, taskID)
+	}
+	slices.Sort(ids)
+	for _, taskID := range ids {
+		task, ok := s.tasks[taskID]
+		if !ok {
+			continue
+		}
+		blocked := task
+		blocked.BlockedBy = append(slices.Clone(task.BlockedBy), entry.blocked[taskID]...)
+		// Dependencies added while the tasks were in the trash may form a cycle
+		if err := s.checkRelations(&blocked); err != nil {
+			continue
+		}
+		blocked.Version++
+		blocked.UpdatedAt = now
+		s.put(TaskActionUpdated, userID, blocked)
+		s.touchAncestors(blocked.ParentID)
+	}
+
+	return s.tasks[id], nil
+}
+
+// reattach drops relations of the restored task to tasks and projects which
+// are gone or which its owner no longer has access to. Must be called with s.mu held
+func (s *TaskStorageInMemory) reattach(t *Task) {
+	if project, ok := s.projects[t.ProjectID]; !ok || project.OwnerID != t.OwnerID {
+		t.ProjectID = 0
+	}
+	if parent, ok := s.tasks[t.ParentID]; !ok || s.access(parent, t.OwnerID) < taskAccessEdit {
+		t.ParentID = 0
+	}
+	t.BlockedBy = slices.DeleteFunc(slices.Clone(t.BlockedBy), func(id int64) bool {
+		blocker, ok := s.tasks[id]
+		return !ok || s.access(blocker, t.OwnerID) == taskAccessNone
+	})
+}
+
+// Purge deletes the trashed task permanently
+func (s *TaskStorageInMemory) Purge(id int64, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.trashed(id, userID); err != nil {
+		return err
+	}
+	s.purge(id)
+
+	return nil
+}
+
+// registerTaskTrash adds trash routes, GET /tasks/trash has to be registered
+// before /tasks/:id
+func registerTaskTrash(webApp *fiber.App, storage *TaskStorageInMemory) {
+	webApp.Get("/tasks/trash", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		return ctx.JSON(ListTrashResponse{Tasks: storage.Trash(userID)})
+	})
+
+	// Restore task with its subtasks, the owner or the user who deleted it can
+	webApp.Post("/tasks/:id/restore", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		task, err := storage.Restore(id, userID)
+		if errors.Is(err, errTrashedTaskNotFound) {
+			return ctx.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+		ctx.Set(fiber.HeaderETag, taskETag(task))
+
+		return ctx.JSON(GetTaskResponse{Task: task})
+	})
+
+	// Delete task from the trash permanently
+	webApp.Delete("/tasks/trash/:id", RequireAuth, func(ctx *fiber.Ctx) error {
+		id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid task ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		err = storage.Purge(id, userID)
+		if errors.Is(err, errTrashedTaskNotFound) {
+			return ctx.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
+		if err != nil {
+			return sendTaskError(ctx, err)
+		}
+
+		return ctx.SendStatus(fiber.StatusOK)
+	})
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/ermakovov/learn-golang/jsonpatch"
 	"github.com/gofiber/fiber/v2"
 	"github.com/sirupsen/logrus"
 )
@@ -15,78 +18,270 @@ type (
 		ID          int64
 		Description string
 		Deadline    int64
+		Status      TaskStatus
+		Priority    TaskPriority
+		Tags        []string
+		// User from the JWT who created the task, the user it's assigned
+		// to and users it's shared with
+		OwnerID    int64
+		AssigneeID int64
+		Shares     []TaskShare
+		// Zero when the task is not in a project or not a subtask
+		ProjectID int64
+		ParentID  int64
+		// Tasks which must be done before this one, sorted
+		BlockedBy []int64
+		// RRULE of a recurring task. Occurrences of the series are separate
+		// tasks, SeriesStart is the deadline of the first one and Occurrence
+		// is the 1-based number of this one. NextOccurrenceID is set when
+		// the next task is created on completion of this one
+		Recurrence       string
+		SeriesStart      int64
+		Occurrence       int
+		NextOccurrenceID int64
+		// Grows on every change, the ETag of the task
+		Version int64
+		// Unix times, CompletedAt is zero unless the task is done,
+		// OverdueAt is set by the reminder scheduler when the deadline passes
+		CreatedAt   int64
+		UpdatedAt   int64
+		CompletedAt int64
+		OverdueAt   int64
 	}
 
 	// Storage
 	TaskStorageInMemory struct {
-		tasks map[int64]Task
+		mu         sync.Mutex
+		ids        TaskIDGenerator
+		projectIDs TaskIDGenerator
+		commentIDs TaskIDGenerator
+		tasks      map[int64]Task
+		projects   map[int64]Project
+		// Comments by task ID, the oldest first
+		comments map[int64][]TaskComment
+		// Last maxTaskRevisions revisions by task ID, the oldest first
+		revisions   map[int64][]TaskRevision
+		revisionIDs TaskIDGenerator
+		// Deleted tasks by ID, they are kept for trashRetention
+		trash          map[int64]TrashedTask
+		trashRetention time.Duration
+		// Changes are published as events
+		events *TaskEventBroker
+		// Users who signed in to the server, tasks are assigned only to them
+		users map[int64]bool
 	}
 )
 
-var taskIdCounter int64 = 1
+func NewTaskStorage(ids TaskIDGenerator, trashRetention time.Duration) *TaskStorageInMemory {
+	return &TaskStorageInMemory{
+		ids:            ids,
+		projectIDs:     NewSequenceIDGenerator(1),
+		commentIDs:     NewSequenceIDGenerator(1),
+		revisionIDs:    NewSequenceIDGenerator(1),
+		tasks:          make(map[int64]Task),
+		projects:       make(map[int64]Project),
+		comments:       make(map[int64][]TaskComment),
+		revisions:      make(map[int64][]TaskRevision),
+		trash:          make(map[int64]TrashedTask),
+		trashRetention: trashRetention,
+		events:         NewTaskEventBroker(taskEventHistorySize),
+		users:          make(map[int64]bool),
+	}
+}
 
 func (s *TaskStorageInMemory) Create(t Task) (int64, error) {
-	t.ID = taskIdCounter
-	taskIdCounter++
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.tasks[t.ID] = t
-
-	return t.ID, nil
-}
+	if t.Status == "" {
+		t.Status = TaskStatusTodo
+	}
+	if t.Priority == "" {
+		t.Priority = TaskPriorityMedium
+	}
+	if err := t.validate(); err != nil {
+		return 0, err
+	}
 
-func (s *TaskStorageInMemory) List() ([]Task, error) {
-	tasks := make([]Task, 0, len(s.tasks))
+	// Subtasks are in the project of the parent unless another one is set,
+	// if the project is of the same owner
+	if parent, ok := s.tasks[t.ParentID]; ok && t.ProjectID == 0 && s.projects[parent.ProjectID].OwnerID == t.OwnerID {
+		t.ProjectID = parent.ProjectID
+	}
+	t.ID = s.ids.NextID()
+	if err := s.checkRelations(&t); err != nil {
+		return 0, err
+	}
+	if t.Status == TaskStatusDone {
+		if err := s.checkNotBlocked(t); err != nil {
+			return 0, err
+		}
+	}
 
-	for _, t := range s.tasks {
-		tasks = append(tasks, t)
+	t.Version = 1
+	now := time.Now().Unix()
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	if t.Recurrence != "" {
+		t.SeriesStart = t.Deadline
+		t.Occurrence = 1
 	}
+	if t.Status == TaskStatusDone {
+		t.CompletedAt = now
+		s.spawnNextOccurrence(&t, t.OwnerID, now)
+	}
+
+	s.put(TaskActionCreated, t.OwnerID, t)
+	s.touchAncestors(t.ParentID)
 
-	return tasks, nil
+	return t.ID, nil
 }
 
 func (s *TaskStorageInMemory) Read(id int64) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	task, ok := s.tasks[id]
 	if !ok {
-		return Task{}, errors.New("Task with provided ID not found")
+		return Task{}, errTaskNotFound
 	}
 
 	return task, nil
 }
 
-func (s *TaskStorageInMemory) Update(id int64, upd PatchTaskRequest) (Task, error) {
+// Update changes fields which are set in the request, empty ones are left as is.
+// Patch documents handled by UpdateWith can clear fields
+func (s *TaskStorageInMemory) Update(id int64, actorID int64, upd PatchTaskRequest, check func(task Task) error) (Task, error) {
+	return s.UpdateWith(id, actorID, check, func(task Task) (Task, error) {
+		if upd.Description != "" {
+			task.Description = upd.Description
+		}
+		if upd.Deadline != 0 {
+			task.Deadline = upd.Deadline
+		}
+		if upd.Status != "" {
+			task.Status = upd.Status
+		}
+		if upd.Priority != "" {
+			task.Priority = upd.Priority
+		}
+		if upd.Tags != nil {
+			task.Tags = upd.Tags
+		}
+		if upd.Recurrence != "" {
+			task.Recurrence = upd.Recurrence
+		}
+		if upd.ProjectID != 0 {
+			task.ProjectID = upd.ProjectID
+		}
+		if upd.ParentID != 0 {
+			task.ParentID = upd.ParentID
+		}
+		if upd.BlockedBy != nil {
+			task.BlockedBy = upd.BlockedBy
+		}
+
+		return task, nil
+	})
+}
+
+// UpdateWith replaces the task with the result of change if check, when set,
+// passes. The ID, version, timestamps and access can't be changed, the completion
+// time follows the status. A changed deadline clears the overdue mark and,
+// as a changed recurrence, starts a new series at the deadline. Only the owner
+// can move the task to another parent, since owners of the ancestors own it too
+func (s *TaskStorageInMemory) UpdateWith(id int64, actorID int64, check func(task Task) error, change func(task Task) (Task, error)) (Task, error) {
+	return s.updateWith(TaskActionUpdated, id, actorID, check, change)
+}
+
+// updateWith is UpdateWith recording the revision with the action
+func (s *TaskStorageInMemory) updateWith(action TaskAction, id int64, actorID int64, check func(task Task) error, change func(task Task) (Task, error)) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	task, ok := s.tasks[id]
 	if !ok {
-		return Task{}, errors.New("Task with provided ID not found")
+		return Task{}, errTaskNotFound
+	}
+	if check != nil {
+		if err := check(task); err != nil {
+			return Task{}, err
+		}
 	}
 
-	if upd.Description != "" {
-		task.Description = upd.Description
+	updated, err := change(task)
+	if err != nil {
+		return Task{}, err
 	}
-	if upd.Deadline != 0 {
-		task.Deadline = upd.Deadline
+	if updated.ParentID != task.ParentID && actorID != task.OwnerID {
+		return Task{}, errTaskNotOwner
 	}
 
-	s.tasks[task.ID] = task
-
-	return task, nil
-}
-
-func (s *TaskStorageInMemory) Delete(id int64) error {
-	task, ok := s.tasks[id]
-	if !ok {
-		return errors.New("Task with provided ID not found")
+	now := time.Now().Unix()
+	status := updated.Status
+	updated.ID = task.ID
+	updated.OwnerID = task.OwnerID
+	updated.AssigneeID = task.AssigneeID
+	updated.Shares = task.Shares
+	updated.Version = task.Version + 1
+	updated.Status = task.Status
+	updated.CreatedAt = task.CreatedAt
+	updated.CompletedAt = task.CompletedAt
+	if updated.Deadline == task.Deadline {
+		updated.OverdueAt = task.OverdueAt
+	} else {
+		updated.OverdueAt = 0
+	}
+	updated.SeriesStart = task.SeriesStart
+	updated.Occurrence = task.Occurrence
+	updated.NextOccurrenceID = task.NextOccurrenceID
+	updated.setStatus(status, now)
+	if err := updated.validate(); err != nil {
+		return Task{}, err
+	}
+	if err := s.checkRelations(&updated); err != nil {
+		return Task{}, err
+	}
+	if task.Status != TaskStatusDone && updated.Status == TaskStatusDone {
+		if err := s.checkNotBlocked(updated); err != nil {
+			return Task{}, err
+		}
+	}
+	updated.UpdatedAt = now
+
+	switch {
+	case updated.Recurrence == "":
+		updated.SeriesStart = 0
+		updated.Occurrence = 0
+	case updated.Recurrence != task.Recurrence || updated.Deadline != task.Deadline:
+		updated.SeriesStart = updated.Deadline
+		updated.Occurrence = 1
+	}
+	if task.Status != TaskStatusDone && updated.Status == TaskStatusDone {
+		s.spawnNextOccurrence(&updated, actorID, now)
 	}
 
-	delete(s.tasks, task.ID)
+	s.put(action, actorID, updated)
+	s.touchAncestors(task.ParentID)
+	if updated.ParentID != task.ParentID {
+		s.touchAncestors(updated.ParentID)
+	}
 
-	return nil
+	return updated, nil
 }
 
 // Task Creation
 type (
 	CreateTaskRequest struct {
-		Description string `json:"description"`
-		Deadline    int64  `json:"deadline"`
+		Description string       `json:"description"`
+		Deadline    int64        `json:"deadline"`
+		Status      TaskStatus   `json:"status"`
+		Priority    TaskPriority `json:"priority"`
+		Tags        []string     `json:"tags"`
+		Recurrence  string       `json:"recurrence"`
+		ProjectID   int64        `json:"project_id"`
+		ParentID    int64        `json:"parent_id"`
+		BlockedBy   []int64      `json:"blocked_by"`
 	}
 
 	CreateTaskResponse struct {
@@ -97,7 +292,12 @@ type (
 // Tasks Reading
 type (
 	ListTasksResponse struct {
-		Tasks []Task `json:"tasks"`
+		Tasks      []Task `json:"tasks"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	ListTagsResponse struct {
+		Tags []TagCount `json:"tags"`
 	}
 
 	GetTaskRequest struct {
@@ -111,9 +311,17 @@ type (
 
 // Task Updating
 type (
+	// Empty fields are left as is, an empty tags array removes all tags
 	PatchTaskRequest struct {
-		Description string `json:"description"`
-		Deadline    int64  `json:"deadline"`
+		Description string       `json:"description"`
+		Deadline    int64        `json:"deadline"`
+		Status      TaskStatus   `json:"status"`
+		Priority    TaskPriority `json:"priority"`
+		Tags        []string     `json:"tags"`
+		Recurrence  string       `json:"recurrence"`
+		ProjectID   int64        `json:"project_id"`
+		ParentID    int64        `json:"parent_id"`
+		BlockedBy   []int64      `json:"blocked_by"`
 	}
 
 	PatchTaskResponse struct {
@@ -123,21 +331,47 @@ type (
 
 func StartToDoServer() {
 	webApp := fiber.New()
-	storage := &TaskStorageInMemory{
-		tasks: make(map[int64]Task),
-	}
+	// Small IDs are friendly to JavaScript clients, replicas would need
+	// NewSnowflakeIDGenerator with distinct nodes
+	storage := NewTaskStorage(NewSequenceIDGenerator(1), defaultTaskTrashRetention)
+
+	idempotency := NewIdempotencyMiddleware(NewIdempotencyStorage(idempotencyKeyTTL))
+
+	// Reminders go to the log, WebhookReminderNotifier and
+	// EmailReminderNotifier can be used instead
+	reminders := NewTaskReminderScheduler(storage, LogReminderNotifier{}, defaultTaskReminderOffsets)
+	go reminders.Run(taskReminderInterval)
 
-	// Create new task
-	webApp.Post("/tasks", func(ctx *fiber.Ctx) error {
+	// Tasks belong to users, so all task routes except the calendar feed
+	// require authentication
+	webApp.Use(rememberTaskUsers(storage))
+
+	// Create new task owned by the user
+	webApp.Post("/tasks", RequireAuth, idempotency, func(ctx *fiber.Ctx) error {
 		var req CreateTaskRequest
 		if err := ctx.BodyParser(&req); err != nil {
 			return fmt.Errorf("body parser: %w", err)
 		}
 
+		userID, _ := authUserID(ctx)
 		id, err := storage.Create(Task{
+			OwnerID:     userID,
 			Description: req.Description,
 			Deadline:    req.Deadline,
+			Status:      req.Status,
+			Priority:    req.Priority,
+			Tags:        req.Tags,
+			Recurrence:  req.Recurrence,
+			ProjectID:   req.ProjectID,
+			ParentID:    req.ParentID,
+			BlockedBy:   req.BlockedBy,
 		})
+		if taskValidationError(err) || taskRelationError(err) {
+			return ctx.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		}
+		if errors.Is(err, errTaskBlocked) {
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		}
 		if err != nil {
 			return fmt.Errorf("creation in storage: %w", err)
 		}
@@ -145,19 +379,69 @@ func StartToDoServer() {
 		return ctx.JSON(CreateTaskResponse{ID: id})
 	})
 
-	// Get list of all tasks
-	webApp.Get("/tasks", func(ctx *fiber.Ctx) error {
-		tasks, err := storage.List()
+	// Get page of tasks the user can view matching the filter
+	webApp.Get("/tasks", RequireAuth, func(ctx *fiber.Ctx) error {
+		filter, err := parseTaskFilter(ctx)
 		if err != nil {
-			return fmt.Errorf("list all tasks from storage: %w", err)
+			return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
 
-		return ctx.JSON(ListTasksResponse{Tasks: tasks})
+		tasks, next, err := storage.List(filter)
+		if errors.Is(err, errInvalidTaskCursor) {
+			return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("list tasks from storage: %w", err)
+		}
+
+		resp := ListTasksResponse{Tasks: tasks}
+		if next != nil {
+			resp.NextCursor = next.String()
+		}
+		setTaskListLinks(ctx, next)
+
+		return ctx.JSON(resp)
+	})
+
+	// Expand recurring tasks over a window, registered before /tasks/:id
+	webApp.Get("/tasks/occurrences", RequireAuth, func(ctx *fiber.Ctx) error {
+		return listOccurrences(ctx, storage)
+	})
+
+	// Calendar feed of deadlines, authenticated by the token in the URL
+	// since calendar apps can't send access tokens
+	feedTokens := NewFeedTokenStore()
+	webApp.Get("/tasks.ics", func(ctx *fiber.Ctx) error {
+		return taskFeed(ctx, storage, feedTokens)
+	})
+
+	webApp.Post("/tasks/feed-token", RequireAuth, func(ctx *fiber.Ctx) error {
+		return issueFeedToken(ctx, feedTokens)
+	})
+
+	// Revoke the feed token of the user, calendar subscriptions stop working
+	webApp.Delete("/tasks/feed-token", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		feedTokens.revoke(userID)
+
+		return ctx.SendStatus(fiber.StatusOK)
+	})
+
+	// Import tasks from an .ics file
+	webApp.Post("/tasks/import", RequireAuth, func(ctx *fiber.Ctx) error {
+		return importTasks(ctx, storage)
+	})
+
+	registerTaskTrash(webApp, storage)
+
+	// Stream changes of tasks over SSE or WebSocket, registered before /tasks/:id
+	webApp.Get("/tasks/events", requireStreamAuth, func(ctx *fiber.Ctx) error {
+		return taskEvents(ctx, storage)
 	})
 
 	const taskIdUnknown = "unknown"
-	// Get task with id
-	webApp.Get("/tasks/:id", func(ctx *fiber.Ctx) error {
+	// Get task with id and all its subtasks
+	webApp.Get("/tasks/:id", RequireAuth, func(ctx *fiber.Ctx) error {
 		taskIdParam := ctx.Params("id", taskIdUnknown)
 		if taskIdParam == taskIdUnknown {
 			return ctx.SendStatus(fiber.StatusBadRequest)
@@ -168,15 +452,28 @@ func StartToDoServer() {
 			return fmt.Errorf("convert ID to string: %w", err)
 		}
 
-		task, err := storage.Read(taskId)
+		userID, _ := authUserID(ctx)
+		tree, err := storage.ReadTree(taskId, storage.Authorize(userID, taskAccessView))
+		if taskAccessError(err) {
+			return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
 		if err != nil {
 			return fmt.Errorf("read task with provided id: %w", err)
 		}
 
-		return ctx.JSON(GetTaskResponse{Task: task})
+		// Changes of subtasks bump versions of their ancestors,
+		// so the ETag of the task covers the subtree
+		if taskNotModified(ctx, tree.Task) {
+			return ctx.SendStatus(fiber.StatusNotModified)
+		}
+
+		return ctx.JSON(tree)
 	})
 
-	webApp.Patch("/tasks/:id", func(ctx *fiber.Ctx) error {
+	// Update task with JSON of PatchTaskRequest or with a merge patch or
+	// a JSON patch of the task document, only patches can clear fields.
+	// The owner, the assignee and users with edit permission can update it
+	webApp.Patch("/tasks/:id", RequireAuth, func(ctx *fiber.Ctx) error {
 		taskIdParam := ctx.Params("id", taskIdUnknown)
 		if taskIdParam == taskIdUnknown {
 			return ctx.SendStatus(fiber.StatusBadRequest)
@@ -187,20 +484,46 @@ func StartToDoServer() {
 			return fmt.Errorf("convert ID to string: %w", err)
 		}
 
-		var req PatchTaskRequest
-		if err := ctx.BodyParser(&req); err != nil {
-			return fmt.Errorf("body parser: %w", err)
-		}
+		userID, _ := authUserID(ctx)
+		check := taskChecks(storage.Authorize(userID, taskAccessEdit), taskIfMatch(ctx))
+
+		var updatedTask Task
+		if mediaType, ok := jsonpatch.MediaType(ctx.Get(fiber.HeaderContentType)); ok {
+			updatedTask, err = patchTask(storage, taskId, userID, check, mediaType, ctx.Body())
+		} else {
+			var req PatchTaskRequest
+			if err := ctx.BodyParser(&req); err != nil {
+				return fmt.Errorf("body parser: %w", err)
+			}
 
-		updatedTask, err := storage.Update(taskId, req)
+			updatedTask, err = storage.Update(taskId, userID, req, check)
+		}
+		if taskAccessError(err) {
+			return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if errors.Is(err, errTaskPrecondition) {
+			return ctx.Status(fiber.StatusPreconditionFailed).SendString(err.Error())
+		}
+		if status, ok := patchErrorStatus(err); ok {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		if taskValidationError(err) || taskRelationError(err) {
+			return ctx.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		}
+		if errors.Is(err, errTaskBlocked) {
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		}
 		if err != nil {
 			return fmt.Errorf("patch task with provided id: %w", err)
 		}
 
+		ctx.Set(fiber.HeaderETag, taskETag(updatedTask))
+
 		return ctx.JSON(PatchTaskResponse{updatedTask})
 	})
 
-	webApp.Delete("/tasks/:id", func(ctx *fiber.Ctx) error {
+	// Move task with its subtasks to the trash, owner only
+	webApp.Delete("/tasks/:id", RequireAuth, func(ctx *fiber.Ctx) error {
 		taskIdParam := ctx.Params("id", taskIdUnknown)
 		if taskIdParam == taskIdUnknown {
 			return ctx.SendStatus(fiber.StatusBadRequest)
@@ -211,13 +534,90 @@ func StartToDoServer() {
 			return fmt.Errorf("convert ID to string: %w", err)
 		}
 
-		if err := storage.Delete(taskId); err != nil {
+		userID, _ := authUserID(ctx)
+		err = storage.Delete(taskId, userID, taskChecks(storage.Authorize(userID, taskAccessOwner), taskIfMatch(ctx)))
+		if taskAccessError(err) {
+			return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if errors.Is(err, errTaskPrecondition) {
+			return ctx.Status(fiber.StatusPreconditionFailed).SendString(err.Error())
+		}
+		if err != nil {
 			return fmt.Errorf("delete task with provided id: %w", err)
 		}
 
 		return ctx.SendStatus(fiber.StatusOK)
 	})
 
+	webApp.Post("/tasks/:id/complete", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		return changeTaskStatus(ctx, func(id int64, now int64) (Task, error) {
+			return storage.Complete(id, userID, now, storage.Authorize(userID, taskAccessEdit))
+		})
+	})
+
+	webApp.Post("/tasks/:id/reopen", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		return changeTaskStatus(ctx, func(id int64, now int64) (Task, error) {
+			return storage.Reopen(id, userID, now, storage.Authorize(userID, taskAccessEdit))
+		})
+	})
+
+	registerTaskSharing(webApp, storage)
+	registerTaskHistory(webApp, storage)
+
+	// Get tags of tasks the user can view with numbers of tasks
+	webApp.Get("/tags", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		return ctx.JSON(ListTagsResponse{Tags: storage.TagCounts(userID)})
+	})
+
+	webApp.Post("/projects", RequireAuth, idempotency, func(ctx *fiber.Ctx) error {
+		var req CreateProjectRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return fmt.Errorf("body parser: %w", err)
+		}
+
+		userID, _ := authUserID(ctx)
+		id, err := storage.CreateProject(req.Name, userID)
+		if errors.Is(err, errProjectName) {
+			return ctx.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("create project in storage: %w", err)
+		}
+
+		return ctx.JSON(CreateProjectResponse{ID: id})
+	})
+
+	// Get projects of the user, tasks of a project are listed with GET /tasks?project_id=
+	webApp.Get("/projects", RequireAuth, func(ctx *fiber.Ctx) error {
+		userID, _ := authUserID(ctx)
+		return ctx.JSON(ListProjectsResponse{Projects: storage.ListProjects(userID)})
+	})
+
+	// Delete project, its tasks are kept without a project
+	webApp.Delete("/projects/:id", RequireAuth, func(ctx *fiber.Ctx) error {
+		projectId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid project ID")
+		}
+
+		userID, _ := authUserID(ctx)
+		err = storage.DeleteProject(projectId, userID)
+		if errors.Is(err, errProjectNotFound) {
+			return ctx.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
+		if errors.Is(err, errProjectForbidden) {
+			return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("delete project with provided id: %w", err)
+		}
+
+		return ctx.SendStatus(fiber.StatusOK)
+	})
+
 	port := "8080"
 	logrus.Fatal(webApp.Listen(":" + port))
 }
@@ -1,8 +1,17 @@
 package webserver
 
 import (
+	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/sirupsen/logrus"
@@ -10,38 +19,143 @@ import (
 
 type (
 	CreateLinkRequest struct {
+		// Custom alias, a random code is generated if empty
 		ExtLink string `json:"external"`
+		// Target URL
+		IntLink   string `json:"internal"`
+		Permanent bool   `json:"permanent"`
+		// Link is gone after this time, never if not set
+		ExpiresAt *time.Time `json:"expires_at"`
+		// Link is gone after this number of redirects, unlimited if zero
+		MaxClicks int64 `json:"max_clicks"`
+	}
+
+	CreateLinkResponse struct {
+		Code     string `json:"code"`
+		ShortURL string `json:"short_url"`
+		IntLink  string `json:"internal"`
+	}
+
+	// Only the target can be changed, the code is the identity of the link
+	UpdateLinkRequest struct {
 		IntLink string `json:"internal"`
 	}
 
+	LinkResponse struct {
+		Code      string     `json:"code"`
+		ShortURL  string     `json:"short_url"`
+		IntLink   string     `json:"internal"`
+		Permanent bool       `json:"permanent"`
+		CreatedAt time.Time  `json:"created_at"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		MaxClicks int64      `json:"max_clicks,omitempty"`
+		Clicks    int64      `json:"clicks"`
+		DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	}
+
+	ListLinksResponse struct {
+		Links      []LinkResponse `json:"links"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+	}
+
 	GetLinkResponse struct {
-		IntLink string `json:"internal"`
+		IntLink   string     `json:"internal"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		MaxClicks int64      `json:"max_clicks,omitempty"`
+		Clicks    int64      `json:"clicks"`
 	}
 )
 
+const (
+	shortCodeLength   = 7
+	shortCodeAttempts = 5
+
+	// Expired, exhausted and deleted links answer with 410 during this time,
+	// deleted ones can be restored, then they are purged with their stats
+	linkRetention     = 7 * 24 * time.Hour
+	linkSweepInterval = time.Minute
+
+	geoIPCSVPath = "geoip.csv"
+
+	defaultLinksPageSize = 50
+	maxLinksPageSize     = 100
+
+	// QR image sizes in pixels
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	qrMaxSize     = 2048
+)
+
 func StartURLExchangerServer() {
 	webApp := fiber.New()
 
+	port := "8080"
+	linkStorage := NewLinkStorage()
+	geoIP, err := LoadGeoIPCSV(geoIPCSVPath)
+	if err != nil {
+		logrus.WithError(err).Warn("GeoIP database is not loaded, countries of clicks are unknown")
+		geoIP = nil
+	}
+	blocklist, err := LoadDomainBlocklist(linkBlocklistPath)
+	if err != nil {
+		logrus.WithError(err).Warn("Domain blocklist is not loaded, all domains are allowed")
+	}
+	baseURL := "http://localhost:" + port
+	targetPolicy, err := NewLinkTargetPolicy(blocklist, ListenHosts(port)...)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	linkHandler := &LinkHandler{
-		storage: &LinkStorage{
-			links: make(map[string]string),
-		},
+		storage: linkStorage,
+		stats:   NewLinkStatsStorage(geoIP),
+		targets: targetPolicy,
+		baseURL: baseURL,
 	}
 
-	webApp.Post("/links", linkHandler.CreateLink)
+	// Codes of purged links can be taken again, their stats must go with them
+	go linkStorage.RunSweeper(linkSweepInterval, linkRetention, linkHandler.stats.Delete)
+
+	idempotency := NewIdempotencyMiddleware(NewIdempotencyStorage(idempotencyKeyTTL))
+
+	// Links are managed by their owners, resolving them is public
+	webApp.Get("/links", RequireAuth, linkHandler.ListLinks)
+	webApp.Post("/links", RequireAuth, idempotency, linkHandler.CreateLink)
+	webApp.Post("/links/batch", RequireAuth, idempotency, linkHandler.CreateLinksBatch)
 	webApp.Get("/links/:extLink", linkHandler.GetLink)
+	webApp.Patch("/links/:extLink", RequireAuth, linkHandler.UpdateLink)
+	webApp.Delete("/links/:extLink", RequireAuth, linkHandler.DeleteLink)
+	webApp.Post("/links/:extLink/restore", RequireAuth, linkHandler.RestoreLink)
+	webApp.Get("/links/:extLink/stats", RequireAuth, linkHandler.GetLinkStats)
+	webApp.Get("/links/:extLink/qr.:format", linkHandler.GetLinkQR)
+	// Must be the last route, it matches any single segment path
+	webApp.Get("/:code", linkHandler.Redirect)
 
-	port := "8080"
 	logrus.Fatal(webApp.Listen(":" + port))
 }
 
 type LinkCreatorGetter interface {
-	CreateLink(extLink, intLink string) error
-	GetLink(extLink string) (string, error)
+	CreateLink(link Link) error
+	GetLink(code string) (Link, error)
+	ListLinks(filter LinkFilter) ([]Link, string, error)
+	UpdateLinkTarget(code string, ownerID int64, target string) (Link, error)
+	ResolveLink(code string, now time.Time) (Link, error)
+	DeleteLink(code string, ownerID int64, now time.Time) error
+	RestoreLink(code string, ownerID int64) error
 }
 
 type LinkHandler struct {
 	storage LinkCreatorGetter
+	stats   *LinkStatsStorage
+	targets *LinkTargetPolicy
+	// Short URLs are built as baseURL + "/" + code
+	baseURL string
+}
+
+var aliasRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// Aliases which would be shadowed by other routes
+var reservedAliases = map[string]bool{
+	"links": true,
 }
 
 func (h *LinkHandler) CreateLink(c *fiber.Ctx) error {
@@ -50,48 +164,651 @@ func (h *LinkHandler) CreateLink(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
 	}
 
-	h.storage.CreateLink(req.ExtLink, req.IntLink)
+	userID, _ := authUserID(c)
+	link, err := h.createLink(req, userID, c.Hostname())
+	if status, ok := createLinkErrorStatus(err); ok {
+		return c.Status(status).SendString(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("link creation: %w", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(h.createLinkResponse(link))
+}
+
+var (
+	errLinkTargetRequired = errors.New("target link is required")
+	errLinkMaxClicks      = errors.New("max_clicks must not be negative")
+	errLinkExpiresAt      = errors.New("expires_at must be in the future")
+	errLinkAlias          = errors.New("alias must be 3-64 letters, digits, '_' or '-' and must not be reserved")
+)
+
+// createLink validates the request and stores the link of the user under
+// the alias or a generated code. requestHost is the host the request came to,
+// links back to it are rejected
+func (h *LinkHandler) createLink(req CreateLinkRequest, ownerID int64, requestHost string) (Link, error) {
+	if req.IntLink == "" {
+		return Link{}, errLinkTargetRequired
+	}
+
+	target, err := h.targets.Normalize(req.IntLink, requestHost)
+	if err != nil {
+		return Link{}, err
+	}
+
+	if req.MaxClicks < 0 {
+		return Link{}, errLinkMaxClicks
+	}
+
+	now := time.Now().UTC()
+	link := Link{
+		Code:      req.ExtLink,
+		OwnerID:   ownerID,
+		Target:    target,
+		Permanent: req.Permanent,
+		MaxClicks: req.MaxClicks,
+		CreatedAt: now,
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return Link{}, errLinkExpiresAt
+		}
+		link.ExpiresAt = req.ExpiresAt.UTC()
+	}
+
+	if link.Code == "" {
+		link.Code, err = h.createWithGeneratedCode(link)
+
+		return link, err
+	}
+
+	if !aliasRegexp.MatchString(link.Code) || reservedAliases[link.Code] {
+		return Link{}, errLinkAlias
+	}
+
+	return link, h.storage.CreateLink(link)
+}
+
+// createLinkErrorStatus returns the response status for errors caused by
+// the request, other errors are internal
+func createLinkErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, errLinkExists):
+		return fiber.StatusConflict, true
+	case errors.Is(err, errLinkNotFound):
+		return fiber.StatusNotFound, true
+	case errors.Is(err, errLinkForbidden):
+		return fiber.StatusForbidden, true
+	case errors.Is(err, errLinkGone):
+		return fiber.StatusGone, true
+	case errors.Is(err, errLinkTargetRequired), errors.Is(err, errLinkMaxClicks),
+		errors.Is(err, errLinkExpiresAt), errors.Is(err, errLinkAlias):
+		return fiber.StatusBadRequest, true
+	case errors.Is(err, errLinkTargetInvalid), errors.Is(err, errLinkTargetScheme),
+		errors.Is(err, errLinkTargetTooLong), errors.Is(err, errLinkTargetBlocked),
+		errors.Is(err, errLinkTargetShortener):
+		return linkTargetErrorStatus(err), true
+	default:
+		return 0, false
+	}
+}
+
+func (h *LinkHandler) createLinkResponse(link Link) CreateLinkResponse {
+	return CreateLinkResponse{
+		Code:     link.Code,
+		ShortURL: h.shortURL(link.Code),
+		IntLink:  link.Target,
+	}
+}
+
+func (h *LinkHandler) linkResponse(link Link) LinkResponse {
+	resp := LinkResponse{
+		Code:      link.Code,
+		ShortURL:  h.shortURL(link.Code),
+		IntLink:   link.Target,
+		Permanent: link.Permanent,
+		CreatedAt: link.CreatedAt,
+		MaxClicks: link.MaxClicks,
+		Clicks:    link.Clicks,
+	}
+	if !link.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &link.ExpiresAt
+	}
+	if link.deleted() {
+		resp.DeletedAt = &link.DeletedAt
+	}
 
-	return c.SendStatus(fiber.StatusOK)
+	return resp
+}
+
+func (h *LinkHandler) shortURL(code string) string {
+	return h.baseURL + "/" + code
+}
+
+// linkTargetErrorStatus maps rejected targets to responses: malformed URLs
+// are bad requests, well-formed but not allowed ones are unprocessable
+func linkTargetErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errLinkTargetBlocked), errors.Is(err, errLinkTargetShortener),
+		errors.Is(err, errLinkTargetScheme), errors.Is(err, errLinkTargetTooLong):
+		return fiber.StatusUnprocessableEntity
+	default:
+		return fiber.StatusBadRequest
+	}
+}
+
+// createWithGeneratedCode retries with a new random code if the generated one
+// is taken. With 62^7 codes collisions are rare, so a few attempts are enough
+func (h *LinkHandler) createWithGeneratedCode(link Link) (string, error) {
+	for i := 0; i < shortCodeAttempts; i++ {
+		code, err := generateShortCode(shortCodeLength)
+		if err != nil {
+			return "", fmt.Errorf("generate code: %w", err)
+		}
+
+		link.Code = code
+		err = h.storage.CreateLink(link)
+		if errors.Is(err, errLinkExists) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return code, nil
+	}
+
+	return "", errors.New("no free short code found")
+}
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func generateShortCode(length int) (string, error) {
+	code := make([]byte, length)
+	alphabetSize := big.NewInt(int64(len(base62Alphabet)))
+
+	for i := range code {
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code[i] = base62Alphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// linkCodeParam returns the unescaped code from the path. Fiber params point
+// into a buffer reused by later requests, so the code is copied before it can
+// end up in the storage
+func linkCodeParam(c *fiber.Ctx, name string) (string, error) {
+	code, err := url.QueryUnescape(c.Params(name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Clone(code), nil
 }
 
 func (h *LinkHandler) GetLink(c *fiber.Ctx) error {
-	extLink, err := url.QueryUnescape(c.Params("extLink"))
+	code, err := linkCodeParam(c, "extLink")
+	if err != nil {
+		return fmt.Errorf("link escaping: %w", err)
+	}
+
+	link, err := h.storage.GetLink(code)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Link not found")
+	}
+	if link.gone(time.Now()) {
+		return c.Status(fiber.StatusGone).SendString("Link is expired or deleted")
+	}
+
+	resp := GetLinkResponse{
+		IntLink:   link.Target,
+		MaxClicks: link.MaxClicks,
+		Clicks:    link.Clicks,
+	}
+	if !link.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &link.ExpiresAt
+	}
+
+	return c.JSON(resp)
+}
+
+// ListLinks returns links of the user sorted by code, including expired and
+// deleted ones. The q param searches codes and targets, case insensitive
+func (h *LinkHandler) ListLinks(c *fiber.Ctx) error {
+	userID, _ := authUserID(c)
+	filter := LinkFilter{
+		OwnerID: userID,
+		Query:   c.Query("q"),
+		Cursor:  c.Query("cursor"),
+		Limit:   c.QueryInt("limit", defaultLinksPageSize),
+	}
+	if filter.Limit < 1 || filter.Limit > maxLinksPageSize {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("limit must be between 1 and %d", maxLinksPageSize))
+	}
+
+	links, next, err := h.storage.ListLinks(filter)
+	if err != nil {
+		return fmt.Errorf("list links: %w", err)
+	}
+
+	resp := ListLinksResponse{Links: make([]LinkResponse, 0, len(links)), NextCursor: next}
+	for _, link := range links {
+		resp.Links = append(resp.Links, h.linkResponse(link))
+	}
+
+	return c.JSON(resp)
+}
+
+// UpdateLink changes the target of the link, only the owner can do it
+func (h *LinkHandler) UpdateLink(c *fiber.Ctx) error {
+	code, err := linkCodeParam(c, "extLink")
+	if err != nil {
+		return fmt.Errorf("link escaping: %w", err)
+	}
+
+	var req UpdateLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
+	}
+	if req.IntLink == "" {
+		return c.Status(fiber.StatusBadRequest).SendString(errLinkTargetRequired.Error())
+	}
+
+	target, err := h.targets.Normalize(req.IntLink, c.Hostname())
+	if err != nil {
+		return c.Status(linkTargetErrorStatus(err)).SendString(err.Error())
+	}
+
+	userID, _ := authUserID(c)
+	link, err := h.storage.UpdateLinkTarget(code, userID, target)
+	if status, ok := createLinkErrorStatus(err); ok {
+		return c.Status(status).SendString(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("update link: %w", err)
+	}
+
+	return c.JSON(h.linkResponse(link))
+}
+
+// GetLinkQR renders the short URL as a QR code in PNG or SVG. Query params
+// are size in pixels and ec, the error correction level L, M, Q or H
+func (h *LinkHandler) GetLinkQR(c *fiber.Ctx) error {
+	code, err := linkCodeParam(c, "extLink")
+	if err != nil {
+		return fmt.Errorf("link escaping: %w", err)
+	}
+
+	format := c.Params("format")
+	if format != "png" && format != "svg" {
+		return c.Status(fiber.StatusNotFound).SendString("QR code format must be png or svg")
+	}
+
+	size := c.QueryInt("size", qrDefaultSize)
+	if size < qrMinSize || size > qrMaxSize {
+		return c.Status(fiber.StatusBadRequest).
+			SendString(fmt.Sprintf("size must be between %d and %d", qrMinSize, qrMaxSize))
+	}
+
+	level, err := ParseQRErrorCorrection(c.Query("ec", "M"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("ec must be one of L, M, Q, H")
+	}
+
+	link, err := h.storage.GetLink(code)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Link not found")
+	}
+	if link.gone(time.Now()) {
+		return c.Status(fiber.StatusGone).SendString("Link is expired or deleted")
+	}
+
+	qr, err := EncodeQR([]byte(h.shortURL(link.Code)), level)
+	if err != nil {
+		return fmt.Errorf("encode QR: %w", err)
+	}
+
+	var buf bytes.Buffer
+	contentType := "image/svg+xml"
+	if format == "png" {
+		contentType = "image/png"
+		err = qr.WritePNG(&buf, size)
+	} else {
+		err = qr.WriteSVG(&buf, size)
+	}
+	if errors.Is(err, errQRSizeTooSmall) {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("render QR: %w", err)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+
+	return c.Send(buf.Bytes())
+}
+
+// DeleteLink soft deletes the link, it can be restored during the retention time
+func (h *LinkHandler) DeleteLink(c *fiber.Ctx) error {
+	code, err := linkCodeParam(c, "extLink")
+	if err != nil {
+		return fmt.Errorf("link escaping: %w", err)
+	}
+
+	userID, _ := authUserID(c)
+	err = h.storage.DeleteLink(code, userID, time.Now().UTC())
+	switch {
+	case errors.Is(err, errLinkNotFound):
+		return c.Status(fiber.StatusNotFound).SendString("Link not found")
+	case errors.Is(err, errLinkForbidden):
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	case err != nil:
+		return fmt.Errorf("delete link: %w", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *LinkHandler) RestoreLink(c *fiber.Ctx) error {
+	code, err := linkCodeParam(c, "extLink")
 	if err != nil {
 		return fmt.Errorf("link escaping: %w", err)
 	}
 
-	intLink, err := h.storage.GetLink(extLink)
+	userID, _ := authUserID(c)
+	err = h.storage.RestoreLink(code, userID)
+	switch {
+	case errors.Is(err, errLinkNotFound):
+		return c.Status(fiber.StatusNotFound).SendString("Link not found")
+	case errors.Is(err, errLinkForbidden):
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	case errors.Is(err, errLinkNotDeleted):
+		return c.Status(fiber.StatusConflict).SendString("Link is not deleted")
+	case err != nil:
+		return fmt.Errorf("restore link: %w", err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Redirect sends the client to the target of the short link
+func (h *LinkHandler) Redirect(c *fiber.Ctx) error {
+	link, err := h.storage.ResolveLink(strings.Clone(c.Params("code")), time.Now())
+	if errors.Is(err, errLinkGone) {
+		return c.Status(fiber.StatusGone).SendString("Link is expired or deleted")
+	}
 	if err != nil {
 		return c.Status(fiber.StatusNotFound).SendString("Link not found")
 	}
 
-	return c.JSON(GetLinkResponse{IntLink: intLink})
+	h.recordClick(c, link.Code)
+
+	status := fiber.StatusFound
+	if link.Permanent {
+		status = fiber.StatusMovedPermanently
+	}
+
+	return c.Redirect(link.Target, status)
+}
+
+// Link model
+type Link struct {
+	Code    string
+	OwnerID int64
+	Target  string
+	// Permanent links are redirected with 301, which browsers cache,
+	// others with 302
+	Permanent bool
+	CreatedAt time.Time
+	// Zero values mean no expiration time and no clicks limit
+	ExpiresAt time.Time
+	MaxClicks int64
+	Clicks    int64
+	// Set when the last allowed click is made
+	ExhaustedAt time.Time
+	// Set when the link is soft deleted
+	DeletedAt time.Time
+}
+
+func (l Link) expired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+func (l Link) exhausted() bool {
+	return l.MaxClicks > 0 && l.Clicks >= l.MaxClicks
+}
+
+func (l Link) deleted() bool {
+	return !l.DeletedAt.IsZero()
+}
+
+// Gone links are kept for a while but can't be used
+func (l Link) gone(now time.Time) bool {
+	return l.deleted() || l.expired(now) || l.exhausted()
+}
+
+// LinkFilter selects links of the owner. Cursor is the code
+// of the last link of the previous page
+type LinkFilter struct {
+	OwnerID int64
+	Query   string
+	Cursor  string
+	Limit   int
 }
 
 // Storage
 type LinkStorage struct {
-	links map[string]string
+	mu    sync.Mutex
+	links map[string]Link
+	// Sorted codes of links of every owner
+	byOwner map[int64][]string
 }
 
-var errLinkNotCreated = "link not created"
+func NewLinkStorage() *LinkStorage {
+	return &LinkStorage{
+		links:   make(map[string]Link),
+		byOwner: make(map[int64][]string),
+	}
+}
 
-func (ls *LinkStorage) CreateLink(extLink, intLink string) error {
-	ls.links[extLink] = intLink
-	if ls.links[extLink] != intLink {
-		return fmt.Errorf(errLinkNotCreated)
+var (
+	errLinkExists     = errors.New("alias is already taken")
+	errLinkNotFound   = errors.New("link not found")
+	errLinkGone       = errors.New("link is expired or deleted")
+	errLinkNotDeleted = errors.New("link is not deleted")
+	errLinkForbidden  = errors.New("link belongs to another user")
+)
+
+func (ls *LinkStorage) CreateLink(link Link) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if _, exists := ls.links[link.Code]; exists {
+		return errLinkExists
 	}
+	ls.links[link.Code] = link
+
+	codes := ls.byOwner[link.OwnerID]
+	i, _ := slices.BinarySearch(codes, link.Code)
+	ls.byOwner[link.OwnerID] = slices.Insert(codes, i, link.Code)
 
 	return nil
 }
 
-var errInternalLinkNotFound = "internal link not found"
+func (ls *LinkStorage) ListLinks(filter LinkFilter) ([]Link, string, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	codes := ls.byOwner[filter.OwnerID]
+	start := 0
+	if filter.Cursor != "" {
+		var found bool
+		if start, found = slices.BinarySearch(codes, filter.Cursor); found {
+			start++
+		}
+	}
+	query := strings.ToLower(filter.Query)
+
+	links := make([]Link, 0, filter.Limit)
+	for _, code := range codes[start:] {
+		link := ls.links[code]
+		if query != "" && !strings.Contains(strings.ToLower(link.Code), query) &&
+			!strings.Contains(strings.ToLower(link.Target), query) {
+			continue
+		}
+
+		// One more match means there is a next page
+		if len(links) == filter.Limit {
+			return links, links[len(links)-1].Code, nil
+		}
+		links = append(links, link)
+	}
+
+	return links, "", nil
+}
 
-func (ls *LinkStorage) GetLink(extLink string) (string, error) {
-	intLink, ok := ls.links[extLink]
+// ownedLink must be called with ls.mu held
+func (ls *LinkStorage) ownedLink(code string, ownerID int64) (Link, error) {
+	link, ok := ls.links[code]
 	if !ok {
-		return "", fmt.Errorf(errInternalLinkNotFound)
+		return Link{}, errLinkNotFound
 	}
+	if link.OwnerID != ownerID {
+		return Link{}, errLinkForbidden
+	}
+
+	return link, nil
+}
+
+func (ls *LinkStorage) UpdateLinkTarget(code string, ownerID int64, target string) (Link, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
 
-	return intLink, nil
+	link, err := ls.ownedLink(code, ownerID)
+	if err != nil {
+		return Link{}, err
+	}
+	if link.deleted() {
+		return Link{}, errLinkGone
+	}
+
+	link.Target = target
+	ls.links[code] = link
+
+	return link, nil
+}
+
+func (ls *LinkStorage) GetLink(code string) (Link, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	link, ok := ls.links[code]
+	if !ok {
+		return Link{}, errLinkNotFound
+	}
+
+	return link, nil
+}
+
+// ResolveLink counts a click of the link unless it's gone
+func (ls *LinkStorage) ResolveLink(code string, now time.Time) (Link, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	link, ok := ls.links[code]
+	if !ok {
+		return Link{}, errLinkNotFound
+	}
+	if link.gone(now) {
+		return Link{}, errLinkGone
+	}
+
+	link.Clicks++
+	if link.exhausted() {
+		link.ExhaustedAt = now
+	}
+	ls.links[code] = link
+
+	return link, nil
+}
+
+func (ls *LinkStorage) DeleteLink(code string, ownerID int64, now time.Time) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	link, err := ls.ownedLink(code, ownerID)
+	if err != nil {
+		return err
+	}
+	if link.deleted() {
+		return nil
+	}
+
+	link.DeletedAt = now
+	ls.links[code] = link
+
+	return nil
+}
+
+func (ls *LinkStorage) RestoreLink(code string, ownerID int64) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	link, err := ls.ownedLink(code, ownerID)
+	if err != nil {
+		return err
+	}
+	if !link.deleted() {
+		return errLinkNotDeleted
+	}
+
+	link.DeletedAt = time.Time{}
+	ls.links[code] = link
+
+	return nil
+}
+
+// PurgeLinks removes links expired, exhausted or deleted more than
+// retention ago and returns their codes
+func (ls *LinkStorage) PurgeLinks(now time.Time, retention time.Duration) []string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	purgeBefore := now.Add(-retention)
+	purged := make([]string, 0)
+	for code, link := range ls.links {
+		expiredLongAgo := link.expired(purgeBefore)
+		exhaustedLongAgo := link.exhausted() && link.ExhaustedAt.Before(purgeBefore)
+		deletedLongAgo := link.deleted() && link.DeletedAt.Before(purgeBefore)
+		if expiredLongAgo || exhaustedLongAgo || deletedLongAgo {
+			delete(ls.links, code)
+			codes := ls.byOwner[link.OwnerID]
+			if i, found := slices.BinarySearch(codes, code); found {
+				ls.byOwner[link.OwnerID] = slices.Delete(codes, i, i+1)
+			}
+			purged = append(purged, code)
+		}
+	}
+
+	return purged
+}
+
+// RunSweeper purges old links every interval and calls onPurge
+// for their codes. It never returns
+func (ls *LinkStorage) RunSweeper(interval, retention time.Duration, onPurge func(code string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		purged := ls.PurgeLinks(now, retention)
+		for _, code := range purged {
+			onPurge(code)
+		}
+		if len(purged) > 0 {
+			logrus.WithField("purged", len(purged)).Info("expired links purged")
+		}
+	}
 }
@@ -0,0 +1,691 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	headerWebhookID        = "X-Webhook-ID"
+	headerWebhookEvent     = "X-Webhook-Event"
+	headerWebhookSignature = "X-Webhook-Signature"
+
+	webhookEventsAll = "*"
+
+	// Deliveries kept in the log of every subscription
+	webhookDeliveryLogSize = 100
+)
+
+var webhookEventTypes = []string{webhookEventsAll, OrderEventCreated, OrderEventStatusChanged}
+
+// Webhook models
+type (
+	// Subscriptions get events of orders of their owner
+	WebhookSubscription struct {
+		ID         string
+		OwnerID    int64
+		URL        string
+		Secret     string
+		EventTypes []string
+		CreatedAt  time.Time
+	}
+
+	WebhookDeliveryStatus string
+
+	WebhookDelivery struct {
+		ID             string
+		SubscriptionID string
+		EventID        string
+		EventType      string
+		Payload        []byte
+		Status         WebhookDeliveryStatus
+		Attempts       []WebhookAttempt
+		NextAttemptAt  time.Time
+		CreatedAt      time.Time
+	}
+
+	WebhookAttempt struct {
+		At         time.Time
+		StatusCode int
+		Error      string
+		Duration   time.Duration
+	}
+)
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+func (s WebhookSubscription) wants(eventType string) bool {
+	return slices.Contains(s.EventTypes, webhookEventsAll) || slices.Contains(s.EventTypes, eventType)
+}
+
+type (
+	CreateWebhookRequest struct {
+		URL string `json:"url" validate:"required,http_url,max=2048"`
+		// Generated if empty
+		Secret     string   `json:"secret" validate:"omitempty,min=16,max=256"`
+		EventTypes []string `json:"event_types" validate:"required,min=1,dive,webhook_event_type"`
+	}
+
+	// Secret is returned only once, on creation
+	CreateWebhookResponse struct {
+		WebhookResponse
+		Secret string `json:"secret"`
+	}
+
+	WebhookResponse struct {
+		ID         string    `json:"id"`
+		URL        string    `json:"url"`
+		EventTypes []string  `json:"event_types"`
+		CreatedAt  time.Time `json:"created_at"`
+	}
+
+	ListWebhooksResponse struct {
+		Webhooks []WebhookResponse `json:"webhooks"`
+	}
+
+	WebhookDeliveryResponse struct {
+		ID            string                   `json:"id"`
+		EventID       string                   `json:"event_id"`
+		EventType     string                   `json:"event_type"`
+		Status        WebhookDeliveryStatus    `json:"status"`
+		Attempts      []WebhookAttemptResponse `json:"attempts"`
+		NextAttemptAt *time.Time               `json:"next_attempt_at,omitempty"`
+		CreatedAt     time.Time                `json:"created_at"`
+	}
+
+	WebhookAttemptResponse struct {
+		At         time.Time `json:"at"`
+		StatusCode int       `json:"status_code,omitempty"`
+		Error      string    `json:"error,omitempty"`
+		DurationMs int64     `json:"duration_ms"`
+	}
+
+	ListWebhookDeliveriesResponse struct {
+		Deliveries []WebhookDeliveryResponse `json:"deliveries"`
+	}
+
+	// Body of the request sent to subscribers
+	WebhookEventPayload struct {
+		ID         string           `json:"id"`
+		Type       string           `json:"type"`
+		OccurredAt time.Time        `json:"occurred_at"`
+		Data       GetOrderResponse `json:"data"`
+	}
+)
+
+func newWebhookResponse(sub WebhookSubscription) WebhookResponse {
+	return WebhookResponse{
+		ID:         sub.ID,
+		URL:        sub.URL,
+		EventTypes: sub.EventTypes,
+		CreatedAt:  sub.CreatedAt,
+	}
+}
+
+func newWebhookDeliveryResponse(delivery WebhookDelivery) WebhookDeliveryResponse {
+	resp := WebhookDeliveryResponse{
+		ID:        delivery.ID,
+		EventID:   delivery.EventID,
+		EventType: delivery.EventType,
+		Status:    delivery.Status,
+		Attempts:  make([]WebhookAttemptResponse, 0, len(delivery.Attempts)),
+		CreatedAt: delivery.CreatedAt,
+	}
+	for _, attempt := range delivery.Attempts {
+		resp.Attempts = append(resp.Attempts, WebhookAttemptResponse{
+			At:         attempt.At,
+			StatusCode: attempt.StatusCode,
+			Error:      attempt.Error,
+			DurationMs: attempt.Duration.Milliseconds(),
+		})
+	}
+	if delivery.Status == WebhookDeliveryPending {
+		resp.NextAttemptAt = &delivery.NextAttemptAt
+	}
+
+	return resp
+}
+
+type WebhookHandler struct {
+	storage  *WebhookStorage
+	validate *validator.Validate
+}
+
+func NewWebhookHandler(storage *WebhookStorage, validate *validator.Validate) (*WebhookHandler, error) {
+	err := validate.RegisterValidation("webhook_event_type", func(fl validator.FieldLevel) bool {
+		return slices.Contains(webhookEventTypes, fl.Field().String())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("register validation: %w", err)
+	}
+
+	return &WebhookHandler{storage: storage, validate: validate}, nil
+}
+
+func (h *WebhookHandler) CreateWebhook(c *fiber.Ctx) error {
+	var req CreateWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid JSON")
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+	if err := checkWebhookURL(c.UserContext(), req.URL); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	userID, _ := authUserID(c)
+	secret := req.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return fmt.Errorf("generate webhook secret: %w", err)
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	sub := h.storage.CreateSubscription(WebhookSubscription{
+		ID:         uuid.NewString(),
+		OwnerID:    userID,
+		URL:        req.URL,
+		Secret:     secret,
+		EventTypes: req.EventTypes,
+		CreatedAt:  time.Now().UTC(),
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(CreateWebhookResponse{
+		WebhookResponse: newWebhookResponse(sub),
+		Secret:          sub.Secret,
+	})
+}
+
+func (h *WebhookHandler) ListWebhooks(c *fiber.Ctx) error {
+	userID, _ := authUserID(c)
+	subs := h.storage.ListSubscriptions(userID)
+
+	resp := ListWebhooksResponse{Webhooks: make([]WebhookResponse, 0, len(subs))}
+	for _, sub := range subs {
+		resp.Webhooks = append(resp.Webhooks, newWebhookResponse(sub))
+	}
+
+	return c.JSON(resp)
+}
+
+func (h *WebhookHandler) GetWebhook(c *fiber.Ctx) error {
+	userID, _ := authUserID(c)
+	sub, err := h.storage.GetSubscription(c.Params("id"), userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Webhook not found")
+	}
+
+	return c.JSON(newWebhookResponse(sub))
+}
+
+func (h *WebhookHandler) DeleteWebhook(c *fiber.Ctx) error {
+	userID, _ := authUserID(c)
+	if err := h.storage.DeleteSubscription(c.Params("id"), userID); err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Webhook not found")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListWebhookDeliveries returns the delivery log of a subscription, newest first
+func (h *WebhookHandler) ListWebhookDeliveries(c *fiber.Ctx) error {
+	userID, _ := authUserID(c)
+	deliveries, err := h.storage.ListDeliveries(c.Params("id"), userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Webhook not found")
+	}
+
+	resp := ListWebhookDeliveriesResponse{Deliveries: make([]WebhookDeliveryResponse, 0, len(deliveries))}
+	for _, delivery := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, newWebhookDeliveryResponse(delivery))
+	}
+
+	return c.JSON(resp)
+}
+
+// registerWebhooks adds webhook routes, users manage only their own subscriptions
+func registerWebhooks(webApp *fiber.App, handler *WebhookHandler) {
+	webhookGroup := webApp.Group("/webhooks", RequireAuth)
+	webhookGroup.Post("", handler.CreateWebhook)
+	webhookGroup.Get("", handler.ListWebhooks)
+	webhookGroup.Get("/:id", handler.GetWebhook)
+	webhookGroup.Delete("/:id", handler.DeleteWebhook)
+	webhookGroup.Get("/:id/deliveries", handler.ListWebhookDeliveries)
+}
+
+// Storage
+type WebhookStorage struct {
+	mu            sync.Mutex
+	subscriptions map[string]WebhookSubscription
+	deliveries    map[string]*WebhookDelivery
+	// Delivery IDs of every subscription in creation order
+	log map[string][]string
+}
+
+func NewWebhookStorage() *WebhookStorage {
+	return &WebhookStorage{
+		subscriptions: make(map[string]WebhookSubscription),
+		deliveries:    make(map[string]*WebhookDelivery),
+		log:           make(map[string][]string),
+	}
+}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+func (s *WebhookStorage) CreateSubscription(sub WebhookSubscription) WebhookSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscriptions[sub.ID] = sub
+
+	return sub
+}
+
+func (s *WebhookStorage) ListSubscriptions(ownerID int64) []WebhookSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := make([]WebhookSubscription, 0)
+	for _, sub := range s.subscriptions {
+		if sub.OwnerID == ownerID {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+
+	return subs
+}
+
+// Subscriptions of other users are not found
+func (s *WebhookStorage) GetSubscription(subID string, ownerID int64) (WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscriptions[subID]
+	if !ok || sub.OwnerID != ownerID {
+		return WebhookSubscription{}, errWebhookNotFound
+	}
+
+	return sub, nil
+}
+
+// DeleteSubscription drops the subscription together with its
+// delivery log and not yet delivered events
+func (s *WebhookStorage) DeleteSubscription(subID string, ownerID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sub, ok := s.subscriptions[subID]; !ok || sub.OwnerID != ownerID {
+		return errWebhookNotFound
+	}
+
+	for _, deliveryID := range s.log[subID] {
+		delete(s.deliveries, deliveryID)
+	}
+	delete(s.log, subID)
+	delete(s.subscriptions, subID)
+
+	return nil
+}
+
+func (s *WebhookStorage) ListDeliveries(subID string, ownerID int64) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sub, ok := s.subscriptions[subID]; !ok || sub.OwnerID != ownerID {
+		return nil, errWebhookNotFound
+	}
+
+	deliveryIDs := s.log[subID]
+	deliveries := make([]WebhookDelivery, 0, len(deliveryIDs))
+	for i := len(deliveryIDs) - 1; i >= 0; i-- {
+		delivery := *s.deliveries[deliveryIDs[i]]
+		delivery.Attempts = slices.Clone(delivery.Attempts)
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// enqueue creates deliveries of the event to interested subscriptions
+// of the order owner
+func (s *WebhookStorage) enqueue(event OrderEvent, payload []byte, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subscriptions {
+		if sub.OwnerID != event.Order.UserID || !sub.wants(event.Type) {
+			continue
+		}
+
+		delivery := &WebhookDelivery{
+			ID:             uuid.NewString(),
+			SubscriptionID: sub.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        payload,
+			Status:         WebhookDeliveryPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		}
+		s.deliveries[delivery.ID] = delivery
+		s.log[sub.ID] = append(s.log[sub.ID], delivery.ID)
+		s.trimLog(sub.ID)
+	}
+}
+
+// trimLog drops the oldest finished deliveries above the log size.
+// Must be called with s.mu held
+func (s *WebhookStorage) trimLog(subID string) {
+	deliveryIDs := s.log[subID]
+	for i := 0; len(deliveryIDs) > webhookDeliveryLogSize && i < len(deliveryIDs); {
+		if s.deliveries[deliveryIDs[i]].Status == WebhookDeliveryPending {
+			i++
+			continue
+		}
+		delete(s.deliveries, deliveryIDs[i])
+		deliveryIDs = slices.Delete(deliveryIDs, i, i+1)
+	}
+	s.log[subID] = deliveryIDs
+}
+
+// Delivery ready to be sent with the subscription data it needs
+type webhookSendJob struct {
+	deliveryID string
+	url        string
+	secret     string
+	eventType  string
+	payload    []byte
+}
+
+// due returns pending deliveries whose next attempt time has come
+func (s *WebhookStorage) due(now time.Time) []webhookSendJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]webhookSendJob, 0)
+	for _, delivery := range s.deliveries {
+		if delivery.Status != WebhookDeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		sub := s.subscriptions[delivery.SubscriptionID]
+		jobs = append(jobs, webhookSendJob{
+			deliveryID: delivery.ID,
+			url:        sub.URL,
+			secret:     sub.Secret,
+			eventType:  delivery.EventType,
+			payload:    delivery.Payload,
+		})
+	}
+
+	return jobs
+}
+
+// recordAttempt logs the attempt and schedules a retry if it failed
+func (s *WebhookStorage) recordAttempt(deliveryID string, attempt WebhookAttempt, succeeded bool, policy WebhookRetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Subscription might be deleted while the request was in flight
+	delivery, ok := s.deliveries[deliveryID]
+	if !ok {
+		return
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	switch {
+	case succeeded:
+		delivery.Status = WebhookDeliverySucceeded
+	case len(delivery.Attempts) >= policy.MaxAttempts:
+		delivery.Status = WebhookDeliveryFailed
+	default:
+		delivery.NextAttemptAt = attempt.At.Add(policy.backoff(len(delivery.Attempts)))
+	}
+}
+
+type WebhookRetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var defaultWebhookRetryPolicy = WebhookRetryPolicy{
+	MaxAttempts:    8,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Hour,
+}
+
+// backoff returns delay before the next attempt after the given number
+// of failed ones: InitialBackoff doubled after every attempt
+func (p WebhookRetryPolicy) backoff(failedAttempts int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < failedAttempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, p.MaxBackoff)
+}
+
+type OrderEventOutbox interface {
+	PeekOutbox(limit int) []OrderEvent
+	AckOutbox(count int)
+}
+
+// WebhookDispatcher moves order events from the outbox to webhook
+// deliveries and sends them to subscribers
+type WebhookDispatcher struct {
+	outbox  OrderEventOutbox
+	storage *WebhookStorage
+	client  *http.Client
+	policy  WebhookRetryPolicy
+}
+
+func NewWebhookDispatcher(outbox OrderEventOutbox, storage *WebhookStorage, client *http.Client, policy WebhookRetryPolicy) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		outbox:  outbox,
+		storage: storage,
+		client:  client,
+		policy:  policy,
+	}
+}
+
+const (
+	webhookOutboxBatchSize = 100
+	webhookMaxParallelSend = 8
+)
+
+// Run dispatches events every interval. It never returns
+func (d *WebhookDispatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		d.DispatchOnce(now)
+	}
+}
+
+// DispatchOnce drains the outbox and makes one attempt for every due delivery
+func (d *WebhookDispatcher) DispatchOnce(now time.Time) {
+	for {
+		events := d.outbox.PeekOutbox(webhookOutboxBatchSize)
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			payload, err := json.Marshal(WebhookEventPayload{
+				ID:         event.ID,
+				Type:       event.Type,
+				OccurredAt: event.OccurredAt,
+				Data:       newGetOrderResponse(event.Order),
+			})
+			if err != nil {
+				logrus.WithError(err).WithField("event_id", event.ID).Error("marshal webhook payload")
+				continue
+			}
+			d.storage.enqueue(event, payload, now)
+		}
+		d.outbox.AckOutbox(len(events))
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, webhookMaxParallelSend)
+	for _, job := range d.storage.due(now) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job webhookSendJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			attempt := d.send(job)
+			succeeded := attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300
+			d.storage.recordAttempt(job.deliveryID, attempt, succeeded, d.policy)
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (d *WebhookDispatcher) send(job webhookSendJob) WebhookAttempt {
+	start := time.Now()
+	attempt := WebhookAttempt{At: start.UTC()}
+
+	req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(job.payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(headerWebhookID, job.deliveryID)
+	req.Header.Set(headerWebhookEvent, job.eventType)
+	req.Header.Set(headerWebhookSignature, SignWebhookPayload(job.secret, start, job.payload))
+
+	resp, err := d.client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	attempt.StatusCode = resp.StatusCode
+
+	return attempt
+}
+
+var errWebhookURLNotPublic = errors.New("webhook URL must point to a public address")
+
+// Shared address space of carrier-grade NATs (RFC 6598)
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether the address is on the internet. Subscribers
+// mustn't make the server call itself or services of its private network
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// checkWebhookURL rejects URLs whose host is or resolves to an address
+// which isn't public
+func checkWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("parse webhook URL: %w", err)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("resolve webhook host: %w", err)
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return errWebhookURLNotPublic
+		}
+	}
+
+	return nil
+}
+
+// NewWebhookHTTPClient returns the client for deliveries. It connects only
+// to public addresses, since hosts may resolve differently than when the
+// subscription was checked. Proxies aren't used for the same reason
+func NewWebhookHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return errWebhookURLNotPublic
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// SignWebhookPayload returns the signature header value "t=<unix>,v1=<hex>",
+// where v1 is HMAC-SHA256 of "<unix>.<payload>" with the subscription secret.
+// Timestamp lets receivers reject replayed requests
+func SignWebhookPayload(secret string, at time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature header produced by SignWebhookPayload
+func VerifyWebhookSignature(secret, header string, payload []byte) bool {
+	timestampPart, _, _ := strings.Cut(header, ",")
+	timestamp, err := strconv.ParseInt(strings.TrimPrefix(timestampPart, "t="), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	expected := SignWebhookPayload(secret, time.Unix(timestamp, 0), payload)
+
+	return hmac.Equal([]byte(expected), []byte(header))
+}
@@ -0,0 +1,321 @@
+package webserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testOutbox is an outbox with fixed events
+type testOutbox struct {
+	mu     sync.Mutex
+	events []OrderEvent
+}
+
+func (o *testOutbox) PeekOutbox(limit int) []OrderEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]OrderEvent(nil), o.events[:min(limit, len(o.events))]...)
+}
+
+func (o *testOutbox) AckOutbox(count int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = o.events[min(count, len(o.events)):]
+}
+
+// webhookReceiver is a subscriber which answers with the next status code
+// of its list, the last one is repeated
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rcv.t.Errorf("read webhook body: %v", err)
+	}
+	if !VerifyWebhookSignature(rcv.secret, r.Header.Get(headerWebhookSignature), body) {
+		rcv.t.Errorf("invalid webhook signature %q", r.Header.Get(headerWebhookSignature))
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	status := rcv.statuses[min(len(rcv.requests), len(rcv.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func (rcv *webhookReceiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	return len(rcv.requests)
+}
+
+func newWebhookTest(t *testing.T, policy WebhookRetryPolicy, statuses ...int) (*WebhookDispatcher, *WebhookStorage, *webhookReceiver, WebhookSubscription) {
+	t.Helper()
+
+	receiver := &webhookReceiver{t: t, secret: "0123456789abcdef0123", statuses: statuses}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	storage := NewWebhookStorage()
+	sub := storage.CreateSubscription(WebhookSubscription{
+		ID:         "sub-1",
+		OwnerID:    1,
+		URL:        server.URL,
+		Secret:     receiver.secret,
+		EventTypes: []string{webhookEventsAll},
+		CreatedAt:  time.Now(),
+	})
+	// Events of other users' orders don't reach the subscription
+	storage.CreateSubscription(WebhookSubscription{
+		ID:         "sub-2",
+		OwnerID:    2,
+		URL:        server.URL,
+		Secret:     receiver.secret,
+		EventTypes: []string{webhookEventsAll},
+		CreatedAt:  time.Now(),
+	})
+
+	outbox := &testOutbox{events: []OrderEvent{{
+		ID:         "event-1",
+		Type:       OrderEventCreated,
+		OccurredAt: time.Now().UTC(),
+		Order:      Order{ID: "order-1", UserID: 1, Status: OrderStatusPending},
+	}}}
+	// The test server listens on the loopback, so the plain client is used
+	dispatcher := NewWebhookDispatcher(outbox, storage, server.Client(), policy)
+
+	return dispatcher, storage, receiver, sub
+}
+
+func TestWebhookDispatcherRetriesWithBackoff(t *testing.T) {
+	policy := WebhookRetryPolicy{MaxAttempts: 5, InitialBackoff: time.Minute, MaxBackoff: 3 * time.Minute}
+	dispatcher, storage, receiver, sub := newWebhookTest(t, policy,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusNoContent)
+
+	// Attempts are due only after the backoff from the previous one
+	dispatcher.DispatchOnce(time.Now())
+	for i, wantBackoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		deliveries, err := storage.ListDeliveries(sub.ID, sub.OwnerID)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("deliveries: %v, %v", deliveries, err)
+		}
+		delivery := deliveries[0]
+		if delivery.Status != WebhookDeliveryPending || len(delivery.Attempts) != i+1 {
+			t.Fatalf("after %d attempts: status %s, %d attempts", i+1, delivery.Status, len(delivery.Attempts))
+		}
+		last := delivery.Attempts[i].At
+		if got := delivery.NextAttemptAt.Sub(last); got != wantBackoff {
+			t.Errorf("backoff after %d attempts: got %s, want %s", i+1, got, wantBackoff)
+		}
+
+		dispatcher.DispatchOnce(last.Add(wantBackoff - time.Second))
+		if got := receiver.count(); got != i+1 {
+			t.Fatalf("attempt before the backoff passed: %d requests, want %d", got, i+1)
+		}
+		dispatcher.DispatchOnce(last.Add(wantBackoff))
+	}
+
+	deliveries, _ := storage.ListDeliveries(sub.ID, sub.OwnerID)
+	delivery := deliveries[0]
+	if delivery.Status != WebhookDeliverySucceeded {
+		t.Fatalf("status %s, want %s", delivery.Status, WebhookDeliverySucceeded)
+	}
+	wantCodes := []int{500, 502, 503, 204}
+	if len(delivery.Attempts) != len(wantCodes) {
+		t.Fatalf("%d attempts, want %d", len(delivery.Attempts), len(wantCodes))
+	}
+	for i, attempt := range delivery.Attempts {
+		if attempt.StatusCode != wantCodes[i] || attempt.Error != "" {
+			t.Errorf("attempt %d: status %d, error %q, want %d", i+1, attempt.StatusCode, attempt.Error, wantCodes[i])
+		}
+	}
+
+	// Nothing is sent after the success, and every attempt was the same delivery
+	dispatcher.DispatchOnce(time.Now().Add(time.Hour))
+	if got := receiver.count(); got != len(wantCodes) {
+		t.Fatalf("%d requests, want %d", got, len(wantCodes))
+	}
+	for i, r := range receiver.requests {
+		if r.Header.Get(headerWebhookID) != delivery.ID || r.Header.Get(headerWebhookEvent) != OrderEventCreated {
+			t.Errorf("request %d headers: %v", i+1, r.Header)
+		}
+		var payload WebhookEventPayload
+		if err := json.Unmarshal(receiver.bodies[i], &payload); err != nil {
+			t.Fatalf("request %d body: %v", i+1, err)
+		}
+		if payload.ID != "event-1" || payload.Type != OrderEventCreated || payload.Data.ID != "order-1" {
+			t.Errorf("request %d payload: %+v", i+1, payload)
+		}
+	}
+
+	if other, _ := storage.ListDeliveries("sub-2", 2); len(other) != 0 {
+		t.Errorf("subscription of another user got %d deliveries", len(other))
+	}
+}
+
+func TestWebhookDispatcherGivesUp(t *testing.T) {
+	policy := WebhookRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Second}
+	dispatcher, storage, receiver, sub := newWebhookTest(t, policy, http.StatusInternalServerError)
+
+	now := time.Now()
+	for i := 0; i < policy.MaxAttempts+2; i++ {
+		dispatcher.DispatchOnce(now)
+		now = now.Add(time.Hour)
+	}
+
+	if got := receiver.count(); got != policy.MaxAttempts {
+		t.Fatalf("%d requests, want %d", got, policy.MaxAttempts)
+	}
+	deliveries, _ := storage.ListDeliveries(sub.ID, sub.OwnerID)
+	if len(deliveries) != 1 || deliveries[0].Status != WebhookDeliveryFailed {
+		t.Fatalf("deliveries: %+v", deliveries)
+	}
+	if resp := newWebhookDeliveryResponse(deliveries[0]); resp.NextAttemptAt != nil || len(resp.Attempts) != policy.MaxAttempts {
+		t.Errorf("delivery response: %+v", resp)
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	payload := []byte(`{"id":"event-1"}`)
+
+	// HMAC-SHA256 of "1700000000.{"id":"event-1"}" with the key "secret"
+	signature := SignWebhookPayload("secret", at, payload)
+	if want := "t=1700000000,v1=01017e2b3bf7b2f3c53c64a662fb4ee9c60a8a998e81d1b19dcfd0aa2de23880"; signature != want {
+		t.Fatalf("got %q, want %q", signature, want)
+	}
+	if !VerifyWebhookSignature("secret", signature, payload) {
+		t.Error("valid signature is rejected")
+	}
+	if VerifyWebhookSignature("other secret", signature, payload) {
+		t.Error("signature with another secret is accepted")
+	}
+	if VerifyWebhookSignature("secret", signature, []byte(`{"id":"event-2"}`)) {
+		t.Error("signature of another payload is accepted")
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	webApp := fiber.New()
+	handler, err := NewWebhookHandler(NewWebhookStorage(), validator.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerWebhooks(webApp, handler)
+
+	token := func(userID int64) string {
+		payload := jwt.MapClaims{"sub": "user@example.com", "uid": userID, "exp": time.Now().Add(time.Hour).Unix()}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, payload).SignedString([]byte("secret-phrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	request := func(method, path, body, token string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		}
+		resp, err := webApp.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/webhooks", "/webhooks/sub-1", "/webhooks/sub-1/deliveries"} {
+		if status := request(http.MethodGet, path, "", ""); status != fiber.StatusUnauthorized {
+			t.Errorf("GET %s without a token: %d", path, status)
+		}
+	}
+	if status := request(http.MethodPost, "/webhooks", `{"url":"https://example.com/hook","event_types":["*"]}`, ""); status != fiber.StatusUnauthorized {
+		t.Errorf("POST /webhooks without a token: %d", status)
+	}
+
+	for _, url := range []string{
+		"http://127.0.0.1/hook",
+		"http://127.0.0.2:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.10/hook",
+		"http://172.16.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://100.64.0.1/hook",
+		"http://0.0.0.0/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://[fd00::1]/hook",
+	} {
+		body := `{"url":"` + url + `","event_types":["*"]}`
+		if status := request(http.MethodPost, "/webhooks", body, token(1)); status != fiber.StatusUnprocessableEntity {
+			t.Errorf("POST /webhooks with %s: %d", url, status)
+		}
+	}
+
+	// Public addresses are accepted, and only their owner sees them
+	body := `{"url":"http://93.184.215.14/hook","event_types":["*"]}`
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token(1))
+	resp, err := webApp.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("POST /webhooks with a public address: %d", resp.StatusCode)
+	}
+	var created CreateWebhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := request(http.MethodGet, "/webhooks/"+created.ID, "", token(1)); status != fiber.StatusOK {
+		t.Errorf("GET own webhook: %d", status)
+	}
+	if status := request(http.MethodGet, "/webhooks/"+created.ID, "", token(2)); status != fiber.StatusNotFound {
+		t.Errorf("GET webhook of another user: %d", status)
+	}
+	if status := request(http.MethodDelete, "/webhooks/"+created.ID, "", token(2)); status != fiber.StatusNotFound {
+		t.Errorf("DELETE webhook of another user: %d", status)
+	}
+	if status := request(http.MethodDelete, "/webhooks/"+created.ID, "", token(1)); status != fiber.StatusNoContent {
+		t.Errorf("DELETE own webhook: %d", status)
+	}
+}
+
+// The delivery client refuses addresses which aren't public even when the
+// host resolved to a public one before
+func TestWebhookHTTPClientRejectsPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer server.Close()
+
+	_, err := NewWebhookHTTPClient(time.Second).Post(server.URL, fiber.MIMEApplicationJSON, strings.NewReader("{}"))
+	if err == nil || !strings.Contains(err.Error(), errWebhookURLNotPublic.Error()) {
+		t.Fatalf("got %v, want %v", err, errWebhookURLNotPublic)
+	}
+}
@@ -0,0 +1,224 @@
+package webserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Server side of the WebSocket protocol (RFC 6455), enough to push messages
+// to clients. The connection is taken over from fasthttp after the handshake
+
+const (
+	webSocketGUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketVersion = "13"
+	// Clients only answer control frames, bigger messages are refused
+	maxWebSocketFrameSize = 4096
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+const (
+	webSocketOpContinuation byte = 0x0
+	webSocketOpText         byte = 0x1
+	webSocketOpBinary       byte = 0x2
+	webSocketOpClose        byte = 0x8
+	webSocketOpPing         byte = 0x9
+	webSocketOpPong         byte = 0xA
+)
+
+const (
+	webSocketCloseNormal        = 1000
+	webSocketCloseProtocolError = 1002
+	webSocketCloseTooBig        = 1009
+	webSocketCloseTryAgainLater = 1013
+)
+
+var (
+	errWebSocketProtocol = errors.New("websocket protocol error")
+	errWebSocketTooBig   = errors.New("websocket frame is too big")
+)
+
+// webSocketConn writes frames from any goroutine, reads happen in one
+type webSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+	closed bool
+}
+
+// upgradeWebSocket checks the handshake and switches the connection to
+// WebSocket, handler runs with it after the 101 response is sent. Requests
+// which aren't valid handshakes are answered with 400 or 426
+func upgradeWebSocket(ctx *fiber.Ctx, handler func(ws *webSocketConn)) error {
+	if ctx.Method() != fiber.MethodGet || !headerHasToken(ctx.Get(fiber.HeaderConnection), "upgrade") {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid WebSocket handshake")
+	}
+	if ctx.Get(fiber.HeaderSecWebSocketVersion) != webSocketVersion {
+		ctx.Set(fiber.HeaderSecWebSocketVersion, webSocketVersion)
+		return ctx.Status(fiber.StatusUpgradeRequired).SendString("Unsupported WebSocket version")
+	}
+	key := ctx.Get(fiber.HeaderSecWebSocketKey)
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid Sec-WebSocket-Key")
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	ctx.Set(fiber.HeaderUpgrade, "websocket")
+	ctx.Set(fiber.HeaderConnection, "Upgrade")
+	ctx.Set(fiber.HeaderSecWebSocketAccept, base64.StdEncoding.EncodeToString(hash[:]))
+	ctx.Status(fiber.StatusSwitchingProtocols)
+
+	ctx.Context().Hijack(func(conn net.Conn) {
+		// Deadlines of the HTTP server don't apply to the stream
+		_ = conn.SetDeadline(time.Time{})
+		ws := &webSocketConn{conn: conn, reader: bufio.NewReader(conn)}
+		defer conn.Close()
+
+		handler(ws)
+	})
+
+	return nil
+}
+
+// headerHasToken reports whether the comma separated header contains the token
+func headerHasToken(header, token string) bool {
+	for _, value := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteMessage writes an unfragmented frame, server frames aren't masked
+func (ws *webSocketConn) WriteMessage(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("write websocket frame: %w", err)
+	}
+
+	return nil
+}
+
+// Close sends the close frame, later writes fail
+func (ws *webSocketConn) Close(code uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	err := ws.WriteMessage(webSocketOpClose, append(payload, reason...))
+
+	ws.mu.Lock()
+	ws.closed = true
+	ws.mu.Unlock()
+
+	return err
+}
+
+// readFrame reads the frame from the client, their frames must be masked
+func (ws *webSocketConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, errWebSocketProtocol
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxWebSocketFrameSize {
+		return 0, nil, errWebSocketTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return opcode, payload, nil
+}
+
+// ReadUntilClose answers pings and the close frame of the client, data
+// messages are dropped. It returns when the connection is closed
+func (ws *webSocketConn) ReadUntilClose() error {
+	for {
+		opcode, payload, err := ws.readFrame()
+		switch {
+		case errors.Is(err, errWebSocketProtocol):
+			_ = ws.Close(webSocketCloseProtocolError, "frames must be masked")
+			return err
+		case errors.Is(err, errWebSocketTooBig):
+			_ = ws.Close(webSocketCloseTooBig, "frame is too big")
+			return err
+		case err != nil:
+			return err
+		}
+
+		switch opcode {
+		case webSocketOpPing:
+			if err := ws.WriteMessage(webSocketOpPong, payload); err != nil {
+				return err
+			}
+		case webSocketOpClose:
+			code := uint16(webSocketCloseNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			return ws.Close(code, "")
+		case webSocketOpText, webSocketOpBinary, webSocketOpContinuation, webSocketOpPong:
+		default:
+			_ = ws.Close(webSocketCloseProtocolError, "unknown opcode")
+			return errWebSocketProtocol
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// readTestFrame reads a server frame and returns its opcode, the 7-bit
+// length code of the header and the payload. Server frames are never masked
+func readTestFrame(t *testing.T, r io.Reader) (byte, byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("read frame header: %v", err)
+	}
+	if header[0]&0x80 == 0 {
+		t.Fatalf("frame is fragmented")
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatalf("server frame is masked")
+	}
+
+	lengthCode := header[1] & 0x7F
+	length := uint64(lengthCode)
+	switch lengthCode {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			t.Fatalf("read frame length: %v", err)
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			t.Fatalf("read frame length: %v", err)
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read frame payload: %v", err)
+	}
+
+	return header[0] & 0x0F, lengthCode, payload
+}
+
+// testClientFrame builds a masked client frame, or an unmasked one
+// which servers must refuse
+func testClientFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length < 126:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	mask := []byte{0x37, 0xFA, 0x21, 0x3D}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+func TestWebSocketHandshakeAndFrames(t *testing.T) {
+	short := bytes.Repeat([]byte("a"), 200)
+	long := bytes.Repeat([]byte("b"), 70000)
+	done := make(chan error, 1)
+
+	webApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+	webApp.Get("/ws", func(ctx *fiber.Ctx) error {
+		return upgradeWebSocket(ctx, func(ws *webSocketConn) {
+			if err := ws.WriteMessage(webSocketOpText, short); err != nil {
+				done <- err
+				return
+			}
+			if err := ws.WriteMessage(webSocketOpBinary, long); err != nil {
+				done <- err
+				return
+			}
+			done <- ws.ReadUntilClose()
+		})
+	})
+
+	// Invalid handshakes are answered without switching protocols
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if resp, err := webApp.Test(req); err != nil || resp.StatusCode != fiber.StatusUpgradeRequired {
+		t.Fatalf("old version: got %v, %v, want %d", resp, err, fiber.StatusUpgradeRequired)
+	}
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=")
+	if resp, err := webApp.Test(req); err != nil || resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("short key: got %v, %v, want %d", resp, err, fiber.StatusBadRequest)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go webApp.Listener(listener)
+	defer webApp.Shutdown()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The key and the accept value are the example of RFC 6455 section 1.3
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, fiber.StatusSwitchingProtocols)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept %q", accept)
+	}
+
+	// 16-bit and 64-bit extended lengths
+	opcode, lengthCode, payload := readTestFrame(t, reader)
+	if opcode != webSocketOpText || lengthCode != 126 || !bytes.Equal(payload, short) {
+		t.Fatalf("got opcode %d, length code %d, %d bytes", opcode, lengthCode, len(payload))
+	}
+	opcode, lengthCode, payload = readTestFrame(t, reader)
+	if opcode != webSocketOpBinary || lengthCode != 127 || !bytes.Equal(payload, long) {
+		t.Fatalf("got opcode %d, length code %d, %d bytes", opcode, lengthCode, len(payload))
+	}
+
+	// Data messages of the client are skipped, pings are answered
+	if _, err := conn.Write(testClientFrame(webSocketOpText, bytes.Repeat([]byte("c"), 300), true)); err != nil {
+		t.Fatalf("write text: %v", err)
+	}
+	if _, err := conn.Write(testClientFrame(webSocketOpPing, []byte("ping"), true)); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	opcode, _, payload = readTestFrame(t, reader)
+	if opcode != webSocketOpPong || string(payload) != "ping" {
+		t.Fatalf("got opcode %d with %q, want pong", opcode, payload)
+	}
+
+	// The close frame is echoed with the code of the client
+	closePayload := binary.BigEndian.AppendUint16(nil, 4000)
+	if _, err := conn.Write(testClientFrame(webSocketOpClose, closePayload, true)); err != nil {
+		t.Fatalf("write close: %v", err)
+	}
+	opcode, _, payload = readTestFrame(t, reader)
+	if opcode != webSocketOpClose || !bytes.Equal(payload, closePayload) {
+		t.Fatalf("got opcode %d with %v, want close 4000", opcode, payload)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+}
+
+func TestWebSocketRejectsFrames(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     []byte
+		wantErr   error
+		wantClose uint16
+	}{
+		{
+			name:      "unmasked frame",
+			frame:     testClientFrame(webSocketOpText, []byte("hello"), false),
+			wantErr:   errWebSocketProtocol,
+			wantClose: webSocketCloseProtocolError,
+		},
+		{
+			name:      "frame with 64-bit length",
+			frame:     testClientFrame(webSocketOpBinary, make([]byte, 70000), true),
+			wantErr:   errWebSocketTooBig,
+			wantClose: webSocketCloseTooBig,
+		},
+		{
+			name:      "frame over the limit",
+			frame:     testClientFrame(webSocketOpText, make([]byte, maxWebSocketFrameSize+1), true),
+			wantErr:   errWebSocketTooBig,
+			wantClose: webSocketCloseTooBig,
+		},
+		{
+			name:      "unknown opcode",
+			frame:     testClientFrame(0x3, nil, true),
+			wantErr:   errWebSocketProtocol,
+			wantClose: webSocketCloseProtocolError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			ws := &webSocketConn{conn: server, reader: bufio.NewReader(server)}
+			done := make(chan error, 1)
+			go func() { done <- ws.ReadUntilClose() }()
+
+			// Pipes are synchronous, the server may stop reading the frame
+			// early and answer with the close frame
+			go func() { _, _ = client.Write(tt.frame) }()
+
+			opcode, _, payload := readTestFrame(t, client)
+			if opcode != webSocketOpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != tt.wantClose {
+				t.Fatalf("got opcode %d with %v, want close %d", opcode, payload, tt.wantClose)
+			}
+			if err := <-done; !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err := ws.WriteMessage(webSocketOpText, []byte("late")); !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("write after close: got %v, want %v", err, net.ErrClosed)
+			}
+		})
+	}
+}
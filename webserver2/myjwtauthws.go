@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/ermakovov/learn-golang/jsonpatch"
 	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,10 +26,12 @@ func StartJWTAuthServer() {
 
 	authorizedGroup := webApp.Group("")
 	authorizedGroup.Use(jwtware.New(jwtware.Config{
-		SigningKey: jwtware.SigningKey{Key: jwtSecretKey},
-		ContextKey: contextKeyUser,
+		SigningKey:     jwtware.SigningKey{Key: jwtSecretKey},
+		ContextKey:     contextKeyUser,
+		SuccessHandler: rejectAudienceTokens,
 	}))
 	authorizedGroup.Get("/profile", authHandler.GetUserData)
+	authorizedGroup.Patch("/profile", authHandler.PatchUserData)
 
 	port := "8080"
 	logrus.Fatal(webApp.Listen(":" + port))
@@ -40,10 +44,12 @@ type (
 
 	// In-memory storage of created users
 	AuthStorage struct {
-		users map[string]User
+		lastUserID int64
+		users      map[string]User
 	}
 
 	User struct {
+		ID       int64
 		Email    string
 		Name     string
 		password string
@@ -66,7 +72,9 @@ func (h *AuthHandler) CreateUser(c *fiber.Ctx) error {
 		return errors.New("User with provided email already exists")
 	}
 
+	h.storage.lastUserID++
 	h.storage.users[req.Email] = User{
+		ID:       h.storage.lastUserID,
 		Email:    req.Email,
 		Name:     req.Name,
 		password: req.Password,
@@ -107,6 +115,7 @@ func (h *AuthHandler) AuthUser(c *fiber.Ctx) error {
 
 	payload := jwt.MapClaims{
 		"sub": user.Email,
+		"uid": user.ID,
 		"exp": time.Now().Add(time.Hour * 72).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
@@ -120,10 +129,70 @@ func (h *AuthHandler) AuthUser(c *fiber.Ctx) error {
 }
 
 type GetUserDataResponse struct {
+	ID    int64  `json:"id"`
 	Email string `json:"email"`
 	Name  string `json:"Name"`
 }
 
+// profileDocument is the part of the profile that patch documents change
+type profileDocument struct {
+	Name string `json:"name"`
+}
+
+// PatchUserData changes the profile with a merge patch or a JSON patch
+func (h *AuthHandler) PatchUserData(c *fiber.Ctx) error {
+	jwtPayload, ok := jwtPayloadFromRequest(c)
+	if !ok {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	email, _ := jwtPayload["sub"].(string)
+	userData, ok := h.storage.users[email]
+	if !ok {
+		return errors.New("user not found")
+	}
+
+	mediaType, ok := jsonpatch.MediaType(c.Get(fiber.HeaderContentType))
+	if !ok {
+		return c.Status(fiber.StatusUnsupportedMediaType).
+			SendString("Content-Type must be " + jsonpatch.MediaTypeMergePatch + " or " + jsonpatch.MediaTypeJSONPatch)
+	}
+
+	doc := profileDocument{Name: userData.Name}
+	err := jsonpatch.ApplyTo(mediaType, c.Body(), &doc)
+	switch {
+	case errors.Is(err, jsonpatch.ErrInvalidPatch):
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case err != nil:
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(err.Error())
+	}
+
+	userData.Name = doc.Name
+	h.storage.users[email] = userData
+
+	return c.JSON(GetUserDataResponse{
+		ID:    userData.ID,
+		Email: userData.Email,
+		Name:  userData.Name,
+	})
+}
+
+// rejectAudienceTokens lets only access tokens through, tokens for other
+// audiences such as feed tokens don't give access to the API
+func rejectAudienceTokens(c *fiber.Ctx) error {
+	jwtPayload, ok := jwtPayloadFromRequest(c)
+	if !ok {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	if _, ok := jwtPayload["aud"]; ok {
+		return c.Status(fiber.StatusUnauthorized).SendString(errInvalidAccessToken.Error())
+	}
+
+	return c.Next()
+}
+
 func jwtPayloadFromRequest(c *fiber.Ctx) (jwt.MapClaims, bool) {
 	jwtToken, ok := c.Context().Value(contextKeyUser).(*jwt.Token)
 	if !ok {
@@ -157,7 +226,115 @@ func (h *AuthHandler) GetUserData(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(GetUserDataResponse{
+		ID:    userData.ID,
 		Email: userData.Email,
 		Name:  userData.Name,
 	})
 }
+
+// Claims of an access token issued by AuthUser
+type AccessTokenClaims struct {
+	Email  string
+	UserID int64
+}
+
+var errInvalidAccessToken = errors.New("invalid access token")
+
+// ParseAccessToken verifies an access token issued by this server, so other
+// servers can authenticate its users. Feed tokens are not access tokens
+func ParseAccessToken(tokenString string) (AccessTokenClaims, error) {
+	payload, err := parseToken(tokenString, jwtSecretKey)
+	if err != nil {
+		return AccessTokenClaims{}, err
+	}
+	if _, ok := payload["aud"]; ok {
+		return AccessTokenClaims{}, errInvalidAccessToken
+	}
+
+	return accessTokenClaims(payload)
+}
+
+// Feed tokens are put into URLs of calendar subscriptions, which can't send
+// headers. They are signed with their own key and valid only for feeds, so
+// a leaked URL doesn't give access to the API. Servers accepting them keep
+// the ID of the current token of every user to revoke older ones
+const (
+	feedTokenAudience = "task-feed"
+	feedTokenTTL      = 365 * 24 * time.Hour
+)
+
+var feedTokenSecretKey = []byte("feed-secret-phrase")
+
+// Claims of a feed token issued by IssueFeedToken
+type FeedTokenClaims struct {
+	AccessTokenClaims
+	TokenID string
+}
+
+// IssueFeedToken issues a feed token for the user of the access token
+func IssueFeedToken(claims AccessTokenClaims) (string, FeedTokenClaims, error) {
+	now := time.Now()
+	feedClaims := FeedTokenClaims{AccessTokenClaims: claims, TokenID: uuid.NewString()}
+	payload := jwt.MapClaims{
+		"sub": claims.Email,
+		"uid": claims.UserID,
+		"aud": feedTokenAudience,
+		"jti": feedClaims.TokenID,
+		"iat": now.Unix(),
+		"exp": now.Add(feedTokenTTL).Unix(),
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, payload).SignedString(feedTokenSecretKey)
+	if err != nil {
+		return "", FeedTokenClaims{}, err
+	}
+
+	return token, feedClaims, nil
+}
+
+// ParseFeedToken verifies a token issued by IssueFeedToken
+func ParseFeedToken(tokenString string) (FeedTokenClaims, error) {
+	payload, err := parseToken(tokenString, feedTokenSecretKey, jwt.WithAudience(feedTokenAudience))
+	if err != nil {
+		return FeedTokenClaims{}, err
+	}
+
+	claims, err := accessTokenClaims(payload)
+	if err != nil {
+		return FeedTokenClaims{}, err
+	}
+	tokenID, _ := payload["jti"].(string)
+	if tokenID == "" {
+		return FeedTokenClaims{}, errInvalidAccessToken
+	}
+
+	return FeedTokenClaims{AccessTokenClaims: claims, TokenID: tokenID}, nil
+}
+
+func parseToken(tokenString string, key []byte, options ...jwt.ParserOption) (jwt.MapClaims, error) {
+	options = append(options, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	}, options...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidAccessToken, err)
+	}
+
+	payload, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errInvalidAccessToken
+	}
+
+	return payload, nil
+}
+
+func accessTokenClaims(payload jwt.MapClaims) (AccessTokenClaims, error) {
+	email, _ := payload["sub"].(string)
+	// Numbers in JSON claims are decoded as float64
+	userID, _ := payload["uid"].(float64)
+	if email == "" || userID <= 0 {
+		return AccessTokenClaims{}, errInvalidAccessToken
+	}
+
+	return AccessTokenClaims{Email: email, UserID: int64(userID)}, nil
+}